@@ -1,6 +1,7 @@
 package build
 
 import (
+	cconf "github.com/pip-services3-go/pip-services3-commons-go/config"
 	cref "github.com/pip-services3-go/pip-services3-commons-go/refer"
 	cbuild "github.com/pip-services3-go/pip-services3-components-go/build"
 	connect "github.com/pip-services3-go/pip-services3-couchbase-go/connect"
@@ -8,11 +9,30 @@ import (
 
 /*
 Creates Couchbase components by their descriptors.
+
+Registered components:
+
+  - pip-services:connection:couchbase:*:1.0    CouchbaseConnection, the bucket is set by configuration
+  - pip-services:persistence:couchbase:<name>:1.0  persistences added by RegisterPersistence
+
+Configuration parameters:
+
+  - <descriptor name>:           (optional) defaults passed to Configure of created components
+                                 with the given descriptor name, for example:
+    - dummies.options.consistency: request_plus
+
+Example:
+
+	factory := build.NewDefaultCouchbaseFactory()
+	factory.RegisterPersistence("beacons", NewBeaconsCouchbasePersistence)
+	component, err := factory.Create(cref.NewDescriptor("pip-services", "persistence", "couchbase", "beacons", "1.0"))
+
 See:  Factory
 See:  CouchbaseConnection
 */
 type DefaultCouchbaseFactory struct {
 	*cbuild.Factory
+	config *cconf.ConfigParams
 }
 
 // NewDefaultCouchbaseFactory method are create a new instance of the factory.
@@ -22,7 +42,55 @@ func NewDefaultCouchbaseFactory() *DefaultCouchbaseFactory {
 	}
 
 	couchbaseConnectionDescriptor := cref.NewDescriptor("pip-services", "connection", "couchbase", "*", "1.0")
-	c.RegisterType(couchbaseConnectionDescriptor, connect.NewCouchbaseConnection)
+	// The constructor requires a bucket name, it is set later by bucket or connection.database configuration
+	c.Register(couchbaseConnectionDescriptor, func(locator interface{}) interface{} {
+		return connect.NewCouchbaseConnection("")
+	})
 
 	return c
 }
+
+// RegisterPersistence method are registers a persistence constructor
+// under pip-services:persistence:couchbase:<name>:1.0 descriptor.
+// Parameters:
+//   - name      a persistence name used in the descriptor.
+//   - factory   a parameterless constructor of the persistence.
+func (c *DefaultCouchbaseFactory) RegisterPersistence(name string, factory interface{}) {
+	descriptor := cref.NewDescriptor("pip-services", "persistence", "couchbase", name, "1.0")
+	c.RegisterType(descriptor, factory)
+}
+
+// Configure method are configures the factory with default parameters of created components.
+// Parameters:
+//   - config    configuration parameters to be set.
+func (c *DefaultCouchbaseFactory) Configure(config *cconf.ConfigParams) {
+	c.config = config
+}
+
+// Create method are creates a component identified by given locator.
+// When the factory has configuration section named after the descriptor name,
+// the created component is configured with it.
+// Parameters:
+//   - locator   a locator to identify component to be created.
+// Returns: interface{}, error
+// the created component or error.
+func (c *DefaultCouchbaseFactory) Create(locator interface{}) (interface{}, error) {
+	component, err := c.Factory.Create(locator)
+	if err != nil || component == nil || c.config == nil {
+		return component, err
+	}
+
+	descriptor, ok := locator.(*cref.Descriptor)
+	if !ok || descriptor.Name() == "" || descriptor.Name() == "*" {
+		return component, nil
+	}
+	configurable, ok := component.(cconf.IConfigurable)
+	if !ok {
+		return component, nil
+	}
+	section := c.config.GetSection(descriptor.Name())
+	if section.Len() > 0 {
+		configurable.Configure(section)
+	}
+	return component, nil
+}
@@ -1,6 +1,7 @@
 package connect
 
 import (
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,11 +21,16 @@ accessing c.Connection properties.
 
 Configuration parameters:
 
-  - bucket:                      (optional) Couchbase bucket name
+  - bucket:                      (optional) Couchbase bucket name (overrides connection.database)
   - connection(s):
     - discovery_key:             (optional) a key to retrieve the connection from connect.idiscovery.html IDiscovery]]
     - host:                      host name or IP address
     - port:                      port number (default: 27017)
+    - database:                  (optional) Couchbase bucket name, used when bucket is not set
+    - bucket_password:           (optional) bucket password for legacy (pre-RBAC) buckets
+    - protocol:                  (optional) connection protocol: couchbase or couchbases for TLS (default: couchbase)
+    - ssl:                       (optional) enable TLS connection, same as couchbases protocol (default: false)
+    - certpath:                  (optional) path to the certificate used to validate the server certificate
     - uri:                       resource URI or connection string with all parameters in it
   - credential(s):
     - store_key:                 (optional) a key to retrieve the credentials from auth.icredentialstore.html ICredentialStore]]
@@ -36,6 +42,20 @@ Configuration parameters:
     - flush_enabled:             (optional) bucket flush enabled (default: false)
     - bucket_type:               (optional) bucket type (default: couchbase)
     - ram_quota:                 (optional) RAM quota in MB (default: 100)
+    - replicas:                  (optional) number of replicas of the created bucket (default: 1)
+    - index_replicas:            (optional) replicate view indexes of the created bucket (default: true)
+    - eviction_policy:           (optional) not supported by the driver, a warning is logged when it is set
+    - bucket_password:           (optional) bucket password, used when connection.bucket_password is not set
+    - warm_up:                   (optional) ping the bucket and issue warm-up reads on open (default: false)
+    - warm_up_reads:             (optional) number of warm-up reads (default: 3)
+    - resolve_cache_ttl:         (optional) time in milliseconds to reuse resolved connection parameters (default: 0, no caching)
+    - validate_credentials:      (optional) require a password when a user name is set (default: true)
+    - connect_timeout:           (optional) connection timeout in milliseconds (default: 5 sec)
+    - operation_timeout:         (optional) key-value operation timeout in milliseconds (default: gocb default)
+    - max_pool_size:             (optional) number of key-value connections per node, used when connection.kv_pool_size is not set (default: 2)
+    - keep_alive:                (optional) enable connection keep alive, gocb always keeps connections alive (default: true)
+    - max_retries:               (optional) number of retries to connect and open the bucket (default: 0)
+    - retry_delay:               (optional) delay before the first retry in milliseconds, doubled on each next retry (default: 1 sec)
 
  References:
 
@@ -58,6 +78,9 @@ type CouchbaseConnection struct {
 	//The Couchbase bucket object.
 	Bucket        *gocb.Bucket
 	Authenticator gocb.PasswordAuthenticator
+
+	lastError  error
+	lastPingMs int64
 }
 
 // NewCouchbaseConnection are creates a new instance of the connection component.
@@ -75,6 +98,9 @@ func NewCouchbaseConnection(bucketName string) *CouchbaseConnection {
 		"options.flush_enabled", true,
 		"options.bucket_type", "couchbase",
 		"options.ram_quota", 100,
+		"options.connect_timeout", 5000,
+		"options.max_pool_size", 2,
+		"options.keep_alive", true,
 	)
 	c.Logger = clog.NewCompositeLogger()
 	c.ConnectionResolver = NewCouchbaseConnectionResolver()
@@ -88,6 +114,8 @@ func NewCouchbaseConnection(bucketName string) *CouchbaseConnection {
 func (c *CouchbaseConnection) Configure(config *cconf.ConfigParams) {
 	config = config.SetDefaults(c.defaultConfig)
 	c.ConnectionResolver.Configure(config)
+	// Bucket name precedence: "bucket", then "connection.database", then the constructor value
+	c.BucketName = config.GetAsStringWithDefault("connection.database", c.BucketName)
 	c.BucketName = config.GetAsStringWithDefault("bucket", c.BucketName)
 	c.Options = c.Options.Override(config.GetSection("options"))
 }
@@ -112,20 +140,54 @@ func (c *CouchbaseConnection) IsOpen() bool {
 // Returns: error
 // error or nil no errors occured.
 func (c *CouchbaseConnection) Open(correlationId string) (err error) {
+	defer func() { c.lastError = err }()
+
+	openStart := time.Now()
+	phaseStart := openStart
 
 	connection, resErr := c.ConnectionResolver.Resolve(correlationId)
 	if resErr != nil {
-		c.Logger.Error(correlationId, err, "Failed to resolve Couchbase connection")
+		c.Logger.Error(correlationId, resErr, "Failed to resolve Couchbase connection")
 		return resErr
 	}
+	c.logPhase(correlationId, "resolve", &phaseStart)
 
-	c.Logger.Debug(correlationId, "Connecting to couchbase")
+	c.Logger.Debug(correlationId, "Connecting to couchbase %s", maskUri(connection.Uri))
+	if strings.HasPrefix(connection.Uri, "couchbases://") &&
+		!strings.Contains(connection.Uri, "certpath=") {
+		c.Logger.Warn(correlationId, "TLS connection to couchbase has no certpath, server certificate is not verified")
+	}
 
-	cluster, conErr := gocb.Connect(connection.Uri)
+	// gocb doesn't accept a bucket in the connection string, the bucket is opened separately
+	uri := RemoveBucketFromUri(connection.Uri)
+	poolSize := c.Options.GetAsIntegerWithDefault("max_pool_size", 0)
+	if poolSize > 0 && !strings.Contains(uri, "kv_pool_size=") {
+		uri = addUriOption(uri, "kv_pool_size", strconv.Itoa(poolSize))
+	}
+	if !c.Options.GetAsBooleanWithDefault("keep_alive", true) {
+		c.Logger.Warn(correlationId, "Couchbase driver always keeps connections alive, keep_alive option is ignored")
+	}
+
+	var cluster *gocb.Cluster
+	conErr := c.retry(correlationId, "connect", func() (retryErr error) {
+		cluster, retryErr = gocb.Connect(uri)
+		return retryErr
+	})
 	if conErr != nil {
-		return conErr
+		err = cerr.NewConnectionError(correlationId, "CONNECT_FAILED", "Connection to couchbase "+maskUri(connection.Uri)+" failed").
+			WithCause(conErr)
+		c.Logger.Error(correlationId, err, "Failed to connect to couchbase")
+		return err
+	}
+	// Nodes are connected when the bucket is opened, so timeouts must be set before that
+	connectTimeout := c.Options.GetAsLongWithDefault("connect_timeout", 0)
+	if connectTimeout > 0 {
+		cluster.SetConnectTimeout(time.Duration(connectTimeout) * time.Millisecond)
+		cluster.SetServerConnectTimeout(time.Duration(connectTimeout) * time.Millisecond)
 	}
 	c.Connection = cluster
+	c.logPhase(correlationId, "connect", &phaseStart)
+
 	c.Authenticator = gocb.PasswordAuthenticator{
 		Username: connection.Username,
 		Password: connection.Password,
@@ -133,42 +195,27 @@ func (c *CouchbaseConnection) Open(correlationId string) (err error) {
 	if connection.Username != "" {
 		c.Connection.Authenticate(c.Authenticator)
 	}
+	c.logPhase(correlationId, "auth", &phaseStart)
 	err = nil
 	newBucket := false
 
 	autocreate := c.Options.GetAsBoolean("auto_create")
 	if autocreate {
 
-		bucketStrType := c.Options.GetAsStringWithDefault("bucket_type", "couchbase")
-		bucketType := gocb.BucketType(0) // couchbase
-
-		switch bucketStrType {
-		case "couchbase":
-			bucketType = gocb.BucketType(0)
-			break
-		case "memcached":
-			bucketType = gocb.BucketType(1)
-			break
-		case "ephemeral":
-			bucketType = gocb.BucketType(2)
-			break
-		}
-		options := gocb.BucketSettings{
-			Name:          c.BucketName,
-			Password:      "",
-			IndexReplicas: true,
-			Replicas:      1,
-			Type:          bucketType,
-			Quota:         int(c.Options.GetAsLongWithDefault("ram_quota", 100)),
-			FlushEnabled:  c.Options.GetAsBooleanWithDefault("flush_enabled", true),
+		if c.Options.GetAsString("eviction_policy") != "" {
+			c.Logger.Warn(correlationId, "Couchbase driver doesn't support bucket eviction policy, eviction_policy option is ignored")
 		}
+		options := c.ComposeBucketSettings()
 
 		err = c.Connection.Manager(connection.Username, connection.Password).InsertBucket(&options)
 
 		if err != nil && err.Error() != "" && strings.Index(err.Error(), "name already exist") < 0 {
+			c.Logger.Error(correlationId, err, "Failed to create bucket")
+			c.Connection.Close()
 			c.Connection = nil
 			c.Bucket = nil
-			return err
+			return cerr.NewConnectionError(correlationId, "CONNECT_FAILED", "Failed to create couchbase bucket "+c.BucketName).
+				WithCause(err)
 		}
 
 		if err == nil {
@@ -179,34 +226,125 @@ func (c *CouchbaseConnection) Open(correlationId string) (err error) {
 		select {
 		case <-time.After(time.Millisecond * 2000):
 		}
+		c.logPhase(correlationId, "auto_create", &phaseStart)
 	}
 
-	bucket, opnErr := c.Connection.OpenBucket(c.BucketName, "")
+	bucketPassword := connection.BucketPassword
+	if bucketPassword == "" {
+		bucketPassword = c.Options.GetAsString("bucket_password")
+	}
+	// Only opening is retried, so the bucket is never created twice
+	var bucket *gocb.Bucket
+	opnErr := c.retry(correlationId, "open bucket", func() (retryErr error) {
+		bucket, retryErr = c.Connection.OpenBucket(c.BucketName, bucketPassword)
+		return retryErr
+	})
 	if opnErr != nil {
-		c.Logger.Error(correlationId, err, "Failed to open bucket")
+		c.Logger.Error(correlationId, opnErr, "Failed to open bucket")
 		err = cerr.NewConnectionError(correlationId, "CONNECT_FAILED", "Connection to couchbase failed").WithCause(opnErr)
-		c.Bucket = nil
+		c.Connection.Close()
 		c.Connection = nil
 		c.Bucket = nil
 		return err
 	}
-	c.Logger.Debug(correlationId, "Connected to couchbase bucket %s", c.BucketName)
 	c.Bucket = bucket
+	operationTimeout := c.Options.GetAsLongWithDefault("operation_timeout", 0)
+	if operationTimeout > 0 {
+		c.Bucket.SetOperationTimeout(time.Duration(operationTimeout) * time.Millisecond)
+		c.Bucket.SetBulkOperationTimeout(time.Duration(operationTimeout) * time.Millisecond)
+	}
+	c.logPhase(correlationId, "open bucket", &phaseStart)
 
 	autoIndex := c.Options.GetAsBoolean("auto_index")
 	if newBucket || autoIndex {
 
 		err = c.Bucket.Manager("", "").CreatePrimaryIndex("", true, false)
 		if err != nil {
+			c.Logger.Error(correlationId, err, "Failed to create primary index")
+			c.Bucket.Close()
+			c.Connection.Close()
 			c.Connection = nil
 			c.Bucket = nil
-			return err
+			return cerr.NewConnectionError(correlationId, "CONNECT_FAILED", "Failed to create primary index in couchbase bucket "+c.BucketName).
+				WithCause(err)
 		}
+		c.logPhase(correlationId, "index", &phaseStart)
 	}
 
+	if c.Options.GetAsBooleanWithDefault("warm_up", false) {
+		c.warmUp(correlationId)
+		c.logPhase(correlationId, "warm up", &phaseStart)
+	}
+
+	c.Logger.Info(correlationId, "Connected to couchbase bucket %s in %d ms", c.BucketName, time.Since(openStart).Milliseconds())
 	return nil
 }
 
+// retry executes the operation and retries it up to options.max_retries times
+// with exponentially growing delay starting from options.retry_delay
+func (c *CouchbaseConnection) retry(correlationId string, phase string, operation func() error) error {
+	maxRetries := c.Options.GetAsIntegerWithDefault("max_retries", 0)
+	delay := time.Duration(c.Options.GetAsLongWithDefault("retry_delay", 1000)) * time.Millisecond
+
+	err := operation()
+	for attempt := 1; err != nil && attempt <= maxRetries; attempt++ {
+		c.Logger.Debug(correlationId, "Couchbase %s failed, retry %d of %d in %d ms: %s",
+			phase, attempt, maxRetries, delay.Milliseconds(), err.Error())
+		time.Sleep(delay)
+		delay *= 2
+		err = operation()
+	}
+	return err
+}
+
+// warmUp primes the connection pool by pinging the bucket and issuing a few reads.
+// It is best-effort: errors are logged and don't fail opening the connection.
+func (c *CouchbaseConnection) warmUp(correlationId string) {
+	_, pingErr := c.Bucket.Ping(nil)
+	if pingErr != nil {
+		c.Logger.Debug(correlationId, "Couchbase warm-up ping failed: %s", pingErr.Error())
+	}
+
+	reads := int(c.Options.GetAsIntegerWithDefault("warm_up_reads", 3))
+	for i := 0; i < reads; i++ {
+		var value interface{}
+		_, getErr := c.Bucket.Get("__warm_up__", &value)
+		// Missing key is expected, the read only opens connections to the node
+		if getErr != nil && !gocb.IsKeyNotFoundError(getErr) {
+			c.Logger.Debug(correlationId, "Couchbase warm-up read failed: %s", getErr.Error())
+		}
+	}
+}
+
+// logPhase writes elapsed time of the Open phase to the log and starts the next phase
+func (c *CouchbaseConnection) logPhase(correlationId string, phase string, phaseStart *time.Time) {
+	c.Logger.Debug(correlationId, "Couchbase connection phase '%s' completed in %d ms", phase, time.Since(*phaseStart).Milliseconds())
+	*phaseStart = time.Now()
+}
+
+// ComposeBucketSettings method are composes settings of the bucket created when auto_create option is set.
+// Returns: gocb.BucketSettings
+// the bucket settings composed from the configuration options.
+func (c *CouchbaseConnection) ComposeBucketSettings() gocb.BucketSettings {
+	bucketType := gocb.Couchbase
+	switch c.Options.GetAsStringWithDefault("bucket_type", "couchbase") {
+	case "memcached":
+		bucketType = gocb.Memcached
+	case "ephemeral":
+		bucketType = gocb.Ephemeral
+	}
+
+	return gocb.BucketSettings{
+		Name:          c.BucketName,
+		Password:      "",
+		IndexReplicas: c.Options.GetAsBooleanWithDefault("index_replicas", true),
+		Replicas:      c.Options.GetAsIntegerWithDefault("replicas", 1),
+		Type:          bucketType,
+		Quota:         int(c.Options.GetAsLongWithDefault("ram_quota", 100)),
+		FlushEnabled:  c.Options.GetAsBooleanWithDefault("flush_enabled", true),
+	}
+}
+
 // Closes component and frees used resources.
 // Parameters:
 //   - correlationId (optional) transaction id to trace execution through call chain.
@@ -218,10 +356,218 @@ func (c *CouchbaseConnection) Close(correlationId string) (err error) {
 	}
 	c.Connection = nil
 	c.Bucket = nil
+	// Connection parameters are resolved again on reconnect
+	c.ConnectionResolver.Invalidate()
 	c.Logger.Debug(correlationId, "Disconnected from couchbase bucket %s", c.BucketName)
 	return nil
 }
 
+// Ping method are checks that the cluster and the bucket are reachable
+// by pinging the key-value service and the query service when it is available.
+// Unlike IsOpen, it detects connections to the server that went away.
+// Parameters:
+//   - correlationId (optional) transaction id to trace execution through call chain.
+// Returns: error
+// error or nil when all services responded.
+func (c *CouchbaseConnection) Ping(correlationId string) error {
+	if !c.IsOpen() || c.Bucket == nil {
+		return cerr.NewInvalidStateError(correlationId, "NOT_OPENED", "Couchbase connection is not opened")
+	}
+
+	pingStart := time.Now()
+	report, pingErr := c.Bucket.Ping(nil)
+	if pingErr == nil {
+		// Ping reports failures of individual services instead of returning error
+		for _, service := range report.Services {
+			if !service.Success {
+				pingErr = cerr.NewConnectionError(correlationId, "PING_FAILED",
+					"Couchbase endpoint "+service.Endpoint+" didn't respond to ping")
+				break
+			}
+		}
+	}
+	if pingErr != nil {
+		c.lastError = pingErr
+		return cerr.NewConnectionError(correlationId, "PING_FAILED", "Failed to ping couchbase bucket "+c.BucketName).
+			WithCause(pingErr)
+	}
+	c.lastPingMs = time.Since(pingStart).Milliseconds()
+	return nil
+}
+
+// GetClusterManager method are returns cluster manager authenticated with the connection credentials
+// to perform administrative operations like listing buckets or managing users.
+// Parameters:
+//   - correlationId (optional) transaction id to trace execution through call chain.
+// Returns: *gocb.ClusterManager, error
+// the cluster manager or NOT_OPENED error.
+func (c *CouchbaseConnection) GetClusterManager(correlationId string) (*gocb.ClusterManager, error) {
+	if !c.IsOpen() {
+		return nil, cerr.NewInvalidStateError(correlationId, "NOT_OPENED", "Couchbase connection is not opened")
+	}
+	return c.Connection.Manager(c.Authenticator.Username, c.Authenticator.Password), nil
+}
+
+// GetBucketManager method are returns manager of the opened bucket authenticated
+// with the connection credentials to manage indexes and design documents.
+// Parameters:
+//   - correlationId (optional) transaction id to trace execution through call chain.
+// Returns: *gocb.BucketManager, error
+// the bucket manager or NOT_OPENED error.
+func (c *CouchbaseConnection) GetBucketManager(correlationId string) (*gocb.BucketManager, error) {
+	if !c.IsOpen() || c.Bucket == nil {
+		return nil, cerr.NewInvalidStateError(correlationId, "NOT_OPENED", "Couchbase connection is not opened")
+	}
+	return c.Bucket.Manager(c.Authenticator.Username, c.Authenticator.Password), nil
+}
+
+// ListBuckets method are returns settings of all buckets in the cluster.
+// The connection user must have cluster administration permissions.
+// Parameters:
+//   - correlationId (optional) transaction id to trace execution through call chain.
+// Returns: []*gocb.BucketSettings, error
+// the bucket settings or error.
+func (c *CouchbaseConnection) ListBuckets(correlationId string) ([]*gocb.BucketSettings, error) {
+	manager, err := c.GetClusterManager(correlationId)
+	if err != nil {
+		return nil, err
+	}
+	buckets, err := manager.GetBuckets()
+	if err != nil {
+		return nil, cerr.NewConnectionError(correlationId, "LIST_BUCKETS_FAILED", "Failed to list couchbase buckets").
+			WithCause(err)
+	}
+	return buckets, nil
+}
+
+// GetBucketStats method are returns statistics of the opened bucket collected from all servers.
+// Parameters:
+//   - correlationId (optional) transaction id to trace execution through call chain.
+//   - key           (optional) a statistics group like "memory" or "timings", empty for general statistics
+// Returns: gocb.ServerStats, error
+// statistics by server and name or error.
+func (c *CouchbaseConnection) GetBucketStats(correlationId string, key string) (gocb.ServerStats, error) {
+	if !c.IsOpen() || c.Bucket == nil {
+		return nil, cerr.NewInvalidStateError(correlationId, "NOT_OPENED", "Couchbase connection is not opened")
+	}
+	stats, err := c.Bucket.Stats(key)
+	if err != nil {
+		return nil, cerr.NewConnectionError(correlationId, "BUCKET_STATS_FAILED", "Failed to get stats of couchbase bucket "+c.BucketName).
+			WithCause(err)
+	}
+	return stats, nil
+}
+
+// GetIndexes method are returns indexes of the opened bucket with their state,
+// for instance to check that deferred indexes are built.
+// Parameters:
+//   - correlationId (optional) transaction id to trace execution through call chain.
+// Returns: []gocb.IndexInfo, error
+// the bucket indexes or error.
+func (c *CouchbaseConnection) GetIndexes(correlationId string) ([]gocb.IndexInfo, error) {
+	manager, err := c.GetBucketManager(correlationId)
+	if err != nil {
+		return nil, err
+	}
+	indexes, err := manager.GetIndexes()
+	if err != nil {
+		return nil, cerr.NewConnectionError(correlationId, "GET_INDEXES_FAILED", "Failed to get indexes of couchbase bucket "+c.BucketName).
+			WithCause(err)
+	}
+	return indexes, nil
+}
+
+// GetStatus method are returns the connection state for health checks.
+// When the connection is opened it pings the bucket to check that it is reachable.
+// Parameters:
+//   - correlationId (optional) transaction id to trace execution through call chain.
+// Returns: CouchbaseStatus
+// the current connection state.
+func (c *CouchbaseConnection) GetStatus(correlationId string) CouchbaseStatus {
+	if c.IsOpen() && c.Bucket != nil {
+		pingErr := c.Ping(correlationId)
+		if pingErr != nil {
+			c.Logger.Error(correlationId, pingErr, "Failed to ping couchbase bucket %s", c.BucketName)
+		}
+	}
+
+	return CouchbaseStatus{
+		Open:       c.IsOpen(),
+		Bucket:     c.BucketName,
+		LastError:  c.lastError,
+		LastPingMs: c.lastPingMs,
+	}
+}
+
+// RemoveBucketFromUri removes bucket (database) path from the connection string,
+// because gocb doesn't accept it and the bucket is opened separately.
+// The query string with connection options is kept.
+// Parameters:
+//   - uri     a connection string like "couchbase://host1,host2/bucket?option=value"
+// Returns: string the connection string without the bucket
+func RemoveBucketFromUri(uri string) string {
+	schemeEnd := strings.Index(uri, "://")
+	if schemeEnd < 0 {
+		return uri
+	}
+	hostsStart := schemeEnd + 3
+	pathStart := strings.Index(uri[hostsStart:], "/")
+	if pathStart < 0 {
+		return uri
+	}
+	pathStart += hostsStart
+	paramsStart := strings.Index(uri[pathStart:], "?")
+	if paramsStart < 0 {
+		return uri[:pathStart]
+	}
+	return uri[:pathStart] + uri[pathStart+paramsStart:]
+}
+
+// addUriOption adds an option to the query string of the connection string
+func addUriOption(uri string, key string, value string) string {
+	if strings.Contains(uri, "?") {
+		return uri + "&" + key + "=" + value
+	}
+	return uri + "?" + key + "=" + value
+}
+
+// maskUri replaces credentials in the connection string to write it into logs
+func maskUri(uri string) string {
+	schemeEnd := strings.Index(uri, "://")
+	if schemeEnd >= 0 {
+		hostsStart := schemeEnd + 3
+		hostsEnd := strings.IndexAny(uri[hostsStart:], "/?")
+		if hostsEnd < 0 {
+			hostsEnd = len(uri)
+		} else {
+			hostsEnd += hostsStart
+		}
+		// Remove user info before the hosts
+		userEnd := strings.LastIndex(uri[hostsStart:hostsEnd], "@")
+		if userEnd >= 0 {
+			uri = uri[:hostsStart] + "***@" + uri[hostsStart+userEnd+1:]
+		}
+	}
+
+	paramsStart := strings.Index(uri, "?")
+	if paramsStart < 0 {
+		return uri
+	}
+	params := strings.Split(uri[paramsStart+1:], "&")
+	for i, param := range params {
+		pos := strings.Index(param, "=")
+		if pos < 0 {
+			continue
+		}
+		key := strings.ToLower(param[:pos])
+		if strings.Contains(key, "user") || strings.Contains(key, "pass") ||
+			strings.Contains(key, "secret") || strings.Contains(key, "token") {
+			params[i] = param[:pos+1] + "***"
+		}
+	}
+	return uri[:paramsStart+1] + strings.Join(params, "&")
+}
+
 // GetConnection method are return opened connection
 func (c *CouchbaseConnection) GetConnection() *gocb.Cluster {
 	return c.Connection
@@ -1,7 +1,11 @@
 package connect
 
 import (
+	"net"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	cconf "github.com/pip-services3-go/pip-services3-commons-go/config"
 	cdata "github.com/pip-services3-go/pip-services3-commons-go/data"
@@ -10,13 +14,49 @@ import (
 	"github.com/pip-services3-go/pip-services3-components-go/auth"
 	cauth "github.com/pip-services3-go/pip-services3-components-go/auth"
 	ccon "github.com/pip-services3-go/pip-services3-components-go/connect"
+	clog "github.com/pip-services3-go/pip-services3-components-go/log"
 )
 
+// DefaultAllowedConnectionOptions are connection string options supported by gocb driver
+var DefaultAllowedConnectionOptions = []string{
+	"analytics_timeout", "bootstrap_on", "cacertpath", "cccp_max_wait", "cccp_poll_period", "certpath",
+	"compression", "compression_min_ratio", "compression_min_size", "config_node_timeout",
+	"config_poll_floor_interval", "config_poll_interval", "config_total_timeout", "fetch_mutation_tokens",
+	"fts_timeout", "http_idle_conn_timeout", "http_max_idle_conns", "http_max_idle_conns_per_host",
+	"http_redial_period", "http_retry_delay", "keypath", "kv_pool_size", "max_queue_size", "n1ql_timeout",
+	"network", "operation_timeout", "operation_tracing", "orphaned_response_logging",
+	"orphaned_response_logging_interval", "orphaned_response_logging_sample_size", "server_duration",
+	"use_enhanced_errors", "use_kverrmaps",
+}
+
+// connectionOptionTypes are value types of connection string options parsed by gocb,
+// their values are checked before passing them to the driver
+var connectionOptionTypes = map[string]string{
+	"analytics_timeout": "int", "cccp_max_wait": "int", "cccp_poll_period": "int", "compression": "bool",
+	"compression_min_ratio": "float", "compression_min_size": "int", "config_node_timeout": "int",
+	"config_poll_floor_interval": "int", "config_poll_interval": "int", "config_total_timeout": "int",
+	"fetch_mutation_tokens": "bool", "fts_timeout": "int", "http_idle_conn_timeout": "int",
+	"http_max_idle_conns": "int", "http_max_idle_conns_per_host": "int", "http_redial_period": "int",
+	"http_retry_delay": "int", "kv_pool_size": "int", "max_queue_size": "int", "n1ql_timeout": "int",
+	"operation_tracing": "bool", "orphaned_response_logging": "bool", "orphaned_response_logging_interval": "int",
+	"orphaned_response_logging_sample_size": "int", "server_duration": "bool", "use_enhanced_errors": "bool",
+	"use_kverrmaps": "bool",
+}
+
+// connectionOptionAliases map names of connection string options used by newer SDKs to names supported by gocb
+var connectionOptionAliases = map[string]string{
+	"query_timeout":  "n1ql_timeout",
+	"search_timeout": "fts_timeout",
+}
+
 /*
 CouchbaseConnectionResolver helper class that resolves Couchbase connection and credential parameters,
 validates them and generates a connection URI.
 
 It is able to process multiple connections to Couchbase cluster nodes.
+All nodes resolved from IDiscovery are added to the connection URI. To pick up
+cluster membership changes, the nodes are resolved again on each Open
+or after options.resolve_cache_ttl when caching is enabled.
 
 Configuration parameters:
 
@@ -25,14 +65,27 @@ Configuration parameters:
    - host:                        host name or IP address
    - port:                        port number (default: 27017)
    - database:                    database (bucket) name
+   - bucket_password:             (optional) bucket password for legacy (pre-RBAC) buckets
+   - protocol:                    (optional) connection protocol: couchbase or couchbases for TLS (default: couchbase)
+   - ssl:                         (optional) enable TLS connection, same as couchbases protocol (default: false)
+   - certpath:                    (optional) path to the certificate used to validate the server certificate
    - uri:                         resource URI or connection string with all parameters in it
+   - ...                          other connection string options supported by gocb (see DefaultAllowedConnectionOptions),
+                                  like n1ql_timeout, config_total_timeout or compression. Names are case insensitive,
+                                  query_timeout and search_timeout are accepted for n1ql_timeout and fts_timeout.
+                                  Unknown options are skipped with a warning, invalid values of known options fail resolution
  - credential(s):
    - store_key:                   (optional) a key to retrieve the credentials from auth.icredentialstore.html ICredentialStore
    - username:                    user name
    - password:                    user password
+ - options:
+   - allowed_connection_options:  (optional) comma-separated list of extra connection string options to pass to gocb
+   - resolve_cache_ttl:           (optional) time in milliseconds to reuse resolved connection parameters (default: 0, no caching)
+   - validate_credentials:        (optional) require a password when a user name is set, disable for buckets accessed by name without a password (default: true)
 
 References:
 
+- *:logger:*:*:1.0                (optional) ILogger components to pass log messages
 - *:discovery:*:*:1.0             (optional) IDiscovery services
 - *:credential-store:*:*:1.0      (optional) Credential stores to resolve credentials
 */
@@ -41,6 +94,18 @@ type CouchbaseConnectionResolver struct {
 	ConnectionResolver *ccon.ConnectionResolver
 	//The credentials resolver.
 	CredentialResolver *cauth.CredentialResolver
+	//The logger.
+	Logger *clog.CompositeLogger
+	//Connection string options that are allowed to be passed to gocb.
+	AllowedOptions map[string]bool
+	//Time to reuse resolved connection parameters, 0 disables caching.
+	CacheTimeout time.Duration
+	//Require a password when a user name is set.
+	ValidateCredentials bool
+
+	cacheLock    sync.Mutex
+	cached       *CouchbaseConnectionParams
+	cachedExpiry time.Time
 }
 
 // NewCouchbaseConnectionResolver method creates new instance of CouchbaseConnectionResolver
@@ -49,6 +114,12 @@ func NewCouchbaseConnectionResolver() *CouchbaseConnectionResolver {
 	ccr := CouchbaseConnectionResolver{}
 	ccr.ConnectionResolver = ccon.NewEmptyConnectionResolver()
 	ccr.CredentialResolver = cauth.NewEmptyCredentialResolver()
+	ccr.Logger = clog.NewCompositeLogger()
+	ccr.AllowedOptions = make(map[string]bool)
+	ccr.ValidateCredentials = true
+	for _, option := range DefaultAllowedConnectionOptions {
+		ccr.AllowedOptions[option] = true
+	}
 	return &ccr
 }
 
@@ -58,13 +129,34 @@ func NewCouchbaseConnectionResolver() *CouchbaseConnectionResolver {
 func (c *CouchbaseConnectionResolver) Configure(config *cconf.ConfigParams) {
 	c.ConnectionResolver.Configure(config)
 	c.CredentialResolver.Configure(config)
+
+	allowedOptions := config.GetAsString("options.allowed_connection_options")
+	for _, option := range strings.Split(allowedOptions, ",") {
+		option = strings.ToLower(strings.TrimSpace(option))
+		if option != "" {
+			c.AllowedOptions[option] = true
+		}
+	}
+	c.CacheTimeout = time.Duration(config.GetAsLongWithDefault("options.resolve_cache_ttl", 0)) * time.Millisecond
+	c.ValidateCredentials = config.GetAsBooleanWithDefault("options.validate_credentials", true)
+	c.Invalidate()
 }
 
 // Sets references to dependent components.
 // 	- references 	references to locate the component dependencies.
 func (c *CouchbaseConnectionResolver) SetReferences(references cref.IReferences) {
+	c.Logger.SetReferences(references)
 	c.ConnectionResolver.SetReferences(references)
 	c.CredentialResolver.SetReferences(references)
+	c.Invalidate()
+}
+
+// Invalidate method clears cached connection parameters,
+// so the next Resolve call performs discovery and credential lookups again.
+func (c *CouchbaseConnectionResolver) Invalidate() {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	c.cached = nil
 }
 
 func (c *CouchbaseConnectionResolver) validateConnection(correlationId string, connection *ccon.ConnectionParams) error {
@@ -82,6 +174,12 @@ func (c *CouchbaseConnectionResolver) validateConnection(correlationId string, c
 	if port == 0 {
 		return cerr.NewConfigError(correlationId, "NO_PORT", "Connection port is not set")
 	}
+
+	protocol := connection.Protocol()
+	if protocol != "" && protocol != "couchbase" && protocol != "couchbases" {
+		return cerr.NewConfigError(correlationId, "UNSUPPORTED_PROTOCOL", "The protocol "+protocol+" is not supported").
+			WithDetails("protocol", protocol)
+	}
 	// database = connection.getAsNullableString("database");
 	// if database == ""{
 	//     return cerr.NewConfigError(correlationId, "NO_DATABASE", "Connection database is not set");
@@ -103,7 +201,42 @@ func (c *CouchbaseConnectionResolver) validateConnections(correlationId string,
 	return nil
 }
 
-func (c *CouchbaseConnectionResolver) composeConnection(connections []*ccon.ConnectionParams, credential *cauth.CredentialParams) *CouchbaseConnectionParams {
+func (c *CouchbaseConnectionResolver) validateCredential(correlationId string, credential *cauth.CredentialParams) error {
+	if !c.ValidateCredentials || credential == nil {
+		return nil
+	}
+
+	// Without a password the connection fails later with an opaque authentication error
+	username := credential.Username()
+	if username != "" && credential.Password() == "" && !credential.UseCredentialStore() {
+		return cerr.NewConfigError(correlationId, "NO_PASSWORD", "Password is not set for user "+username).
+			WithDetails("username", username)
+	}
+	return nil
+}
+
+// validateConnectionOption checks that the value of the connection string option can be parsed by gocb
+func validateConnectionOption(correlationId string, key string, value string) error {
+	var err error
+	switch connectionOptionTypes[key] {
+	case "int":
+		_, err = strconv.ParseInt(value, 10, 64)
+	case "float":
+		_, err = strconv.ParseFloat(value, 64)
+	case "bool":
+		_, err = strconv.ParseBool(value)
+	}
+	if err != nil {
+		return cerr.NewConfigError(correlationId, "INVALID_CONNECTION_OPTION",
+			"Connection option "+key+" must be "+connectionOptionTypes[key]+", but got "+value).
+			WithDetails("option", key).
+			WithDetails("value", value)
+	}
+	return nil
+}
+
+func (c *CouchbaseConnectionResolver) composeConnection(correlationId string, connections []*ccon.ConnectionParams,
+	credential *cauth.CredentialParams) (*CouchbaseConnectionParams, error) {
 	result := new(CouchbaseConnectionParams)
 
 	if credential != nil {
@@ -113,32 +246,61 @@ func (c *CouchbaseConnectionResolver) composeConnection(connections []*ccon.Conn
 		}
 	}
 
+	// Connections resolved from discovery don't keep settings of the configured
+	// connection with discovery_key, so they are looked up there as well
+	configured := c.ConnectionResolver.GetAll()
+
+	// Legacy (pre-RBAC) buckets are protected by a bucket password
+	for _, connection := range append(connections, configured...) {
+		if result.BucketPassword == "" {
+			result.BucketPassword = connection.GetAsString("bucket_password")
+		}
+	}
+
 	// If there is a uri then return it immediately
 	for _, connection := range connections {
 		result.Uri = connection.Uri()
 		if result.Uri != "" {
-			return result
+			return result, nil
 		}
 	}
 
-	// Define hosts
+	// TLS is enabled when it is requested by any connection
+	ssl := false
+	for _, connection := range connections {
+		if connection.GetAsBoolean("ssl") || connection.Protocol() == "couchbases" {
+			ssl = true
+		}
+	}
+	defaultPort := 8091
+	if ssl {
+		defaultPort = 18091
+	}
+
+	// Define hosts, the same node may be both configured and discovered
 	hosts := ""
+	addedHosts := make(map[string]bool)
 	for _, connection := range connections {
-		host := connection.Host()
+		host := formatHost(connection.Host())
 		port := connection.Port()
 
+		if port > 0 && port != defaultPort {
+			host = host + ":" + strconv.FormatInt(int64(port), 10)
+		}
+		if addedHosts[host] {
+			continue
+		}
+		addedHosts[host] = true
+
 		if len(hosts) > 0 {
 			hosts += ","
 		}
-		if port > 0 && port != 8091 {
-			host = host + ":" + strconv.FormatInt(int64(port), 10)
-		}
 		hosts += host
 	}
 
 	// Define database
 	database := ""
-	for _, connection := range connections {
+	for _, connection := range append(connections, configured...) {
 		if database == "" {
 			database = connection.GetAsString("database")
 		}
@@ -166,17 +328,37 @@ func (c *CouchbaseConnectionResolver) composeConnection(connections []*ccon.Conn
 	options.Remove("database")
 	options.Remove("username")
 	options.Remove("password")
+	options.Remove("bucket_password")
+	options.Remove("protocol")
+	options.Remove("ssl")
 	params := ""
 	keys := options.Keys()
 
 	for _, key := range keys {
+		value := options.GetAsString(key)
+		// gocb expects lower case names, so a different case would be silently ignored by the driver
+		name := strings.ToLower(key)
+		if alias, ok := connectionOptionAliases[name]; ok {
+			name = alias
+		}
+
+		// Unknown options are not passed to the driver to keep connection string valid
+		if !c.AllowedOptions[name] {
+			c.Logger.Warn(correlationId, "Ignored unsupported Couchbase connection option %s", key)
+			continue
+		}
+		if value != "" {
+			if err := validateConnectionOption(correlationId, name, value); err != nil {
+				return nil, err
+			}
+		}
+
 		if len(params) > 0 {
 			params += "&"
 		}
 
-		params += key
+		params += name
 
-		value := options.GetAsString(key)
 		if value != "" {
 			params += "=" + value
 		}
@@ -185,16 +367,41 @@ func (c *CouchbaseConnectionResolver) composeConnection(connections []*ccon.Conn
 		params = "?" + params
 	}
 	// Compose uri
-	result.Uri = "couchbase://" + hosts + database + params
-	return result
+	scheme := "couchbase://"
+	if ssl {
+		scheme = "couchbases://"
+	}
+	result.Uri = scheme + hosts + database + params
+	return result, nil
+}
+
+// formatHost wraps IPv6 address in brackets, so it can be followed by a port in the connection string
+func formatHost(host string) string {
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") && net.ParseIP(host) != nil {
+		return "[" + host + "]"
+	}
+	return host
 }
 
 // Resolves Couchbase connection URI from connection and credential parameters.
+// When options.resolve_cache_ttl is set, resolved parameters are reused until they expire
+// or Invalidate is called.
 // Parameters:
 //   - correlationId     (optional) transaction id to trace execution through call chain.
 // Returns: connection *CouchbaseConnectionParams, err error
 // resolved connection params or error.
 func (c *CouchbaseConnectionResolver) Resolve(correlationId string) (connection *CouchbaseConnectionParams, err error) {
+	if c.CacheTimeout > 0 {
+		c.cacheLock.Lock()
+		if c.cached != nil && time.Now().Before(c.cachedExpiry) {
+			// Return a copy, so callers can't modify cached parameters
+			cached := *c.cached
+			c.cacheLock.Unlock()
+			return &cached, nil
+		}
+		c.cacheLock.Unlock()
+	}
+
 	var connections []*ccon.ConnectionParams
 	var credential *auth.CredentialParams
 
@@ -208,10 +415,24 @@ func (c *CouchbaseConnectionResolver) Resolve(correlationId string) (connection
 		return nil, err
 	}
 	credential, err = c.CredentialResolver.Lookup(correlationId)
-	// Credentials are not validated right now
 	if err != nil {
 		return nil, err
 	}
-	connection = c.composeConnection(connections, credential)
+	err = c.validateCredential(correlationId, credential)
+	if err != nil {
+		return nil, err
+	}
+	connection, err = c.composeConnection(correlationId, connections, credential)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.CacheTimeout > 0 {
+		c.cacheLock.Lock()
+		cached := *connection
+		c.cached = &cached
+		c.cachedExpiry = time.Now().Add(c.CacheTimeout)
+		c.cacheLock.Unlock()
+	}
 	return connection, nil
 }
@@ -0,0 +1,16 @@
+package connect
+
+/*
+CouchbaseStatus struct that describes the state of Couchbase component
+for health checks.
+*/
+type CouchbaseStatus struct {
+	// True if the component is opened
+	Open bool `json:"open"`
+	// The Couchbase bucket name
+	Bucket string `json:"bucket"`
+	// The last error occured while opening or pinging the connection
+	LastError error `json:"last_error"`
+	// Duration of the last successful ping in milliseconds
+	LastPingMs int64 `json:"last_ping_ms"`
+}
@@ -1,20 +1,29 @@
 module github.com/pip-services3-go/pip-services3-couchbase-go
 
-go 1.16
+go 1.18
 
 require (
-	github.com/golang/snappy v0.0.4 // indirect
-	github.com/opentracing/opentracing-go v1.2.0 // indirect
 	github.com/pip-services3-go/pip-services3-commons-go v1.1.6
 	github.com/pip-services3-go/pip-services3-components-go v1.3.2
 	github.com/pip-services3-go/pip-services3-data-go v1.1.11
-	github.com/pkg/errors v0.9.1 // indirect
 	github.com/stretchr/testify v1.8.1
+	gopkg.in/couchbase/gocb.v1 v1.6.7
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/golang/snappy v0.0.4 // indirect
+	github.com/google/uuid v1.3.0 // indirect
+	github.com/jinzhu/copier v0.3.5 // indirect
+	github.com/opentracing/opentracing-go v1.2.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/net v0.5.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
-	gopkg.in/couchbase/gocb.v1 v1.6.7
+	golang.org/x/text v0.6.0 // indirect
 	gopkg.in/couchbase/gocbcore.v7 v7.1.18 // indirect
 	gopkg.in/couchbaselabs/gocbconnstr.v1 v1.0.4 // indirect
 	gopkg.in/couchbaselabs/gojcbmock.v1 v1.0.4 // indirect
 	gopkg.in/couchbaselabs/jsonx.v1 v1.0.1 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
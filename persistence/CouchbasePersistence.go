@@ -4,7 +4,11 @@ import (
 	"encoding/json"
 	"math/rand"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	cconf "github.com/pip-services3-go/pip-services3-commons-go/config"
@@ -13,6 +17,7 @@ import (
 	cerr "github.com/pip-services3-go/pip-services3-commons-go/errors"
 	cref "github.com/pip-services3-go/pip-services3-commons-go/refer"
 	crefer "github.com/pip-services3-go/pip-services3-commons-go/refer"
+	ccount "github.com/pip-services3-go/pip-services3-components-go/count"
 	clog "github.com/pip-services3-go/pip-services3-components-go/log"
 	connect "github.com/pip-services3-go/pip-services3-couchbase-go/connect"
 	cmpersist "github.com/pip-services3-go/pip-services3-data-go/persistence"
@@ -37,11 +42,16 @@ accessing c._collection or c._model properties.
 
 Configuration parameters:
 
-  - bucket:                      (optional) Couchbase bucket name
+  - bucket:                      (optional) Couchbase bucket name (overrides connection.database)
   - connection(s):
     - discovery_key:             (optional) a key to retrieve the connection from connect.idiscovery.html IDiscovery
     - host:                      host name or IP address
     - port:                      port number (default: 27017)
+    - database:                  (optional) Couchbase bucket name, used when bucket is not set
+    - bucket_password:           (optional) bucket password for legacy (pre-RBAC) buckets
+    - protocol:                  (optional) connection protocol: couchbase or couchbases for TLS (default: couchbase)
+    - ssl:                       (optional) enable TLS connection, same as couchbases protocol (default: false)
+    - certpath:                  (optional) path to the certificate used to validate the server certificate
     - uri:                       resource URI or connection string with all parameters in it
   - credential(s):
     - store_key:                 (optional) a key to retrieve the credentials from auth.icredentialstore.html ICredentialStore
@@ -50,13 +60,44 @@ Configuration parameters:
   - options:
     - auto_create:               (optional) automatically create missing bucket (default: false)
     - auto_index:                (optional) automatically create primary index (default: false)
-    - flush_enabled:             (optional) bucket flush enabled (default: false)
+    - flush_enabled:             (optional) flush the whole bucket in Clear instead of deleting items of the collection,
+                                 also enables flush of auto-created bucket (default: false)
     - bucket_type:               (optional) bucket type (default: couchbase)
     - ram_quota:                 (optional) RAM quota in MB (default: 100)
+    - warm_up:                   (optional) ping the bucket and issue warm-up reads on open (default: false)
+    - collection_field:          (optional) name of the document field that stores collection name (default: _c)
+    - flatten_fields:            (optional) store nested object fields as top level fields with dotted keys (default: false)
+    - id_field:                  (optional) JSON name of the id field used to generate document keys (default: id)
+    - key_separator:             (optional) separator between collection name and id in document keys,
+                                 set it to empty string to keep keys of version 1.1 and earlier (default: ":")
+    - clear_wait_timeout:        (optional) time in milliseconds to wait until collection is empty after Clear (default: 0, no wait)
+    - max_scan:                  (optional) maximum number of items GetPageByFilter filter may match (default: 0, no limit)
+    - require_filter_for_delete: (optional) reject DeleteByFilter with empty filter, DeleteAll must be used instead (default: false)
+    - consistency:               (optional) N1QL query consistency: not_bounded, request_plus or statement_plus, can be overridden per call (default: depends on the method)
+    - query_timeout:             (optional) timeout in milliseconds for N1QL queries (default: gocb default)
+    - slow_query_threshold_ms:   (optional) log a warning when GetPageByFilter or GetListByFilter query takes longer (default: 0, disabled)
+    - default_ttl:               (optional) time to live in seconds of created and set items, up to 30 days
+                                 it is relative, otherwise it's absolute Unix time (default: 0, no expiry)
+    - read_only:                 (optional) reject all changes of data items, only reads are allowed (default: false)
+    - generate_correlation_id:   (optional) generate correlation id for operations called without it (default: false)
+    - query_pretty:              (optional) format N1QL query results with indentation (default: server default)
+    - query_metrics:             (optional) return N1QL query metrics, methods that need them always request them (default: server default)
+    - index_wait:                (optional) time in milliseconds to retry queries while index is not ready (default: 0, no retries)
+    - retry_budget_per_sec:      (optional) maximum number of retries per second shared by all operations: index waits,
+                                 concurrent update retries and repeats after reconnect (default: 0, no limit)
+    - bulk_timeout:              (optional) timeout in milliseconds for bulk operations, applied only to own connection,
+                                 shared connections are left to their owner (default: gocb default).
+                                 Durability requirements are not supported by gocb bulk operations
+    - max_write_concurrency:     (optional) maximum number of bulk write operations running in parallel (default: 0, no limit)
+    - auto_reconnect:            (optional) reopen lost own connection once and repeat GetOneById, Create and Update,
+                                 shared connections are left to their owner (default: true)
+    - persist_to:                (optional) number of nodes single item writes must be persisted to before they are acknowledged (default: 0)
+    - replicate_to:              (optional) number of replicas single item writes must be replicated to before they are acknowledged (default: 0)
 
  References:
 
 - *:logger:*:*:1.0           (optional) ILogger components to pass log messages
+- *:counters:*:*:1.0         (optional) ICounters components to pass operation call counts and timings
 - *:discovery:*:*:1.0        (optional) IDiscovery services
 - *:credential-store:*:*:1.0 (optional) Credential stores to resolve credentials
 
@@ -143,11 +184,19 @@ type CouchbasePersistence struct {
 	opened           bool
 	localConnection  bool
 	schemaStatements []schemaStatement
+	pendingOps       int64
+	retryBudget      *RetryBudget
+	reconnectLock    sync.Mutex
+	bucketLock       sync.RWMutex
+	keyGenerator     IKeyGenerator
+	operations       IBucketOperations
 
 	//The dependency resolver.
 	DependencyResolver *crefer.DependencyResolver
 	//The logger.
 	Logger *clog.CompositeLogger
+	//The performance counters.
+	Counters *ccount.CompositeCounters
 	//The Couchbase connection component.
 	Connection *connect.CouchbaseConnection
 	//The configuration options.
@@ -162,7 +211,16 @@ type CouchbasePersistence struct {
 	Prototype reflect.Type
 
 	CollectionName string
-	MaxPageSize    int
+	// Name of the document field that stores collection name
+	CollectionField string
+	MaxPageSize     int
+	// Name of the id field in stored documents (JSON name)
+	IdField string
+	// Separator between collection name and id in document keys
+	KeySeparator string
+	// Function that builds unique id from several fields of data item (composite keys).
+	// When it is not set the Id field of data item is used.
+	IdComposer func(item interface{}) interface{}
 }
 
 // InheritCouchbasePersistence method are creates a new instance of the persistence component.
@@ -180,16 +238,20 @@ func InheritCouchbasePersistence(overrides ICouchbasePersistenceOverrides, proto
 		"dependencies.connection", "*:connection:couchbase:*:1.0",
 		"options.auto_create", false,
 		"options.auto_index", true,
-		"options.flush_enabled", true,
 		"options.bucket_type", "couchbase",
 		"options.ram_quota", "100",
+		"options.collection_field", "_c",
 	)
 
 	cp.DependencyResolver = cref.NewDependencyResolverWithParams(cp.defaultConfig, cref.NewEmptyReferences())
 	cp.Logger = clog.NewCompositeLogger()
+	cp.Counters = ccount.NewCompositeCounters()
 	cp.Options = cconf.NewEmptyConfigParams()
 	cp.BucketName = bucket
 	cp.Prototype = proto
+	cp.CollectionField = "_c"
+	cp.IdField = "id"
+	cp.KeySeparator = ":"
 	return &cp
 }
 
@@ -199,19 +261,45 @@ func (c *CouchbasePersistence) Configure(config *cconf.ConfigParams) {
 	config = config.SetDefaults(c.defaultConfig)
 	c.config = config
 	c.DependencyResolver.Configure(config)
+	// Bucket name precedence: "bucket", then "connection.database", then the constructor value
+	c.BucketName = config.GetAsStringWithDefault("connection.database", c.BucketName)
 	c.BucketName = config.GetAsStringWithDefault("bucket", c.BucketName)
 	c.Options = c.Options.Override(config.GetSection("options"))
+	c.CollectionField = c.Options.GetAsStringWithDefault("collection_field", c.CollectionField)
+	c.IdField = c.Options.GetAsStringWithDefault("id_field", c.IdField)
+	// Empty separator is a valid value that keeps legacy keys
+	if separator, ok := c.Options.Value()["key_separator"]; ok {
+		c.KeySeparator = separator
+	}
+	c.retryBudget = nil
+	if retriesPerSec := c.Options.GetAsDoubleWithDefault("retry_budget_per_sec", 0); retriesPerSec > 0 {
+		c.retryBudget = NewRetryBudget(retriesPerSec)
+	}
 }
 
 // SetReferences method are sets references to dependent components.
+// When references are set again and a different connection is resolved, the opened
+// persistence is closed together with its local connection and must be reopened.
 // 	- references 	references to locate the component dependencies.
 func (c *CouchbasePersistence) SetReferences(references cref.IReferences) {
 	c.references = references
 	c.Logger.SetReferences(references)
+	c.Counters.SetReferences(references)
 	// Get connection
 	c.DependencyResolver.SetReferences(references)
 	resolve := c.DependencyResolver.GetOneOptional("connection")
-	c.Connection, _ = resolve.(*connect.CouchbaseConnection)
+	connection, _ := resolve.(*connect.CouchbaseConnection)
+
+	// Keep the owned local connection when no shared connection is referenced
+	if connection == nil && c.localConnection && c.Connection != nil {
+		c.Connection.SetReferences(references)
+		return
+	}
+	if c.Connection != nil && connection != c.Connection {
+		c.releaseConnection("")
+	}
+
+	c.Connection = connection
 	// Or create a local one
 	if c.Connection == nil {
 		c.Connection = c.createConnection()
@@ -222,14 +310,39 @@ func (c *CouchbasePersistence) SetReferences(references cref.IReferences) {
 }
 
 // UnsetReferences method is unsets (clears) previously set references to dependent components.
+// The opened persistence is closed together with its local connection,
+// the following operations fail with NOT_OPENED error until the persistence is reopened.
 func (c *CouchbasePersistence) UnsetReferences() {
+	c.releaseConnection("")
+	c.references = nil
 	c.Connection = nil
+	c.localConnection = false
+}
+
+// releaseConnection method closes the persistence and the local connection it owns
+// before the connection is replaced or removed.
+func (c *CouchbasePersistence) releaseConnection(correlationId string) {
+	if c.Connection == nil {
+		return
+	}
+	if c.opened {
+		c.Logger.Debug(correlationId, "Connection of %s is released, closing the persistence", c.CollectionName)
+	}
+	c.opened = false
+	c.setBucket(nil, nil)
+	if c.localConnection && c.Connection.IsOpen() {
+		if err := c.Connection.Close(correlationId); err != nil {
+			c.Logger.Error(correlationId, err, "Failed to close local connection of %s", c.CollectionName)
+		}
+	}
 }
 
-// Defines a database schema for this persistence
+// Defines a database schema for this persistence.
+// It is called during Open, child classes override it to declare
+// secondary indexes their filters require using EnsureIndex.
 func (c *CouchbasePersistence) DefineSchema() {
 	// Override in child classes
-	c.EnsureIndex(c.BucketName+"_collection", []string{"_c"}, true)
+	c.EnsureIndex(c.BucketName+"_collection", []string{c.CollectionField}, true)
 }
 
 // Adds index definition to create it on opening
@@ -258,30 +371,65 @@ func (c *CouchbasePersistence) ClearSchema() {
 	c.schemaStatements = make([]schemaStatement, 0)
 }
 
-// ConvertFromPublic method help convert object (map) from public view by added "_c" field with collection name
+// ConvertFromPublic method help convert object (map) from public view by added collection field (_c by default) with collection name
+// It panics when the item is not a map or struct, use ConvertFromPublicWithError to get an error instead.
 // Parameters:
 // 	  - item *interface{} item for convert
 // Returns: *interface{} converted item
 func (c *CouchbasePersistence) ConvertFromPublic(item interface{}) interface{} {
-	var value interface{} = item
-	if reflect.TypeOf(value).Kind() == reflect.Map {
-		m, ok := value.(map[string]interface{})
+	result, err := c.ConvertFromPublicWithError(item)
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+// ConvertFromPublicWithError method converts object (map or struct) from public view like ConvertFromPublic,
+// but returns an error instead of panic when the item can't be converted.
+// Parameters:
+// 	  - item interface{} item for convert
+// Returns: interface{}, error converted item or INVALID_ITEM error
+func (c *CouchbasePersistence) ConvertFromPublicWithError(item interface{}) (interface{}, error) {
+	value := c.publicValue(item)
+	if !value.IsValid() {
+		return nil, c.invalidItemError(item)
+	}
+
+	if value.Kind() == reflect.Map {
+		m, ok := value.Interface().(map[string]interface{})
 		if ok {
-			m["_c"] = c.CollectionName
-			return item
+			m[c.CollectionField] = c.CollectionName
+			if c.Options.GetAsBoolean("flatten_fields") {
+				return c.flattenItem(m), nil
+			}
+			return item, nil
 		}
-		return item
+		return item, nil
 	}
 
-	if reflect.TypeOf(value).Kind() == reflect.Struct {
-		jsonVal, _ := json.Marshal(item)
+	if value.Kind() == reflect.Struct {
+		jsonVal, jsonErr := json.Marshal(value.Interface())
+		if jsonErr != nil {
+			return nil, c.invalidItemError(item).WithCause(jsonErr)
+		}
 		resMap := make(map[string]interface{}, 0)
 		json.Unmarshal(jsonVal, &resMap)
-		resMap["_c"] = c.CollectionName
+		resMap[c.CollectionField] = c.CollectionName
+		if c.Options.GetAsBoolean("flatten_fields") {
+			resMap = FlattenDocument(resMap)
+		}
 		var result interface{} = resMap
-		return &result
+		return &result, nil
 	}
-	panic("ConvertFromPublic:Error! Item must to be a map[string]interface{} or struct!")
+	return nil, c.invalidItemError(item)
+}
+
+// flattenItem method normalizes map item through JSON and flattens its nested fields
+func (c *CouchbasePersistence) flattenItem(item map[string]interface{}) map[string]interface{} {
+	jsonVal, _ := json.Marshal(item)
+	resMap := make(map[string]interface{}, 0)
+	json.Unmarshal(jsonVal, &resMap)
+	return FlattenDocument(resMap)
 }
 
 // ConvertFromPublicPartial method are converts the given object from the public partial format.
@@ -291,35 +439,114 @@ func (c *CouchbasePersistence) ConvertFromPublicPartial(value interface{}) inter
 	return c.ConvertFromPublic(value)
 }
 
-// ConvertToPublic method is convert object (map) to public view by exluded "_c" field
+// ConvertToPublic method is convert object (map) to public view by exluded collection field (_c by default)
+// It panics when the item is not a map or struct, use ConvertToPublicWithError to get an error instead.
 // Parameters:
 // 	  - item *interface{}  item for convert
 // Returns: *interface{} converted item
 func (c *CouchbasePersistence) ConvertToPublic(item interface{}) interface{} {
-	var value interface{} = item
+	result, err := c.ConvertToPublicWithError(item)
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+// ConvertToPublicWithError method converts object (map or struct) to public view like ConvertToPublic,
+// but returns an error instead of panic when the item can't be converted.
+// Parameters:
+// 	  - item interface{}  item for convert
+// Returns: interface{}, error converted item or INVALID_ITEM error
+func (c *CouchbasePersistence) ConvertToPublicWithError(item interface{}) (interface{}, error) {
+	value := c.publicValue(item)
+	if !value.IsValid() {
+		return nil, c.invalidItemError(item)
+	}
 
-	if reflect.TypeOf(value).Kind() == reflect.Map {
-		m, ok := value.(map[string]interface{})
+	if value.Kind() == reflect.Map {
+		m, ok := value.Interface().(map[string]interface{})
 		if ok {
-			delete(m, "_c")
-			return m
+			delete(m, c.CollectionField)
+			return m, nil
+		}
+	}
+
+	if value.Kind() == reflect.Struct {
+		return item, nil
+	}
+	return nil, c.invalidItemError(item)
+}
+
+// publicValue returns value of the public item dereferencing pointers and interfaces,
+// or invalid value when the item is nil
+func (c *CouchbasePersistence) publicValue(item interface{}) reflect.Value {
+	value := reflect.ValueOf(item)
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return reflect.Value{}
 		}
+		value = value.Elem()
+	}
+	return value
+}
+
+// invalidItemError creates an error for items that can't be converted to or from public view
+func (c *CouchbasePersistence) invalidItemError(item interface{}) *cerr.ApplicationError {
+	itemType := "nil"
+	if item != nil {
+		itemType = reflect.TypeOf(item).String()
 	}
+	return cerr.NewBadRequestError("", "INVALID_ITEM", "Item must be a map[string]interface{} or struct").
+		WithDetails("type", itemType)
+}
+
+// convertFromPublic method converts the item from public view through the overrides
+// and turns a panic of the conversion into INVALID_ITEM error
+func (c *CouchbasePersistence) convertFromPublic(correlationId string, item interface{}) (result interface{}, err error) {
+	defer c.recoverConversion(correlationId, item, &err)
+	return c.Overrides.ConvertFromPublic(item), nil
+}
+
+// convertToPublic method converts the item to public view through the overrides
+// and turns a panic of the conversion into INVALID_ITEM error
+func (c *CouchbasePersistence) convertToPublic(correlationId string, item interface{}) (result interface{}, err error) {
+	defer c.recoverConversion(correlationId, item, &err)
+	return c.Overrides.ConvertToPublic(item), nil
+}
 
-	if reflect.TypeOf(value).Kind() == reflect.Struct {
-		return item
+// recoverConversion recovers a panic of a conversion and sets it as an error
+func (c *CouchbasePersistence) recoverConversion(correlationId string, item interface{}, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if appErr, ok := r.(*cerr.ApplicationError); ok {
+		*err = appErr.WithCorrelationId(correlationId)
+		return
 	}
-	panic("ConvertToPublic:Error! Item must to be a map[string]interface{} or struct!")
+	convErr := c.invalidItemError(item).WithCorrelationId(correlationId)
+	if cause, ok := r.(error); ok {
+		convErr = convErr.WithCause(cause)
+	} else {
+		convErr = convErr.WithDetails("reason", r)
+	}
+	*err = convErr
 }
 
+// QuoteIdentifier method escapes a bucket, field or index name with backticks
+// to use it in N1QL statements, so reserved words like "type" or names with hyphens
+// don't break the queries. Values that are already quoted are returned as is.
+// Parameters:
+//   - value             a name to escape.
+// Returns: string escaped name
 func (c *CouchbasePersistence) QuoteIdentifier(value string) string {
 	if value == "" {
 		return value
 	}
-	if value[0] == '`' {
+	if len(value) > 1 && value[0] == '`' && value[len(value)-1] == '`' {
 		return value
 	}
-	return "`" + value + "`"
+	return escapeName(value)
 }
 
 func (c *CouchbasePersistence) createConnection() *connect.CouchbaseConnection {
@@ -372,25 +599,108 @@ func (c *CouchbasePersistence) Open(correlationId string) (err error) {
 	if err != nil {
 		return err
 	}
-	c.Cluster = c.Connection.GetConnection()
-	c.Bucket = c.Connection.GetBucket()
+	c.configureBucket(c.Connection.GetBucket())
+	c.setBucket(c.Connection.GetConnection(), c.Connection.GetBucket())
 	c.BucketName = c.Connection.GetBucketName()
 
-	// Define database schema
+	// Define database schema, statements of the previous opening are cleared to avoid duplicates
+	c.ClearSchema()
 	c.Overrides.DefineSchema()
 
 	// Recreate objects
 	err = c.CreateSchema(correlationId)
 	if err != nil {
-		c.Cluster = nil
-		c.Bucket = nil
-		err = cerr.NewConnectionError(correlationId, "CONNECT_FAILED", "Connection to postgres failed").WithCause(err)
+		c.setBucket(nil, nil)
+		if c.localConnection {
+			c.Connection.Close(correlationId)
+		}
+		err = cerr.NewConnectionError(correlationId, "CONNECT_FAILED", "Connection to couchbase failed").WithCause(err)
 	} else {
 		c.opened = true
-		c.Logger.Debug(correlationId, "Connected to postgres database %s, collection %s", c.BucketName, c.QuoteIdentifier(c.CollectionName))
+		c.Logger.Debug(correlationId, "Connected to couchbase bucket %s, collection %s", c.BucketName, c.QuoteIdentifier(c.CollectionName))
 	}
 
-	return nil
+	return err
+}
+
+// configureBucket method applies persistence settings to the opened bucket.
+// Settings are applied only to the bucket of the owned connection,
+// a shared bucket is configured by its owner.
+func (c *CouchbasePersistence) configureBucket(bucket *gocb.Bucket) {
+	if !c.localConnection {
+		return
+	}
+	// Bulk operations timeout is set on the bucket and applies to all its bulk operations
+	bulkTimeout := c.Options.GetAsLongWithDefault("bulk_timeout", 0)
+	if bulkTimeout > 0 {
+		bucket.SetBulkOperationTimeout(time.Duration(bulkTimeout) * time.Millisecond)
+	}
+}
+
+// getBucket method returns the bucket used by operations. The bucket is replaced
+// when the owned connection is reopened, so it is read under the lock.
+func (c *CouchbasePersistence) getBucket() *gocb.Bucket {
+	c.bucketLock.RLock()
+	defer c.bucketLock.RUnlock()
+	return c.Bucket
+}
+
+// setBucket method replaces the cluster and the bucket used by operations
+func (c *CouchbasePersistence) setBucket(cluster *gocb.Cluster, bucket *gocb.Bucket) {
+	c.bucketLock.Lock()
+	defer c.bucketLock.Unlock()
+	c.Cluster = cluster
+	c.Bucket = bucket
+}
+
+// withReconnect method runs the operation and repeats it once after reconnection
+// when it failed because the connection to couchbase was lost.
+func (c *CouchbasePersistence) withReconnect(correlationId string, operation func() error) error {
+	bucket := c.getBucket()
+	err := operation()
+	if err != nil && c.reconnect(correlationId, bucket, err) {
+		err = operation()
+	}
+	return err
+}
+
+// reconnect method reopens the connection after an operation on the bucket failed with
+// a connection error and options.auto_reconnect is enabled. Only the connection owned by
+// the persistence is reopened, a shared connection is left to its owner.
+// Returns true when the connection was reopened and the operation can be repeated.
+func (c *CouchbasePersistence) reconnect(correlationId string, bucket *gocb.Bucket, err error) bool {
+	if !isConnectionError(err) || !c.opened || !c.Options.GetAsBooleanWithDefault("auto_reconnect", true) {
+		return false
+	}
+	if !c.acquireRetry() {
+		c.Logger.Debug(correlationId, "Retry budget of %s is exhausted, the operation is not repeated", c.BucketName)
+		return false
+	}
+
+	c.reconnectLock.Lock()
+	defer c.reconnectLock.Unlock()
+
+	// The connection may have been reopened already by another operation or its owner
+	if current := c.Connection.GetBucket(); current != nil && current != bucket {
+		c.configureBucket(current)
+		c.setBucket(c.Connection.GetConnection(), current)
+		return true
+	}
+	if !c.localConnection {
+		return false
+	}
+
+	c.Logger.Warn(correlationId, "Connection to couchbase bucket %s was lost, reconnecting: %s", c.BucketName, err.Error())
+	c.Connection.Close(correlationId)
+	openErr := c.Connection.Open(correlationId)
+	if openErr != nil {
+		c.Logger.Error(correlationId, openErr, "Failed to reconnect to couchbase bucket %s", c.BucketName)
+		return false
+	}
+	c.configureBucket(c.Connection.GetBucket())
+	c.setBucket(c.Connection.GetConnection(), c.Connection.GetBucket())
+	c.Logger.Info(correlationId, "Reconnected to couchbase bucket %s", c.BucketName)
+	return true
 }
 
 // Close method are closes component and frees used resources.
@@ -410,39 +720,181 @@ func (c *CouchbasePersistence) Close(correlationId string) (err error) {
 		err = c.Connection.Close(correlationId)
 	}
 	c.opened = false
-	c.Cluster = nil
-	c.Bucket = nil
+	c.setBucket(nil, nil)
+	return err
+}
+
+// DrainAndClose method are waits until all pending operations are completed
+// and closes the component. When the operations aren't completed in time
+// the component is closed anyway and the timeout error is returned.
+// Parameters:
+//   - correlationId 	(optional) transaction id to trace execution through call chain.
+//   - timeout          a maximum time to wait for pending operations.
+// Returns: error
+// error or nil no errors occured.
+func (c *CouchbasePersistence) DrainAndClose(correlationId string, timeout time.Duration) (err error) {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&c.pendingOps) > 0 && time.Now().Before(deadline) {
+		select {
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+
+	pending := atomic.LoadInt64(&c.pendingOps)
+	if pending > 0 {
+		c.Logger.Warn(correlationId, "Closing %s with %d pending operations", c.CollectionName, pending)
+		err = cerr.NewInvalidStateError(correlationId, "DRAIN_TIMEOUT", "Pending operations were not completed in time").
+			WithDetails("pending", pending)
+	}
+
+	closeErr := c.Close(correlationId)
+	if err == nil {
+		err = closeErr
+	}
 	return err
 }
 
+// ResolveCorrelationId method are returns the given correlation id, or generates a new one
+// when it is empty and options.generate_correlation_id is set.
+// Callers can use it to get the id to trace an operation before its execution.
+// Parameters:
+//   - correlationId 	(optional) transaction id to trace execution through call chain.
+// Returns: string
+// the correlation id to use in the operation.
+func (c *CouchbasePersistence) ResolveCorrelationId(correlationId string) string {
+	if correlationId == "" && c.Options.GetAsBoolean("generate_correlation_id") {
+		correlationId = cdata.IdGenerator.NextLong()
+	}
+	return correlationId
+}
+
+// DefaultTtl method are returns time to live of created items set by options.default_ttl.
+// Returns: uint32
+// time to live in seconds, 0 means no expiry.
+func (c *CouchbasePersistence) DefaultTtl() uint32 {
+	ttl := c.Options.GetAsLongWithDefault("default_ttl", 0)
+	if ttl < 0 {
+		return 0
+	}
+	return uint32(ttl)
+}
+
+// checkWritable method returns error when the persistence is configured as read-only
+func (c *CouchbasePersistence) checkWritable(correlationId string) error {
+	if c.Options.GetAsBoolean("read_only") {
+		return cerr.NewUnsupportedError(correlationId, "READ_ONLY", "Persistence is read-only, changes are not allowed").
+			WithDetails("collection", c.CollectionName)
+	}
+	return c.checkOpened(correlationId)
+}
+
+// checkOpened method returns NOT_OPENED error when the persistence isn't opened,
+// for instance after its references were unset
+func (c *CouchbasePersistence) checkOpened(correlationId string) error {
+	if !c.opened || c.getBucket() == nil {
+		return cerr.NewInvalidStateError(correlationId, "NOT_OPENED", "Couchbase persistence is not opened").
+			WithDetails("collection", c.CollectionName)
+	}
+	return nil
+}
+
+// trackOperation method counts pending operation, records "couchbase.<name>.calls"
+// and "couchbase.<name>.time" counters and returns function to complete it
+func (c *CouchbasePersistence) trackOperation(name string) func() {
+	atomic.AddInt64(&c.pendingOps, 1)
+	c.Counters.IncrementOne("couchbase." + name + ".calls")
+	timing := c.Counters.BeginTiming("couchbase." + name + ".time")
+	return func() {
+		timing.EndTiming()
+		atomic.AddInt64(&c.pendingOps, -1)
+	}
+}
+
+// GetStatus method are returns the persistence state for health checks.
+// Parameters:
+//   - correlationId 	(optional) transaction id to trace execution through call chain.
+// Returns: connect.CouchbaseStatus
+// the current persistence state.
+func (c *CouchbasePersistence) GetStatus(correlationId string) connect.CouchbaseStatus {
+	if c.Connection == nil {
+		return connect.CouchbaseStatus{Open: false, Bucket: c.BucketName}
+	}
+	status := c.Connection.GetStatus(correlationId)
+	status.Open = status.Open && c.opened
+	return status
+}
+
 // Clear method are clears component state.
+// By default it deletes only items of the collection, the whole bucket
+// is flushed only when options.flush_enabled is set.
 //   - correlationId 	(optional) transaction id to trace execution through call chain.
 // Returns: error
 // error or nil no errors occured.
 func (c *CouchbasePersistence) Clear(correlationId string) (err error) {
+	if writeErr := c.checkWritable(correlationId); writeErr != nil {
+		return writeErr
+	}
 	// Return error if collection is not set
 	if c.BucketName == "" {
 		return cerr.NewError("Bucket name is not defined")
 	}
 
-	flushErr := c.Bucket.Manager(c.Connection.Authenticator.Username, c.Connection.Authenticator.Password).Flush()
+	// Flush wipes items of all collections in the bucket
+	if !c.Options.GetAsBoolean("flush_enabled") {
+		return c.ClearCollection(correlationId)
+	}
+
+	flushErr := c.getBucket().Manager(c.Connection.Authenticator.Username, c.Connection.Authenticator.Password).Flush()
 	if flushErr != nil {
 		return cerr.NewConnectionError(correlationId, "FLUSH_FAILED", "Couchbase bucket flush failed").
-			WithCause(err)
+			WithCause(flushErr)
+	}
+
+	// Flush is asynchronous, so optionally wait until the collection becomes empty
+	waitTimeout := c.Options.GetAsLongWithDefault("clear_wait_timeout", 0)
+	if waitTimeout > 0 {
+		return c.waitUntilEmpty(correlationId, time.Duration(waitTimeout)*time.Millisecond)
 	}
 	return nil
 }
 
+// ClearCollection method are deletes all items of the collection
+// keeping items of other collections in the same bucket.
+// Parameters:
+//   - correlationId 	(optional) transaction id to trace execution through call chain.
+// Returns: error
+// error or nil no errors occured.
+func (c *CouchbasePersistence) ClearCollection(correlationId string) (err error) {
+	return c.DeleteAll(correlationId)
+}
+
+func (c *CouchbasePersistence) waitUntilEmpty(correlationId string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		count, countErr := c.GetCountByFilter(correlationId, "")
+		if countErr == nil && count == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return cerr.NewConnectionError(correlationId, "CLEAR_TIMEOUT", "Couchbase collection was not cleared in time").
+				WithDetails("collection", c.CollectionName).
+				WithCause(countErr)
+		}
+		select {
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+}
+
 func (c *CouchbasePersistence) CreateSchema(correlationId string) (err error) {
 	if c.schemaStatements == nil || len(c.schemaStatements) == 0 {
 		return nil
 	}
 
 	// Add indexes
-	mng := c.Bucket.Manager(c.Connection.Authenticator.Username, c.Connection.Authenticator.Password)
 	for _, statement := range c.schemaStatements {
 		if statement.Type == "index" {
-			err = mng.CreateIndex(statement.IndexName, statement.Fields, true, statement.Deferred)
+			err = c.CreateIndex(correlationId, statement.IndexName, statement.Fields, statement.Deferred)
 			if err != nil {
 				return err
 			}
@@ -452,7 +904,95 @@ func (c *CouchbasePersistence) CreateSchema(correlationId string) (err error) {
 	return nil
 }
 
-// GenerateBucketId method are generates unique id for specific collection in the bucket
+// CreateIndex method are creates a secondary index over given fields.
+// An existing index with the same name is not an error.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - name              an index name.
+//   - fields            indexed fields (index keys).
+//   - deferred          true to defer building the index until BuildDeferredIndexes is called.
+// Returns: error
+// error or nil no errors occured.
+func (c *CouchbasePersistence) CreateIndex(correlationId string, name string, fields []string, deferred bool) error {
+	err := c.indexManager().CreateIndex(name, fields, true, deferred)
+	if err != nil {
+		return cerr.NewInternalError(correlationId, "CREATE_INDEX_FAILED", "Failed to create index "+name).
+			WithDetails("index", name).
+			WithCause(err)
+	}
+	c.Logger.Debug(correlationId, "Created index %s in %s", name, c.BucketName)
+	return nil
+}
+
+// DropIndex method are drops a secondary index. A missing index is not an error.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - name              an index name.
+// Returns: error
+// error or nil no errors occured.
+func (c *CouchbasePersistence) DropIndex(correlationId string, name string) error {
+	err := c.indexManager().DropIndex(name, true)
+	if err != nil {
+		return cerr.NewInternalError(correlationId, "DROP_INDEX_FAILED", "Failed to drop index "+name).
+			WithDetails("index", name).
+			WithCause(err)
+	}
+	c.Logger.Debug(correlationId, "Dropped index %s in %s", name, c.BucketName)
+	return nil
+}
+
+// BuildDeferredIndexes method are builds all indexes that were created as deferred.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+// Returns: names []string, err error
+// names of indexes that are being built or error.
+func (c *CouchbasePersistence) BuildDeferredIndexes(correlationId string) (names []string, err error) {
+	names, err = c.indexManager().BuildDeferredIndexes()
+	if err != nil {
+		return nil, cerr.NewInternalError(correlationId, "BUILD_INDEXES_FAILED", "Failed to build deferred indexes").
+			WithCause(err)
+	}
+	c.Logger.Debug(correlationId, "Started building %d deferred indexes in %s", len(names), c.BucketName)
+	return names, nil
+}
+
+// indexManager method returns bucket manager authenticated with the connection credentials
+func (c *CouchbasePersistence) indexManager() *gocb.BucketManager {
+	return c.getBucket().Manager(c.Connection.Authenticator.Username, c.Connection.Authenticator.Password)
+}
+
+// SetKeyGenerator method are sets a generator of document keys used by all operations.
+// Parameters:
+//   - keyGenerator    a key generator, nil to compose keys of the collection name, KeySeparator and id.
+func (c *CouchbasePersistence) SetKeyGenerator(keyGenerator IKeyGenerator) {
+	c.keyGenerator = keyGenerator
+}
+
+// SetBucketOperations method are sets bucket operations used to execute N1QL queries,
+// bulk operations and document inserts instead of the opened bucket, for instance
+// to intercept or simulate them in tests.
+// Parameters:
+//   - operations      bucket operations, nil to run the operations on the opened bucket.
+func (c *CouchbasePersistence) SetBucketOperations(operations IBucketOperations) {
+	c.bucketLock.Lock()
+	defer c.bucketLock.Unlock()
+	c.operations = operations
+}
+
+// bucketOperations method returns operations set by SetBucketOperations
+// or operations that run on the opened bucket
+func (c *CouchbasePersistence) bucketOperations() IBucketOperations {
+	c.bucketLock.RLock()
+	defer c.bucketLock.RUnlock()
+	if c.operations != nil {
+		return c.operations
+	}
+	return NewBucketOperations(c.Bucket)
+}
+
+// GenerateBucketId method are generates unique id for specific collection in the bucket.
+// The id is generated by the key generator when it is set, otherwise it is composed
+// of the collection name, KeySeparator and the public id.
 // Parameters:
 //   - value a public unique id.
 // Retruns a unique bucket id.
@@ -460,7 +1000,129 @@ func (c *CouchbasePersistence) GenerateBucketId(value interface{}) string {
 	if value == nil {
 		return ""
 	}
-	return c.CollectionName + cconv.StringConverter.ToString(value)
+	// Composite keys can be passed as data items with key fields
+	if c.IdComposer != nil {
+		switch reflect.ValueOf(value).Kind() {
+		case reflect.Struct, reflect.Map, reflect.Ptr:
+			value = c.IdComposer(value)
+		}
+	}
+	if c.keyGenerator != nil {
+		return c.keyGenerator.GenerateBucketId(c.CollectionName, value)
+	}
+	generator := DefaultKeyGenerator{Separator: c.KeySeparator}
+	return generator.GenerateBucketId(c.CollectionName, value)
+}
+
+// ComposeId method are gets unique id of data item.
+// It uses IdComposer for composite keys or the id field of the item otherwise.
+// Parameters:
+//   - item a data item.
+// Returns unique id of the item.
+func (c *CouchbasePersistence) ComposeId(item interface{}) interface{} {
+	if c.IdComposer != nil {
+		return c.IdComposer(item)
+	}
+	if index := c.idFieldIndex(item); index != nil {
+		return c.structValue(item).FieldByIndex(index).Interface()
+	}
+	return cmpersist.GetProperty(item, c.IdField)
+}
+
+// GenerateObjectId method are assigns a new unique id to data item when it's empty.
+// Items with composite keys are left unchanged.
+// Parameters:
+//   - item a pointer to data item.
+func (c *CouchbasePersistence) GenerateObjectId(item *interface{}) {
+	if c.IdComposer != nil {
+		return
+	}
+	id := c.ComposeId(*item)
+	if id != nil && !reflect.ValueOf(id).IsZero() {
+		return
+	}
+
+	newId := cdata.IdGenerator.NextLong()
+	if reflect.ValueOf(*item).Kind() == reflect.Map {
+		cmpersist.SetProperty(*item, c.IdField, newId)
+		return
+	}
+	index := c.idFieldIndex(*item)
+	if index == nil {
+		cmpersist.GenerateObjectId(item)
+		return
+	}
+	// Set the field in addressable copy of the struct
+	isPtr := reflect.ValueOf(*item).Kind() == reflect.Ptr
+	value := reflect.New(c.structValue(*item).Type()).Elem()
+	value.Set(c.structValue(*item))
+	field := value.FieldByIndex(index)
+	if field.Kind() != reflect.String {
+		return
+	}
+	field.SetString(newId)
+	if isPtr {
+		reflect.ValueOf(*item).Elem().Set(value)
+	} else {
+		*item = value.Interface()
+	}
+}
+
+// CheckItemType method are checks that the item type matches the persistence prototype.
+// Items can be passed by value or by pointer, any map is accepted for map prototypes.
+// Parameters:
+//   - correlationId 	(optional) transaction id to trace execution through call chain.
+//   - item             a data item to check.
+// Returns: error
+// TYPE_MISMATCH error or nil if the item type is correct.
+func (c *CouchbasePersistence) CheckItemType(correlationId string, item interface{}) error {
+	if item == nil || c.Prototype == nil {
+		return nil
+	}
+	itemType := reflect.TypeOf(item)
+	protoType := c.Prototype
+	if protoType.Kind() == reflect.Ptr {
+		protoType = protoType.Elem()
+	}
+	if itemType.Kind() == reflect.Ptr {
+		itemType = itemType.Elem()
+	}
+
+	if protoType.Kind() == reflect.Map && itemType.Kind() == reflect.Map ||
+		itemType.AssignableTo(protoType) {
+		return nil
+	}
+	return cerr.NewBadRequestError(correlationId, "TYPE_MISMATCH", "Item type doesn't match the persistence prototype").
+		WithDetails("type", reflect.TypeOf(item).String()).
+		WithDetails("prototype", c.Prototype.String())
+}
+
+// structValue returns struct value of the item dereferencing pointers
+func (c *CouchbasePersistence) structValue(item interface{}) reflect.Value {
+	value := reflect.ValueOf(item)
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		value = value.Elem()
+	}
+	return value
+}
+
+// idFieldIndex returns index of the struct field with JSON name equal to IdField
+func (c *CouchbasePersistence) idFieldIndex(item interface{}) []int {
+	if item == nil {
+		return nil
+	}
+	value := c.structValue(item)
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == c.IdField && field.PkgPath == "" {
+			return field.Index
+		}
+	}
+	return nil
 }
 
 // Generates a list of unique ids for specific collection in the bucket
@@ -491,70 +1153,700 @@ func (c *CouchbasePersistence) GenerateBucketIds(value []interface{}) []string {
 // data page or error.
 func (c *CouchbasePersistence) GetPageByFilter(correlationId string, filter string, paging *cdata.PagingParams,
 	sort string, sel string) (page *cdata.DataPage, err error) {
+	return c.GetPageByFilterWithParams(correlationId, filter, nil, paging, sort, sel)
+}
+
+// GetPageByFilterWithParams method are gets a page of data items retrieved by a given filter
+// with query parameters and sorted according to sort parameters.
+// Values are passed to the filter through $name or $1 placeholders instead of
+// inlining them into the filter string, so they can't break the query.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - filter            (optional) a filter query string after WHERE clause with placeholders
+//   - params            (optional) named (map or *cdata.AnyValueMap) or positional (slice) query parameters
+//   - paging            (optional) paging parameters
+//   - sort              (optional) sorting string after ORDER BY clause
+//   - sel               (optional) projection string after SELECT clause
+// Returns:  page *cdata.DataPage, err error
+// data page or error.
+func (c *CouchbasePersistence) GetPageByFilterWithParams(correlationId string, filter string, params interface{},
+	paging *cdata.PagingParams, sort string, sel string) (page *cdata.DataPage, err error) {
+	return c.GetPageByFilterWithConsistency(correlationId, filter, params, paging, sort, sel, 0)
+}
+
+// GetPageByFilterWithSort method are gets a page of data items retrieved by a given filter
+// with query parameters and sorted by typed sort fields.
+// The ORDER BY clause is composed by ComposeSort, so field names are escaped properly.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - filter            (optional) a filter query string after WHERE clause with placeholders
+//   - params            (optional) named (map or *cdata.AnyValueMap) or positional (slice) query parameters
+//   - paging            (optional) paging parameters
+//   - sort              (optional) sort fields with their directions
+//   - sel               (optional) projection string after SELECT clause
+// Returns:  page *cdata.DataPage, err error
+// data page or error.
+func (c *CouchbasePersistence) GetPageByFilterWithSort(correlationId string, filter string, params interface{},
+	paging *cdata.PagingParams, sort *cdata.SortParams, sel string) (page *cdata.DataPage, err error) {
+	return c.GetPageByFilterWithParams(correlationId, filter, params, paging, c.ComposeSort(sort), sel)
+}
+
+// GetPageByFilterWithConsistency method are gets a page of data items retrieved by a given filter
+// with query parameters and sorted according to sort parameters using a given query consistency.
+// It allows to read own writes (gocb.RequestPlus) or to read faster (gocb.NotBounded) in a particular call.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - filter            (optional) a filter query string after WHERE clause with placeholders
+//   - params            (optional) named (map or *cdata.AnyValueMap) or positional (slice) query parameters
+//   - paging            (optional) paging parameters
+//   - sort              (optional) sorting string after ORDER BY clause
+//   - sel               (optional) projection string after SELECT clause
+//   - consistency       (optional) query consistency, 0 to use options.consistency (default: gocb.StatementPlus)
+// Returns:  page *cdata.DataPage, err error
+// data page or error.
+func (c *CouchbasePersistence) GetPageByFilterWithConsistency(correlationId string, filter string, params interface{},
+	paging *cdata.PagingParams, sort string, sel string, consistency gocb.ConsistencyMode) (page *cdata.DataPage, err error) {
+	page, _, err = c.getPageByFilter(correlationId, filter, params, paging, sort, sel, consistency)
+	return page, err
+}
+
+// GetPageByFilterWithStats method are gets a page of data items retrieved by a given filter
+// with query parameters together with metrics of the query reported by the server.
+// The stats describe the page query only, not the query that counts the total.
+// Parameters:
+//   - correlationId    (optional) transaction id to trace execution through call chain.
+//   - filter           (optional) a filter query string after WHERE clause with placeholders
+//   - params           (optional) named (map or *cdata.AnyValueMap) or positional (slice) query parameters
+//   - paging           (optional) paging parameters
+//   - sort             (optional) sorting string after ORDER BY clause
+//   - sel              (optional) projection string after SELECT clause
+// Returns: page *cdata.DataPage, stats QueryStats, err error
+// a data page, query metrics or error.
+func (c *CouchbasePersistence) GetPageByFilterWithStats(correlationId string, filter string, params interface{},
+	paging *cdata.PagingParams, sort string, sel string) (page *cdata.DataPage, stats QueryStats, err error) {
+	return c.getPageByFilter(correlationId, filter, params, paging, sort, sel, 0)
+}
+
+func (c *CouchbasePersistence) getPageByFilter(correlationId string, filter string, params interface{},
+	paging *cdata.PagingParams, sort string, sel string, consistency gocb.ConsistencyMode) (page *cdata.DataPage, stats QueryStats, err error) {
+	defer c.trackOperation("GetPageByFilter")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	params = normalizeQueryParams(params)
 
 	selectStatement := "*"
 	if sel != "" {
 		selectStatement = sel
 	}
-	statement := "SELECT " + selectStatement + " FROM `" + c.BucketName + "`"
-	// Adjust max item count based on configuration
-	if paging == nil {
-		paging = cdata.NewEmptyPagingParams()
+	statement, pagingEnabled, err := c.composePageStatement(correlationId, filter, params, paging, sort, selectStatement)
+	if err != nil {
+		return nil, stats, err
 	}
 
-	skip := paging.GetSkip(-1)
-	take := paging.GetTake(int64(c.MaxPageSize))
-	pagingEnabled := paging.Total
-	collectionFilter := "_c='" + c.CollectionName + "'"
-
-	if filter != "" {
-		filter = collectionFilter + " AND " + filter
-	} else {
-		filter = collectionFilter
-	}
-	statement += " WHERE " + filter
+	queryOptions := c.queryOptionsWithConsistency(consistency, gocb.StatementPlus)
+	queryStart := time.Now()
+	queryResp, queryErr := c.executeQuery(correlationId, statement, queryOptions, params)
 
-	if sort != "" {
-		statement += " ORDER BY " + sort
+	if queryErr != nil {
+		return nil, stats, queryErr
 	}
 
-	if skip >= 0 {
-		statement += " OFFSET " + strconv.FormatInt(int64(skip), 10)
+	items := make([]interface{}, 0, 0)
+	buf := make(map[string]interface{}, 0)
+	for queryResp.Next(&buf) {
+		var item interface{}
+		if selectStatement == "*" {
+			item = c.convertDocument(correlationId, "", buf[c.BucketName])
+		} else {
+			item = c.convertDocument(correlationId, "", buf)
+		}
+		items = append(items, item)
+	}
+	// Metrics are available only after the results are closed
+	if closeErr := queryResp.Close(); closeErr != nil {
+		return nil, stats, closeErr
+	}
+	stats = NewQueryStats(queryResp.Metrics())
+	c.logSlowQuery(correlationId, statement, queryStart)
+	if len(items) > 0 {
+		c.Logger.Trace(correlationId, "Retrieved %d from %s", len(items), c.BucketName)
+	}
+
+	page, err = c.composePage(correlationId, items, pagingEnabled, filter, params)
+	return page, stats, err
+}
+
+// GetPageByFilterWithProjection method are gets a page of data items with only given fields
+// retrieved by a given filter and sorted according to sort parameters.
+// Field names are escaped, so reserved words can be used as field names.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - filter            (optional) a filter query string after WHERE clause with placeholders
+//   - params            (optional) named (map or *cdata.AnyValueMap) or positional (slice) query parameters
+//   - paging            (optional) paging parameters
+//   - sort              (optional) sorting string after ORDER BY clause
+//   - fields            field paths to retrieve, like "name" or "address.city".
+// Returns:  page *cdata.DataPage, err error
+// data page with map[string]interface{} elements keyed by field paths or error.
+// Fields missing in a document are not included into its map.
+func (c *CouchbasePersistence) GetPageByFilterWithProjection(correlationId string, filter string, params interface{},
+	paging *cdata.PagingParams, sort string, fields []string) (page *cdata.DataPage, err error) {
+	defer c.trackOperation("GetPageByFilterWithProjection")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	params = normalizeQueryParams(params)
+	if len(fields) == 0 {
+		return nil, cerr.NewBadRequestError(correlationId, "NO_FIELDS", "Projection fields are not set")
 	}
-	statement = statement + " LIMIT " + strconv.FormatInt(int64(take), 10)
 
-	query := gocb.NewN1qlQuery(statement)
-	// Todo: Make it configurable?
-	query.Consistency(gocb.StatementPlus)
-	queryResp, queryErr := c.Bucket.ExecuteN1qlQuery(query, nil)
+	statement, pagingEnabled, err := c.composePageStatement(correlationId, filter, params, paging, sort, c.composeProjection(fields))
+	if err != nil {
+		return nil, err
+	}
 
+	queryOptions := c.ComposeQueryOptions(gocb.StatementPlus)
+	queryResp, queryErr := c.executeQuery(correlationId, statement, queryOptions, params)
 	if queryErr != nil {
 		return nil, queryErr
 	}
 
-	items := make([]interface{}, 0, 0)
+	items := make([]interface{}, 0)
 	buf := make(map[string]interface{}, 0)
 	for queryResp.Next(&buf) {
-		var item interface{}
-		if selectStatement == "*" {
-			item = c.ConvertFromMap(buf[c.BucketName])
-		} else {
-			item = c.ConvertFromMap(buf)
+		items = append(items, buf)
+		buf = make(map[string]interface{}, 0)
+	}
+	if closeErr := queryResp.Close(); closeErr != nil {
+		return nil, closeErr
+	}
+	if len(items) > 0 {
+		c.Logger.Trace(correlationId, "Retrieved %d from %s", len(items), c.BucketName)
+	}
+
+	return c.composePage(correlationId, items, pagingEnabled, filter, params)
+}
+
+// GetPageByFilterWithCursor method are gets a page of data items retrieved by a given filter
+// using keyset pagination: items are sorted by the cursor field and only items after
+// the cursor value are selected. Unlike OFFSET paging, the cost doesn't grow with the page depth.
+// The cursor field must be unique, otherwise items with equal values on the page boundary are skipped,
+// and it should be indexed together with the collection field to avoid scans.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - filter            (optional) a filter query string after WHERE clause
+//   - afterKey          (optional) a cursor returned with the previous page, nil for the first page
+//   - take              a page size, 0 to use the maximum page size (options.max_page_size)
+//   - sort              a cursor field path, optionally followed by DESC for descending order
+// Returns:  items []interface{}, nextCursor interface{}, err error
+// data items, a cursor for the next page (nil on the last page) or error.
+func (c *CouchbasePersistence) GetPageByFilterWithCursor(correlationId string, filter string, afterKey interface{},
+	take int, sort string) (items []interface{}, nextCursor interface{}, err error) {
+	defer c.trackOperation("GetPageByFilterWithCursor")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+
+	field := strings.TrimSpace(sort)
+	order, compare := " ASC", " > "
+	if upper := strings.ToUpper(field); strings.HasSuffix(upper, " DESC") {
+		field = strings.TrimSpace(field[:len(field)-len(" DESC")])
+		order, compare = " DESC", " < "
+	} else if strings.HasSuffix(upper, " ASC") {
+		field = strings.TrimSpace(field[:len(field)-len(" ASC")])
+	}
+	if field == "" {
+		return nil, nil, cerr.NewBadRequestError(correlationId, "NO_CURSOR_FIELD", "Cursor field is not set")
+	}
+	var paging *cdata.PagingParams
+	if take > 0 {
+		paging = cdata.NewPagingParams(nil, take, nil)
+	}
+	limit := c.ComposeTake(correlationId, paging)
+
+	cursorField := c.escapeFieldPath(field)
+	whereClause := c.composeFilter(filter)
+	params := map[string]interface{}{}
+	if afterKey != nil {
+		whereClause += " AND " + cursorField + compare + "$afterKey"
+		params["afterKey"] = afterKey
+	}
+	statement := "SELECT *, " + cursorField + " AS `_cursor` FROM " + c.QuoteIdentifier(c.BucketName) + " WHERE " + whereClause +
+		" ORDER BY " + cursorField + order + " LIMIT " + strconv.FormatInt(limit, 10)
+
+	queryOptions := c.ComposeQueryOptions(gocb.StatementPlus)
+	queryResp, queryErr := c.executeQuery(correlationId, statement, queryOptions, params)
+	if queryErr != nil {
+		return nil, nil, queryErr
+	}
+
+	items = make([]interface{}, 0)
+	var lastKey interface{}
+	buf := make(map[string]interface{}, 0)
+	for queryResp.Next(&buf) {
+		items = append(items, c.convertDocument(correlationId, "", buf[c.BucketName]))
+		lastKey = buf["_cursor"]
+		buf = make(map[string]interface{}, 0)
+	}
+	if closeErr := queryResp.Close(); closeErr != nil {
+		return nil, nil, wrapError(correlationId, closeErr)
+	}
+	c.Logger.Trace(correlationId, "Retrieved %d from %s after cursor %v", len(items), c.BucketName, afterKey)
+
+	// A short page is the last one
+	if int64(len(items)) == limit {
+		nextCursor = lastKey
+	}
+	return items, nextCursor, nil
+}
+
+// composeProjection method composes SELECT clause with escaped field paths aliased by the paths
+func (c *CouchbasePersistence) composeProjection(fields []string) string {
+	projection := ""
+	for _, field := range fields {
+		if len(projection) > 0 {
+			projection += ", "
 		}
-		items = append(items, item)
+		// Flattened documents keep dotted paths as top level field names
+		if c.Options.GetAsBoolean("flatten_fields") {
+			projection += c.escapeFieldPath(field)
+			continue
+		}
+		projection += c.escapeFieldPath(field) + " AS " + escapeName(field)
+	}
+	return projection
+}
+
+// escapeFieldPath method escapes a field path like "address.city" for N1QL statements.
+// Flattened documents keep dotted paths as top level field names.
+func (c *CouchbasePersistence) escapeFieldPath(field string) string {
+	if c.Options.GetAsBoolean("flatten_fields") {
+		return escapeName(field)
+	}
+	parts := strings.Split(field, ".")
+	for i, part := range parts {
+		parts[i] = escapeName(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+// ComposeSort method composes a sorting string for ORDER BY clause from typed sort fields.
+// Field paths like "address.city" are escaped with backticks, fields with empty names are skipped.
+// Parameters:
+//   - sort              sort fields with their directions
+// Returns: string sorting string like "`key` DESC, `name` ASC" or empty string if there are no fields
+func (c *CouchbasePersistence) ComposeSort(sort *cdata.SortParams) string {
+	if sort == nil {
+		return ""
+	}
+	fields := make([]string, 0, len(*sort))
+	for _, field := range *sort {
+		if field.Name == "" {
+			continue
+		}
+		order := " ASC"
+		if !field.Ascending {
+			order = " DESC"
+		}
+		fields = append(fields, c.escapeFieldPath(field.Name)+order)
+	}
+	return strings.Join(fields, ", ")
+}
+
+// escapeName escapes a single identifier with backticks
+func escapeName(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// quoteString escapes a string literal for N1QL statements
+func quoteString(value string) string {
+	value = strings.ReplaceAll(value, "\\", "\\\\")
+	return "'" + strings.ReplaceAll(value, "'", "\\'") + "'"
+}
+
+// GetPageWithCasByFilter method are gets a page of data items paired with their CAS values
+// retrieved by a given filter and sorted according to sort parameters.
+// The CAS values can be used to update the items with optimistic concurrency.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - filter            (optional) a filter query string after WHERE clause
+//   - paging            (optional) paging parameters
+//   - sort              (optional) sorting string after ORDER BY clause
+// Returns:  page *cdata.DataPage, err error
+// data page with ItemWithCas elements or error.
+func (c *CouchbasePersistence) GetPageWithCasByFilter(correlationId string, filter string, paging *cdata.PagingParams,
+	sort string) (page *cdata.DataPage, err error) {
+	defer c.trackOperation("GetPageWithCasByFilter")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+
+	// CAS is returned as a string because it doesn't fit into float64 JSON numbers
+	statement, pagingEnabled, err := c.composePageStatement(correlationId, filter, nil, paging, sort, "*, TOSTRING(META().cas) AS `_cas`")
+	if err != nil {
+		return nil, err
+	}
+
+	queryOptions := c.ComposeQueryOptions(gocb.StatementPlus)
+	queryResp, queryErr := c.executeQuery(correlationId, statement, queryOptions, nil)
+
+	if queryErr != nil {
+		return nil, queryErr
+	}
+
+	items := make([]interface{}, 0, 0)
+	buf := make(map[string]interface{}, 0)
+	for queryResp.Next(&buf) {
+		cas, _ := strconv.ParseUint(cconv.StringConverter.ToString(buf["_cas"]), 10, 64)
+		items = append(items, &ItemWithCas{
+			Item: c.convertDocument(correlationId, "", buf[c.BucketName]),
+			Cas:  gocb.Cas(cas),
+		})
+		buf = make(map[string]interface{}, 0)
+	}
+	if closeErr := queryResp.Close(); closeErr != nil {
+		return nil, wrapError(correlationId, closeErr)
 	}
 	if len(items) > 0 {
 		c.Logger.Trace(correlationId, "Retrieved %d from %s", len(items), c.BucketName)
 	}
 
+	return c.composePage(correlationId, items, pagingEnabled, filter, nil)
+}
+
+// composePageStatement method composes N1QL statement to read a page of data items
+func (c *CouchbasePersistence) composePageStatement(correlationId string, filter string, params interface{},
+	paging *cdata.PagingParams, sort string, selectStatement string) (statement string, pagingEnabled bool, err error) {
+
+	statement = "SELECT " + selectStatement + " FROM " + c.QuoteIdentifier(c.BucketName)
+	// Adjust max item count based on configuration
+	if paging == nil {
+		paging = cdata.NewEmptyPagingParams()
+	}
+
+	skip := paging.GetSkip(-1)
+	take := c.ComposeTake(correlationId, paging)
+	pagingEnabled = paging.Total
+	whereClause := c.composeFilter(filter)
+	statement += " WHERE " + whereClause
+
+	scanErr := c.checkScanLimit(correlationId, whereClause, params)
+	if scanErr != nil {
+		return "", false, scanErr
+	}
+
+	if sort != "" {
+		statement += " ORDER BY " + sort
+	}
+
+	if skip >= 0 {
+		statement += " OFFSET " + strconv.FormatInt(int64(skip), 10)
+	}
+	statement = statement + " LIMIT " + strconv.FormatInt(int64(take), 10)
+	return statement, pagingEnabled, nil
+}
+
+// defaultMaxPageSize is the page size used when MaxPageSize is not set
+const defaultMaxPageSize = 100
+
+// ComposeTake method returns the number of items to read in a page.
+// When paging doesn't set take, MaxPageSize is used. A larger requested take
+// is clamped to MaxPageSize (options.max_page_size), so clients can't read huge pages at once.
+// When MaxPageSize is not set, the default page size of 100 items is used instead.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - paging            (optional) paging parameters
+// Returns: int64 the number of items to read
+func (c *CouchbasePersistence) ComposeTake(correlationId string, paging *cdata.PagingParams) int64 {
+	if paging == nil || paging.Take == nil {
+		return c.maxPageSize()
+	}
+	if *paging.Take < 0 {
+		return 0
+	}
+	return c.clampTake(correlationId, *paging.Take)
+}
+
+// clampTake method limits the requested take by MaxPageSize and logs when it is clamped
+func (c *CouchbasePersistence) clampTake(correlationId string, take int64) int64 {
+	maxTake := c.maxPageSize()
+	if take > maxTake {
+		c.Logger.Debug(correlationId, "Requested page size %d in %s exceeds max page size, clamped to %d", take, c.CollectionName, maxTake)
+		return maxTake
+	}
+	return take
+}
+
+// maxPageSize method returns MaxPageSize or the default page size when it is not set
+func (c *CouchbasePersistence) maxPageSize() int64 {
+	if c.MaxPageSize <= 0 {
+		return defaultMaxPageSize
+	}
+	return int64(c.MaxPageSize)
+}
+
+// composePage method wraps retrieved items into a data page.
+// When total is requested it counts all items that match the filter.
+func (c *CouchbasePersistence) composePage(correlationId string, items []interface{}, pagingEnabled bool,
+	filter string, params interface{}) (*cdata.DataPage, error) {
+	var total int64 = 0
 	if pagingEnabled {
-		var total int64 = int64(len(items))
-		page = cdata.NewDataPage(&total, items)
-	} else {
-		var total int64 = 0
-		page = cdata.NewDataPage(&total, items)
+		count, err := c.countByWhere(correlationId, c.composeFilter(filter), params)
+		if err != nil {
+			return nil, err
+		}
+		total = count
+	}
+	return cdata.NewDataPage(&total, items), nil
+}
+
+// ExecuteViewQuery method are executes a query over design document view (map/reduce).
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - designDoc         a design document name.
+//   - viewName          a view name.
+//   - opts              view query options.
+// Returns: items []interface{}, err error
+// emitted values (or converted documents when opts.IncludeDocs is set) or error.
+func (c *CouchbasePersistence) ExecuteViewQuery(correlationId string, designDoc string, viewName string,
+	opts ViewOptions) (items []interface{}, err error) {
+	defer c.trackOperation("ExecuteViewQuery")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if openErr := c.checkOpened(correlationId); openErr != nil {
+		return nil, openErr
+	}
+
+	query := gocb.NewViewQuery(designDoc, viewName)
+	if opts.Key != nil {
+		query.Key(opts.Key)
+	}
+	if len(opts.Keys) > 0 {
+		query.Keys(opts.Keys)
+	}
+	if opts.StartKey != nil || opts.EndKey != nil {
+		query.Range(opts.StartKey, opts.EndKey, true)
+	}
+	if opts.Skip > 0 {
+		query.Skip(opts.Skip)
+	}
+	if opts.Limit > 0 {
+		query.Limit(opts.Limit)
+	}
+	query.Reduce(opts.Reduce)
+	if opts.Reduce && opts.Group {
+		query.Group(opts.Group)
+	}
+	if opts.Reduce && opts.GroupLevel > 0 {
+		query.GroupLevel(opts.GroupLevel)
+	}
+	if opts.Stale != 0 {
+		query.Stale(opts.Stale)
+	}
+
+	rows, viewErr := c.readViewRows(query)
+	if viewErr != nil {
+		return nil, viewErr
+	}
+
+	ids := make([]string, 0)
+	items = make([]interface{}, 0)
+	for _, row := range rows {
+		if opts.IncludeDocs {
+			if id, ok := row["id"].(string); ok {
+				ids = append(ids, id)
+			}
+		} else {
+			items = append(items, row["value"])
+		}
+	}
+
+	if opts.IncludeDocs && len(ids) > 0 {
+		var opItems []gocb.BulkOp
+		for _, id := range ids {
+			buf := make(map[string]interface{})
+			opItems = append(opItems, &gocb.GetOp{Key: id, Value: &buf})
+		}
+		doErr := c.bucketOperations().Do(opItems)
+		if doErr != nil {
+			return nil, doErr
+		}
+		for _, op := range opItems {
+			getOp := op.(*gocb.GetOp)
+			// Skip documents removed after the view was indexed
+			if getOp.Err != nil {
+				continue
+			}
+			items = append(items, c.convertDocument(correlationId, getOp.Key, *getOp.Value.(*map[string]interface{})))
+		}
+	}
+
+	c.Logger.Trace(correlationId, "Retrieved %d from %s view %s/%s", len(items), c.BucketName, designDoc, viewName)
+	return items, nil
+}
+
+// QueryView method are executes a prepared query over design document view (map/reduce).
+// Emitted object values are converted to the persistence prototype,
+// other values (keys, reduced values) are returned as they are.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - designDoc         a design document name.
+//   - viewName          a view name.
+//   - options           (optional) a query created by gocb.NewViewQuery for the same design document and view,
+//                       with stale mode, key ranges and other options set.
+// Returns: items []interface{}, err error
+// emitted values or error.
+func (c *CouchbasePersistence) QueryView(correlationId string, designDoc string, viewName string,
+	options *gocb.ViewQuery) (items []interface{}, err error) {
+	defer c.trackOperation("QueryView")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if openErr := c.checkOpened(correlationId); openErr != nil {
+		return nil, openErr
+	}
+
+	query := options
+	if query == nil {
+		query = gocb.NewViewQuery(designDoc, viewName)
+	}
+
+	rows, viewErr := c.readViewRows(query)
+	if viewErr != nil {
+		return nil, viewErr
+	}
+
+	items = make([]interface{}, 0)
+	for _, row := range rows {
+		if value, ok := row["value"].(map[string]interface{}); ok {
+			items = append(items, c.convertDocument(correlationId, "", value))
+		} else {
+			items = append(items, row["value"])
+		}
+	}
+
+	c.Logger.Trace(correlationId, "Retrieved %d from %s view %s/%s", len(items), c.BucketName, designDoc, viewName)
+	return items, nil
+}
+
+// readViewRows method executes the view query and reads all its rows
+func (c *CouchbasePersistence) readViewRows(query *gocb.ViewQuery) (rows []map[string]interface{}, err error) {
+	viewResp, viewErr := c.getBucket().ExecuteViewQuery(query)
+	if viewErr != nil {
+		return nil, viewErr
+	}
+
+	rows = make([]map[string]interface{}, 0)
+	row := make(map[string]interface{})
+	for viewResp.Next(&row) {
+		rows = append(rows, row)
+		row = make(map[string]interface{})
+	}
+	if closeErr := viewResp.Close(); closeErr != nil {
+		return nil, closeErr
+	}
+	return rows, nil
+}
+
+// composeFilter method adds collection condition to the filter.
+// The filter is wrapped in parentheses to keep precedence of its top level OR conditions.
+func (c *CouchbasePersistence) composeFilter(filter string) string {
+	collectionFilter := c.QuoteIdentifier(c.CollectionField) + "=" + quoteString(c.CollectionName)
+	if filter != "" {
+		return collectionFilter + " AND (" + filter + ")"
+	}
+	return collectionFilter
+}
+
+// checkScanLimit method checks that the number of items matching the where clause
+// doesn't exceed max_scan option. The check itself scans at most max_scan + 1 items.
+func (c *CouchbasePersistence) checkScanLimit(correlationId string, whereClause string, params interface{}) error {
+	maxScan := c.Options.GetAsLongWithDefault("max_scan", 0)
+	if maxScan <= 0 {
+		return nil
+	}
+
+	statement := "SELECT RAW COUNT(*) FROM (SELECT RAW 1 FROM " + c.QuoteIdentifier(c.BucketName) + " WHERE " + whereClause +
+		" LIMIT " + strconv.FormatInt(maxScan+1, 10) + ") AS s"
+	queryOptions := c.ComposeQueryOptions(gocb.RequestPlus)
+	queryResp, queryErr := c.executeQuery(correlationId, statement, queryOptions, params)
+	if queryErr != nil {
+		return queryErr
+	}
+
+	var count int64
+	if queryErr = queryResp.One(&count); queryErr != nil {
+		return queryErr
+	}
+	if count > maxScan {
+		return cerr.NewBadRequestError(correlationId, "SCAN_LIMIT_EXCEEDED", "Query filter matches more items than allowed to scan").
+			WithDetails("max_scan", maxScan).
+			WithDetails("collection", c.CollectionName)
+	}
+	return nil
+}
+
+// GetCountByFilter method are gets a number of data items retrieved by a given filter.
+// This method shall be called by a public getCountByFilter method from child class that
+// receives FilterParams and converts them into a filter string.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - filter            (optional) a filter query string after WHERE clause
+// Returns: count int64, err error
+// data count or error.
+func (c *CouchbasePersistence) GetCountByFilter(correlationId string, filter string) (count int64, err error) {
+	defer c.trackOperation("GetCountByFilter")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	count, err = c.countByWhere(correlationId, c.composeFilter(filter), nil)
+	if err != nil {
+		return 0, err
+	}
+	c.Logger.Trace(correlationId, "Counted %d items in %s", count, c.BucketName)
+	return count, nil
+}
+
+// Exists method are checks if any data item matches a given filter.
+// The query stops at the first match, so it is cheaper than counting or reading items.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - filter            (optional) a filter query string after WHERE clause
+// Returns: exists bool, err error
+// true if a matching item exists or error.
+func (c *CouchbasePersistence) Exists(correlationId string, filter string) (exists bool, err error) {
+	return c.ExistsWithParams(correlationId, filter, nil)
+}
+
+// ExistsWithParams method are checks if any data item matches a given filter with query parameters.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - filter            (optional) a filter query string after WHERE clause with placeholders
+//   - params            (optional) named (map or *cdata.AnyValueMap) or positional (slice) query parameters
+// Returns: exists bool, err error
+// true if a matching item exists or error.
+func (c *CouchbasePersistence) ExistsWithParams(correlationId string, filter string, params interface{}) (exists bool, err error) {
+	defer c.trackOperation("Exists")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	params = normalizeQueryParams(params)
+
+	statement := "SELECT RAW true FROM " + c.QuoteIdentifier(c.BucketName) + " WHERE " + c.composeFilter(filter) + " LIMIT 1"
+	queryOptions := c.ComposeQueryOptions(gocb.RequestPlus)
+	queryRes, queryErr := c.executeQuery(correlationId, statement, queryOptions, params)
+	if queryErr != nil {
+		return false, queryErr
+	}
+	var found bool
+	exists = queryRes.Next(&found)
+	if closeErr := queryRes.Close(); closeErr != nil {
+		return false, closeErr
+	}
+	c.Logger.Trace(correlationId, "Checked existence of items in %s: %t", c.BucketName, exists)
+	return exists, nil
+}
+
+// countByWhere method counts items that match the where clause
+func (c *CouchbasePersistence) countByWhere(correlationId string, whereClause string, params interface{}) (int64, error) {
+	statement := "SELECT COUNT(*) AS count FROM " + c.QuoteIdentifier(c.BucketName) + " WHERE " + whereClause
+	queryOptions := c.ComposeQueryOptions(gocb.RequestPlus)
+	queryResp, queryErr := c.executeQuery(correlationId, statement, queryOptions, params)
+	if queryErr != nil {
+		return 0, queryErr
+	}
+
+	buf := make(map[string]interface{}, 0)
+	if queryErr = queryResp.One(&buf); queryErr != nil {
+		return 0, queryErr
 	}
-	return page, nil
+	return cconv.LongConverter.ToLong(buf["count"]), nil
 }
 
 // GetListByFilter method are gets a list of data items retrieved by a given filter and sorted according to sort parameters.
@@ -569,41 +1861,229 @@ func (c *CouchbasePersistence) GetPageByFilter(correlationId string, filter stri
 // Returns:  items []interface{}, err error
 // data list or error.
 func (c *CouchbasePersistence) GetListByFilter(correlationId string, filter string, sort string, sel string) (items []interface{}, err error) {
+	return c.GetListByFilterWithParams(correlationId, filter, nil, sort, sel)
+}
+
+// GetListByFilterWithParams method are gets a list of data items retrieved by a given filter
+// with query parameters and sorted according to sort parameters.
+// Values are passed to the filter through $name or $1 placeholders instead of
+// inlining them into the filter string, so they can't break the query.
+// Parameters:
+//   - correlationId    (optional) transaction id to trace execution through call chain.
+//   - filter           (optional) a filter query string after WHERE clause with placeholders
+//   - params           (optional) named (map or *cdata.AnyValueMap) or positional (slice) query parameters
+//   - sort             (optional) sorting string after ORDER BY clause
+//   - sel              (optional) projection string after SELECT clause
+// Returns:  items []interface{}, err error
+// data list or error.
+func (c *CouchbasePersistence) GetListByFilterWithParams(correlationId string, filter string, params interface{},
+	sort string, sel string) (items []interface{}, err error) {
+	return c.GetListByFilterWithConsistency(correlationId, filter, params, sort, sel, 0)
+}
+
+// GetListByFilterWithConsistency method are gets a list of data items retrieved by a given filter
+// with query parameters and sorted according to sort parameters using a given query consistency.
+// Only items of the collection are returned.
+// Parameters:
+//   - correlationId    (optional) transaction id to trace execution through call chain.
+//   - filter           (optional) a filter query string after WHERE clause with placeholders
+//   - params           (optional) named (map or *cdata.AnyValueMap) or positional (slice) query parameters
+//   - sort             (optional) sorting string after ORDER BY clause
+//   - sel              (optional) projection string after SELECT clause
+//   - consistency      (optional) query consistency, 0 to use options.consistency (default: gocb.RequestPlus)
+// Returns:  items []interface{}, err error
+// data list or error.
+func (c *CouchbasePersistence) GetListByFilterWithConsistency(correlationId string, filter string, params interface{},
+	sort string, sel string, consistency gocb.ConsistencyMode) (items []interface{}, err error) {
+	defer c.trackOperation("GetListByFilter")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	params = normalizeQueryParams(params)
 
 	selectStatement := "*"
 	if sel != "" {
 		selectStatement = sel
 	}
-	statement := "SELECT " + selectStatement + " FROM `" + c.BucketName + "`"
-	// Adjust max item count based on configuration
-	if filter != "" {
-		statement += " WHERE " + filter
+	statement := "SELECT " + selectStatement + " FROM " + c.QuoteIdentifier(c.BucketName) + " WHERE " + c.composeFilter(filter)
+	if sort != "" {
+		statement += " ORDER BY " + sort
+	}
+	queryOptions := c.queryOptionsWithConsistency(consistency, gocb.RequestPlus)
+	queryStart := time.Now()
+	queryResp, queryErr := c.executeQuery(correlationId, statement, queryOptions, params)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	items = make([]interface{}, 0, 0)
+	buf := make(map[string]interface{}, 0)
+	for queryResp.Next(&buf) {
+		var item interface{}
+		if selectStatement == "*" {
+			item = c.convertDocument(correlationId, "", buf[c.BucketName])
+		} else {
+			item = c.convertDocument(correlationId, "", buf)
+		}
+		items = append(items, item)
+	}
+	if closeErr := queryResp.Close(); closeErr != nil {
+		return nil, wrapError(correlationId, closeErr)
+	}
+	c.logSlowQuery(correlationId, statement, queryStart)
+	if len(items) > 0 {
+		c.Logger.Trace(correlationId, "Retrieved %d from %s", len(items), c.BucketName)
+	}
+	return items, nil
+}
+
+// ForEachByFilter method are iterates over data items retrieved by a given filter and sorted
+// according to sort parameters. Items are read from the query results and passed to the callback
+// one by one, so large result sets are processed with bounded memory.
+// When the callback returns an error the iteration stops and the error is returned.
+// Parameters:
+//   - correlationId    (optional) transaction id to trace execution through call chain.
+//   - filter           (optional) a filter query string after WHERE clause with placeholders
+//   - params           (optional) named (map or *cdata.AnyValueMap) or positional (slice) query parameters
+//   - sort             (optional) sorting string after ORDER BY clause
+//   - sel              (optional) projection string after SELECT clause
+//   - callback         a function that receives each data item.
+// Returns: error
+// error or nil no errors occured.
+func (c *CouchbasePersistence) ForEachByFilter(correlationId string, filter string, params interface{},
+	sort string, sel string, callback func(item interface{}) error) (err error) {
+	defer c.trackOperation("ForEachByFilter")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	params = normalizeQueryParams(params)
+
+	selectStatement := "*"
+	if sel != "" {
+		selectStatement = sel
+	}
+	statement := "SELECT " + selectStatement + " FROM " + c.QuoteIdentifier(c.BucketName) + " WHERE " + c.composeFilter(filter)
+	if sort != "" {
+		statement += " ORDER BY " + sort
+	}
+	queryOptions := c.ComposeQueryOptions(gocb.RequestPlus)
+	queryResp, queryErr := c.executeQuery(correlationId, statement, queryOptions, params)
+	if queryErr != nil {
+		return queryErr
+	}
+
+	count := 0
+	buf := make(map[string]interface{}, 0)
+	for queryResp.Next(&buf) {
+		var item interface{}
+		if selectStatement == "*" {
+			item = c.convertDocument(correlationId, "", buf[c.BucketName])
+		} else {
+			item = c.convertDocument(correlationId, "", buf)
+		}
+		buf = make(map[string]interface{}, 0)
+		count++
+		if err = callback(item); err != nil {
+			break
+		}
+	}
+	// Closing releases the connection also when the iteration was stopped
+	closeErr := queryResp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	c.Logger.Trace(correlationId, "Iterated over %d items from %s", count, c.BucketName)
+	return nil
+}
+
+// GetByKeyPrefix method are gets a list of data items which public ids start with a given prefix.
+// The search is performed by a range scan over document keys (META().id), so a custom
+// key generator must keep the key of a prefix as a prefix of the item keys.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - prefix            a prefix of public ids (without collection name).
+//   - limit             (optional) maximum number of items to return, 0 for no limit.
+// Returns: items []interface{}, err error
+// data list or error.
+func (c *CouchbasePersistence) GetByKeyPrefix(correlationId string, prefix string, limit int) (items []interface{}, err error) {
+	defer c.trackOperation("GetByKeyPrefix")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	statement := "SELECT * FROM " + c.QuoteIdentifier(c.BucketName) + " WHERE META().id LIKE $prefix || '%' AND " + c.composeFilter("")
+	if limit > 0 {
+		statement += " LIMIT " + strconv.FormatInt(int64(limit), 10)
+	}
+
+	// Escape LIKE wildcards in the key prefix
+	keyPrefix := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(c.GenerateBucketId(prefix))
+	params := map[string]interface{}{"prefix": keyPrefix}
+
+	queryOptions := c.ComposeQueryOptions(gocb.RequestPlus)
+	queryResp, queryErr := c.executeQuery(correlationId, statement, queryOptions, params)
+	if queryErr != nil {
+		return nil, queryErr
 	}
+
+	items = make([]interface{}, 0)
+	buf := make(map[string]interface{}, 0)
+	for queryResp.Next(&buf) {
+		items = append(items, c.convertDocument(correlationId, "", buf[c.BucketName]))
+		buf = make(map[string]interface{}, 0)
+	}
+	if closeErr := queryResp.Close(); closeErr != nil {
+		return nil, closeErr
+	}
+	c.Logger.Trace(correlationId, "Retrieved %d from %s by key prefix %s", len(items), c.BucketName, prefix)
+	return items, nil
+}
+
+// GetOneByFilter method are gets the first data item retrieved by a given filter
+// and sorted according to sort parameters. It is handy to look up items by a unique business key.
+// This method shall be called by a public getOneByFilter method from child class that
+// receives FilterParams and converts them into a filter function.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - filter            (optional) a filter query string after WHERE clause
+//   - sort              (optional) sorting string after ORDER BY clause
+// Returns: item interface{}, err error
+// a found item, nil when nothing matches, or error.
+func (c *CouchbasePersistence) GetOneByFilter(correlationId string, filter string, sort string) (item interface{}, err error) {
+	return c.GetOneByFilterWithParams(correlationId, filter, nil, sort)
+}
+
+// GetOneByFilterWithParams method are gets the first data item retrieved by a given filter
+// with query parameters and sorted according to sort parameters.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - filter            (optional) a filter query string after WHERE clause with placeholders
+//   - params            (optional) named (map or *cdata.AnyValueMap) or positional (slice) query parameters
+//   - sort              (optional) sorting string after ORDER BY clause
+// Returns: item interface{}, err error
+// a found item, nil when nothing matches, or error.
+func (c *CouchbasePersistence) GetOneByFilterWithParams(correlationId string, filter string, params interface{},
+	sort string) (item interface{}, err error) {
+	defer c.trackOperation("GetOneByFilter")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	params = normalizeQueryParams(params)
+
+	statement := "SELECT * FROM " + c.QuoteIdentifier(c.BucketName) + " WHERE " + c.composeFilter(filter)
 	if sort != "" {
 		statement += " ORDER BY " + sort
 	}
-	query := gocb.NewN1qlQuery(statement)
-	// Todo: Make it configurable?
-	query.Consistency(gocb.RequestPlus)
-	queryResp, queryErr := c.Bucket.ExecuteN1qlQuery(query, nil)
+	statement += " LIMIT 1"
+	queryOptions := c.ComposeQueryOptions(gocb.RequestPlus)
+	queryRes, queryErr := c.executeQuery(correlationId, statement, queryOptions, params)
 	if queryErr != nil {
 		return nil, queryErr
 	}
-	items = make([]interface{}, 0, 0)
-	buf := make(map[string]interface{}, 0)
-	for queryResp.Next(&buf) {
-		var item interface{}
-		if selectStatement == "*" {
-			item = c.ConvertFromMap(buf[c.BucketName])
-		} else {
-			item = c.ConvertFromMap(buf)
-		}
-		items = append(items, item)
+	buf := make(map[string]interface{})
+	found := queryRes.Next(&buf)
+	if closeErr := queryRes.Close(); closeErr != nil {
+		return nil, closeErr
 	}
-	if len(items) > 0 {
-		c.Logger.Trace(correlationId, "Retrieved %d from %s", len(items), c.BucketName)
+	if !found {
+		c.Logger.Trace(correlationId, "Nothing found in %s with filter %s", c.BucketName, filter)
+		return nil, nil
 	}
-	return items, nil
+	c.Logger.Trace(correlationId, "Retrieved item from %s with filter %s", c.BucketName, filter)
+	return c.convertDocument(correlationId, "", buf[c.BucketName]), nil
 }
 
 // GetOneRandom method are gts a random item from items that match to a given filter.
@@ -615,72 +2095,241 @@ func (c *CouchbasePersistence) GetListByFilter(correlationId string, filter stri
 // Returns: item interface{}, err error
 // a random item or error.
 func (c *CouchbasePersistence) GetOneRandom(correlationId string, filter string) (item interface{}, err error) {
-
-	statement := "SELECT COUNT(*) FROM `" + c.BucketName + "`"
-	// Adjust max item count based on configuration
-	if filter != "" {
-		statement += " WHERE " + filter
+	defer c.trackOperation("GetOneRandom")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+
+	// Both queries are scoped to the collection
+	whereClause := c.composeFilter(filter)
+	count, countErr := c.countByWhere(correlationId, whereClause, nil)
+	if countErr != nil {
+		return nil, countErr
+	}
+	if count == 0 {
+		return nil, nil
 	}
 
-	query := gocb.NewN1qlQuery(statement)
-	// Todo: Make it configurable?
-	query.Consistency(gocb.RequestPlus)
-	queryRes, queryErr := c.Bucket.ExecuteN1qlQuery(query, nil)
-
-	count := queryRes.Metrics().ResultCount
-
-	if queryErr != nil || count == 0 {
+	rand.Seed(time.Now().UnixNano())
+	skip := rand.Int63n(count)
+	statement := "SELECT * FROM " + c.QuoteIdentifier(c.BucketName) + " WHERE " + whereClause +
+		" OFFSET " + strconv.FormatInt(skip, 10) + " LIMIT 1"
+	queryOptions := c.ComposeQueryOptions(gocb.RequestPlus)
+	queryRes, queryErr := c.executeQuery(correlationId, statement, queryOptions, nil)
+	if queryErr != nil {
 		return nil, queryErr
 	}
-	statement = "SELECT * FROM `" + c.BucketName + "`"
-	// Adjust max item count based on configuration
-	if filter != "" {
-		statement += " WHERE " + filter
+	buf := make(map[string]interface{})
+	found := queryRes.Next(&buf)
+	if closeErr := queryRes.Close(); closeErr != nil {
+		return nil, closeErr
 	}
-	rand.Seed(time.Now().UnixNano())
-	skip := rand.Int63n(int64(count))
-	if skip < 0 {
-		skip = 0
+	// The item may be deleted between the queries
+	if !found {
+		return nil, nil
+	}
+	item = c.convertDocument(correlationId, "", buf[c.BucketName])
+	c.Logger.Trace(correlationId, "Retrieved random item from %s", c.BucketName)
+	return item, nil
+}
+
+// SampleRandom method are gets a pseudo-random sample of items from the collection.
+// It runs a single query with random ordering, so it is suitable for test data generation
+// rather than for statistically strict sampling.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - count             a maximum number of items to return.
+// Returns: items []interface{}, err error
+// up to count random items or error.
+func (c *CouchbasePersistence) SampleRandom(correlationId string, count int) (items []interface{}, err error) {
+	defer c.trackOperation("SampleRandom")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	items = make([]interface{}, 0)
+	if count <= 0 {
+		return items, nil
 	}
-	statement += " OFFSET " + strconv.FormatInt(skip, 10) + " LIMIT 1"
-	query = gocb.NewN1qlQuery(statement)
-	queryRes, queryErr = c.Bucket.ExecuteN1qlQuery(query, nil)
+
+	statement := "SELECT * FROM " + c.QuoteIdentifier(c.BucketName) + " WHERE " + c.composeFilter("") +
+		" ORDER BY RANDOM() LIMIT " + strconv.Itoa(count)
+	queryOptions := c.ComposeQueryOptions(gocb.RequestPlus)
+	queryResp, queryErr := c.executeQuery(correlationId, statement, queryOptions, nil)
 	if queryErr != nil {
 		return nil, queryErr
 	}
+
 	buf := make(map[string]interface{})
-	queryRes.Next(&buf)
-	item = c.ConvertFromMap(buf)
-	c.Logger.Trace(correlationId, "Retrieved random item from %s", c.BucketName)
-	return item, nil
+	for queryResp.Next(&buf) {
+		items = append(items, c.convertDocument(correlationId, "", buf[c.BucketName]))
+		buf = make(map[string]interface{})
+	}
+	if closeErr := queryResp.Close(); closeErr != nil {
+		return nil, closeErr
+	}
+	c.Logger.Trace(correlationId, "Retrieved %d random items from %s", len(items), c.BucketName)
+	return items, nil
 }
 
 // DeleteByFilter method are deletes data items that match to a given filter.
+// Only items of the persistence collection are deleted.
 // This method shall be called by a public deleteByFilter method from child class that
 // receives FilterParams and converts them into a filter function.
 // Parameters:
 //   - correlationId     (optional) transaction id to trace execution through call chain.
 //   - filter            (optional) a filter JSON object.
-// Returns: error
-// error or nil for success.
-func (c *CouchbasePersistence) DeleteByFilter(correlationId string, filter string) (err error) {
+// Returns: deletedCount int64, err error
+// number of deleted items or error.
+func (c *CouchbasePersistence) DeleteByFilter(correlationId string, filter string) (deletedCount int64, err error) {
+	defer c.trackOperation("DeleteByFilter")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if writeErr := c.checkWritable(correlationId); writeErr != nil {
+		return 0, writeErr
+	}
+	if filter == "" && c.Options.GetAsBooleanWithDefault("require_filter_for_delete", false) {
+		return 0, cerr.NewBadRequestError(correlationId, "FILTER_REQUIRED", "Filter is required to delete items, use DeleteAll to delete all items").
+			WithDetails("collection", c.CollectionName)
+	}
 
-	statement := "DELETE FROM `" + c.BucketName + "`"
-	// Adjust max item count based on configuration
-	if filter != "" {
-		statement += " WHERE " + filter
+	statement := "DELETE FROM " + c.QuoteIdentifier(c.BucketName) + " WHERE " + c.composeFilter(filter)
+	queryOptions := c.ComposeQueryOptions(gocb.RequestPlus)
+	// The number of deleted items is taken from query metrics
+	metricsEnabled := true
+	queryOptions.Metrics = &metricsEnabled
+	queryRes, queryErr := c.executeQuery(correlationId, statement, queryOptions, nil)
+	if queryErr != nil {
+		return 0, queryErr
+	}
+	// Metrics are available only after the results are closed
+	if closeErr := queryRes.Close(); closeErr != nil {
+		return 0, closeErr
 	}
+	deletedCount = int64(queryRes.Metrics().MutationCount)
+	c.Logger.Trace(correlationId, "Deleted %d items from %s", deletedCount, c.BucketName)
+	return deletedCount, nil
+}
 
-	query := gocb.NewN1qlQuery(statement)
-	queryRes, queryErr := c.Bucket.ExecuteN1qlQuery(query, nil)
+// DeleteAll method are deletes all data items in the collection.
+// Unlike Clear it doesn't flush the bucket and keeps items of other collections.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+// Returns: error
+// error or nil for success.
+func (c *CouchbasePersistence) DeleteAll(correlationId string) (err error) {
+	defer c.trackOperation("DeleteAll")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if writeErr := c.checkWritable(correlationId); writeErr != nil {
+		return writeErr
+	}
+	statement := "DELETE FROM " + c.QuoteIdentifier(c.BucketName) + " WHERE " + c.composeFilter("")
+	queryOptions := c.ComposeQueryOptions(gocb.RequestPlus)
+	queryRes, queryErr := c.executeQuery(correlationId, statement, queryOptions, nil)
 	if queryErr != nil {
 		return queryErr
 	}
-	count := queryRes.Metrics().ResultCount
-	c.Logger.Trace(correlationId, "Deleted %d items from %s", count, c.BucketName)
+	if closeErr := queryRes.Close(); closeErr != nil {
+		return closeErr
+	}
+	count := queryRes.Metrics().MutationCount
+	c.Logger.Trace(correlationId, "Deleted all %d items from %s", count, c.BucketName)
 	return nil
 }
 
+// composeSetClause method composes SET clause of N1QL UPDATE statement with named parameters
+// for all values in the data map
+func (c *CouchbasePersistence) composeSetClause(data *cdata.AnyValueMap) (setClause string, params map[string]interface{}) {
+	values := data.Value()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	params = make(map[string]interface{}, len(keys))
+	for i, key := range keys {
+		param := "v" + strconv.Itoa(i)
+		if setClause != "" {
+			setClause += ", "
+		}
+		setClause += c.escapeFieldPath(key) + "=$" + param
+		params[param] = values[key]
+	}
+	return setClause, params
+}
+
+// UpdateManyByFilter method are updates fields in all data items that match to a given filter
+// using a single N1QL UPDATE statement. Values are passed as query parameters.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - filter            (optional) a filter query string after WHERE clause
+//   - data              a map with fields to be updated.
+// Returns: count int64, err error
+// number of updated items or error.
+func (c *CouchbasePersistence) UpdateManyByFilter(correlationId string, filter string, data *cdata.AnyValueMap) (count int64, err error) {
+	defer c.trackOperation("UpdateManyByFilter")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if writeErr := c.checkWritable(correlationId); writeErr != nil {
+		return 0, writeErr
+	}
+	if data == nil || data.Len() == 0 {
+		return 0, nil
+	}
+
+	setClause, params := c.composeSetClause(data)
+	statement := "UPDATE " + c.QuoteIdentifier(c.BucketName) + " SET " + setClause + " WHERE " + c.composeFilter(filter)
+
+	queryOptions := c.ComposeQueryOptions(gocb.RequestPlus)
+	// The number of updated items is taken from query metrics
+	metricsEnabled := true
+	queryOptions.Metrics = &metricsEnabled
+	queryResp, queryErr := c.executeQuery(correlationId, statement, queryOptions, params)
+	if queryErr != nil {
+		return 0, queryErr
+	}
+	// Metrics are available only after the results are closed
+	if closeErr := queryResp.Close(); closeErr != nil {
+		return 0, closeErr
+	}
+	count = int64(queryResp.Metrics().MutationCount)
+	c.Logger.Trace(correlationId, "Updated %d items in %s", count, c.BucketName)
+	return count, nil
+}
+
+// UpdateManyByFilterReturning method are updates fields in all data items that match to a given filter
+// using a single N1QL UPDATE statement and returns the updated data items.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - filter            (optional) a filter query string after WHERE clause
+//   - data              a map with fields to be updated.
+// Returns: items []interface{}, err error
+// updated data items or error.
+func (c *CouchbasePersistence) UpdateManyByFilterReturning(correlationId string, filter string, data *cdata.AnyValueMap) (items []interface{}, err error) {
+	defer c.trackOperation("UpdateManyByFilterReturning")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if writeErr := c.checkWritable(correlationId); writeErr != nil {
+		return nil, writeErr
+	}
+	items = make([]interface{}, 0)
+	if data == nil || data.Len() == 0 {
+		return items, nil
+	}
+
+	setClause, params := c.composeSetClause(data)
+	statement := "UPDATE " + c.QuoteIdentifier(c.BucketName) + " SET " + setClause + " WHERE " + c.composeFilter(filter) +
+		" RETURNING " + c.QuoteIdentifier(c.BucketName) + ".*"
+
+	queryResp, queryErr := c.executeQuery(correlationId, statement, c.ComposeQueryOptions(gocb.RequestPlus), params)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	buf := make(map[string]interface{}, 0)
+	for queryResp.Next(&buf) {
+		items = append(items, c.convertDocument(correlationId, "", buf))
+		buf = make(map[string]interface{}, 0)
+	}
+	if closeErr := queryResp.Close(); closeErr != nil {
+		return nil, closeErr
+	}
+	c.Logger.Trace(correlationId, "Updated %d items in %s", len(items), c.BucketName)
+	return items, nil
+}
+
 // Create method are creates a data item.
 // Parameters:
 //   - correlation_id    (optional) transaction id to trace execution through call chain.
@@ -688,26 +2337,176 @@ func (c *CouchbasePersistence) DeleteByFilter(correlationId string, filter strin
 // Returns:  result interface{}, err error
 // created item or error.
 func (c *CouchbasePersistence) Create(correlationId string, item interface{}) (result interface{}, err error) {
+	defer c.trackOperation("Create")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if writeErr := c.checkWritable(correlationId); writeErr != nil {
+		return nil, writeErr
+	}
 	if item == nil {
 		return nil, nil
 	}
 	var newItem interface{}
 	newItem = cmpersist.CloneObject(item, c.Prototype)
 	// Assign unique id if not exist
-	insertedItem := c.Overrides.ConvertFromPublic(newItem)
+	insertedItem, convErr := c.convertFromPublic(correlationId, newItem)
+	if convErr != nil {
+		return nil, convErr
+	}
 	id := cdata.IdGenerator.NextLong()
 	objectId := c.GenerateBucketId(id)
 
-	_, insErr := c.Bucket.Insert(objectId, insertedItem, 0)
+	_, insErr := c.InsertDocument(correlationId, objectId, insertedItem, c.DefaultTtl())
 
 	if insErr != nil {
-		return nil, insErr
+		return nil, wrapError(correlationId, insErr)
 	}
 	c.Logger.Trace(correlationId, "Created in %s with id = %s", c.BucketName, id)
-	c.Overrides.ConvertToPublic(newItem)
+	if _, convErr := c.convertToPublic(correlationId, newItem); convErr != nil {
+		return nil, convErr
+	}
 	return c.GetPtrIfNeed(newItem), nil
 }
 
+// InsertDocument method are inserts a document into the bucket.
+// When the insert ambiguously times out, the document is read back to check whether
+// the write was applied, and the operation is reported successful if it was.
+// Parameters:
+//   - correlationId    (optional) transaction id to trace execution through call chain.
+//   - objectId          a bucket id of the document.
+//   - value             a document to be inserted.
+//   - expiry            a document expiration time.
+// Returns: cas gocb.Cas, err error
+// CAS value of the inserted document or error.
+func (c *CouchbasePersistence) InsertDocument(correlationId string, objectId string, value interface{}, expiry uint32) (cas gocb.Cas, err error) {
+	defer c.trackOperation("InsertDocument")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if writeErr := c.checkWritable(correlationId); writeErr != nil {
+		return 0, writeErr
+	}
+	operations := c.bucketOperations()
+	replicateTo, persistTo := c.durability()
+	cas, err = operations.Insert(objectId, value, expiry, replicateTo, persistTo)
+	if err == nil || gocb.ErrorCause(err) != gocb.ErrTimeout {
+		return cas, err
+	}
+
+	// The write may or may not have landed, check the stored document
+	buf := make(map[string]interface{})
+	getCas, getErr := operations.Get(objectId, &buf)
+	if getErr != nil || !IsSameDocument(value, buf) {
+		return cas, err
+	}
+	c.Logger.Debug(correlationId, "Insert of %s in %s timed out but document was written", objectId, c.BucketName)
+	return getCas, nil
+}
+
+// durability method returns the number of replicas and nodes
+// single item writes must reach before they are acknowledged.
+func (c *CouchbasePersistence) durability() (replicateTo uint, persistTo uint) {
+	replicas := c.Options.GetAsIntegerWithDefault("replicate_to", 0)
+	if replicas > 0 {
+		replicateTo = uint(replicas)
+	}
+	nodes := c.Options.GetAsIntegerWithDefault("persist_to", 0)
+	if nodes > 0 {
+		persistTo = uint(nodes)
+	}
+	return replicateTo, persistTo
+}
+
+// upsertDocument method are upserts a document with configured durability requirements
+func (c *CouchbasePersistence) upsertDocument(objectId string, value interface{}, expiry uint32) (gocb.Cas, error) {
+	if replicateTo, persistTo := c.durability(); replicateTo > 0 || persistTo > 0 {
+		return c.getBucket().UpsertDura(objectId, value, expiry, replicateTo, persistTo)
+	}
+	return c.getBucket().Upsert(objectId, value, expiry)
+}
+
+// replaceDocument method are replaces a document with configured durability requirements
+func (c *CouchbasePersistence) replaceDocument(objectId string, value interface{}, cas gocb.Cas, expiry uint32) (gocb.Cas, error) {
+	if replicateTo, persistTo := c.durability(); replicateTo > 0 || persistTo > 0 {
+		return c.getBucket().ReplaceDura(objectId, value, cas, expiry, replicateTo, persistTo)
+	}
+	return c.getBucket().Replace(objectId, value, cas, expiry)
+}
+
+// removeDocument method are removes a document with configured durability requirements
+func (c *CouchbasePersistence) removeDocument(objectId string, cas gocb.Cas) (gocb.Cas, error) {
+	if replicateTo, persistTo := c.durability(); replicateTo > 0 || persistTo > 0 {
+		return c.getBucket().RemoveDura(objectId, cas, replicateTo, persistTo)
+	}
+	return c.getBucket().Remove(objectId, cas)
+}
+
+// mutateDocument method starts a sub-document mutation with configured durability requirements
+func (c *CouchbasePersistence) mutateDocument(objectId string, cas gocb.Cas, expiry uint32) *gocb.MutateInBuilder {
+	if replicateTo, persistTo := c.durability(); replicateTo > 0 || persistTo > 0 {
+		return c.getBucket().MutateInExDura(objectId, 0, cas, expiry, replicateTo, persistTo)
+	}
+	return c.getBucket().MutateIn(objectId, cas, expiry)
+}
+
+// IsSameDocument checks if the stored document has the same content as a written value.
+// The value is compared in its JSON form, as it is stored in the bucket.
+// Parameters:
+//   - value    a written value.
+//   - stored   a document read from the bucket.
+// Returns true if the stored document matches the value.
+func IsSameDocument(value interface{}, stored map[string]interface{}) bool {
+	jsonBuf, jsonErr := json.Marshal(value)
+	if jsonErr != nil {
+		return false
+	}
+	expected := make(map[string]interface{})
+	if jsonErr = json.Unmarshal(jsonBuf, &expected); jsonErr != nil {
+		return false
+	}
+	return reflect.DeepEqual(expected, stored)
+}
+
+// Increment method are atomically increments a counter stored in the collection and returns its new value.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - id                a counter id.
+//   - delta             a value to add to the counter.
+//   - initial           a value to create missing counter with, negative value to fail instead.
+//   - ttl               time to live in seconds, 0 means no expiry.
+// Returns: value int64, err error
+// the new counter value or error.
+func (c *CouchbasePersistence) Increment(correlationId string, id string, delta int64, initial int64, ttl uint32) (value int64, err error) {
+	defer c.trackOperation("Increment")()
+	return c.changeCounter(correlationId, id, delta, initial, ttl)
+}
+
+// Decrement method are atomically decrements a counter stored in the collection and returns its new value.
+// Couchbase counters are unsigned and don't go below zero.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - id                a counter id.
+//   - delta             a value to subtract from the counter.
+//   - initial           a value to create missing counter with, negative value to fail instead.
+//   - ttl               time to live in seconds, 0 means no expiry.
+// Returns: value int64, err error
+// the new counter value or error.
+func (c *CouchbasePersistence) Decrement(correlationId string, id string, delta int64, initial int64, ttl uint32) (value int64, err error) {
+	defer c.trackOperation("Decrement")()
+	return c.changeCounter(correlationId, id, -delta, initial, ttl)
+}
+
+func (c *CouchbasePersistence) changeCounter(correlationId string, id string, delta int64, initial int64, ttl uint32) (value int64, err error) {
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if writeErr := c.checkWritable(correlationId); writeErr != nil {
+		return 0, writeErr
+	}
+	objectId := c.GenerateBucketId(id)
+	counter, _, cntErr := c.getBucket().Counter(objectId, delta, initial, ttl)
+	if cntErr != nil {
+		return 0, wrapError(correlationId, cntErr)
+	}
+	c.Logger.Trace(correlationId, "Changed counter %s in %s by %d", id, c.BucketName, delta)
+	return int64(counter), nil
+}
+
 // GetProtoPtr method are returns pointer on new prototype object for unmarshaling or decode from DB
 // Returns reflect.Value
 // pointer on new empty object
@@ -739,10 +2538,375 @@ func (c *CouchbasePersistence) GetPtrIfNeed(item interface{}) interface{} {
 	return item
 }
 
-// ConvertFromMap method are converts from map[string]interface{} to object, defined by c.Prototype
+// DoBulkWrite method are executes bulk write operations. When options.max_write_concurrency
+// is set, no more than the configured number of operations run in parallel,
+// otherwise all operations are sent in a single batch.
+// Results of the operations are set into their Err fields.
+// Parameters:
+//   - ops     bulk operations to execute.
+// Returns: error
+// error of the bulk execution or nil no errors occured.
+func (c *CouchbasePersistence) DoBulkWrite(ops []gocb.BulkOp) (err error) {
+	limit := c.Options.GetAsIntegerWithDefault("max_write_concurrency", 0)
+	if limit <= 0 || limit >= len(ops) {
+		return c.bucketOperations().Do(ops)
+	}
+
+	semaphore := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	for _, op := range ops {
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(op gocb.BulkOp) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			doErr := c.bucketOperations().Do([]gocb.BulkOp{op})
+			if doErr != nil {
+				lock.Lock()
+				if err == nil {
+					err = doErr
+				}
+				lock.Unlock()
+			}
+		}(op)
+	}
+	wg.Wait()
+	return err
+}
+
+// QueryRaw method are executes N1QL statement and returns live query results
+// for advanced scenarios like custom row handling or reading query metrics.
+// The configured consistency and timeout are applied to the query.
+// The caller owns the returned results: it must iterate them and call Close
+// to release the connection and to get the errors occured while reading rows.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - statement         a N1QL statement.
+//   - params            (optional) named (map) or positional (slice) query parameters.
+// Returns: results gocb.QueryResults, err error
+// query results or error.
+func (c *CouchbasePersistence) QueryRaw(correlationId string, statement string, params interface{}) (results gocb.QueryResults, err error) {
+	results, err = c.executeQuery(correlationId, statement, c.ComposeQueryOptions(gocb.RequestPlus), params)
+	if err != nil {
+		return nil, err
+	}
+	c.Logger.Trace(correlationId, "Executed raw query in %s", c.BucketName)
+	return results, nil
+}
+
+// ExecuteQuery method are executes custom N1QL statement (joins, subqueries, aggregates)
+// and returns all result rows. The configured consistency and timeout are applied to the query.
+// Rows are returned as they are selected and not converted to the persistence prototype.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - statement         a N1QL statement.
+//   - params            (optional) named (map) or positional (slice) query parameters.
+// Returns: rows []map[string]interface{}, err error
+// result rows or error.
+func (c *CouchbasePersistence) ExecuteQuery(correlationId string, statement string, params interface{}) (rows []map[string]interface{}, err error) {
+	defer c.trackOperation("ExecuteQuery")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	queryOptions := c.ComposeQueryOptions(gocb.RequestPlus)
+	queryResp, queryErr := c.executeQuery(correlationId, statement, queryOptions, params)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+
+	rows = make([]map[string]interface{}, 0)
+	row := make(map[string]interface{}, 0)
+	for queryResp.Next(&row) {
+		rows = append(rows, row)
+		row = make(map[string]interface{}, 0)
+	}
+	if closeErr := queryResp.Close(); closeErr != nil {
+		return nil, closeErr
+	}
+	c.Logger.Trace(correlationId, "Executed query in %s and retrieved %d rows", c.BucketName, len(rows))
+	return rows, nil
+}
+
+// ExecuteAnalyticsQuery method are executes a statement on the analytics service,
+// so heavy reports don't load the query nodes used by operations.
+// Result rows are converted to the persistence prototype. The statement is executed
+// as is, analytics datasets must be filtered by collection field when needed.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - statement         an analytics (SQL++) statement.
+//   - params            (optional) named (map) or positional (slice) query parameters.
+// Returns: items []interface{}, err error
+// converted result rows or error.
+func (c *CouchbasePersistence) ExecuteAnalyticsQuery(correlationId string, statement string, params interface{}) (items []interface{}, err error) {
+	defer c.trackOperation("ExecuteAnalyticsQuery")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if openErr := c.checkOpened(correlationId); openErr != nil {
+		return nil, openErr
+	}
+	query := gocb.NewAnalyticsQuery(statement)
+	queryTimeout := c.Options.GetAsLongWithDefault("query_timeout", 0)
+	if queryTimeout > 0 {
+		query.ServerSideTimeout(time.Duration(queryTimeout) * time.Millisecond)
+	}
+
+	queryResp, queryErr := c.getBucket().ExecuteAnalyticsQuery(query, params)
+	if queryErr != nil {
+		return nil, wrapError(correlationId, queryErr)
+	}
+
+	items = make([]interface{}, 0)
+	row := make(map[string]interface{}, 0)
+	for queryResp.Next(&row) {
+		item := c.convertDocument(correlationId, "", row)
+		items = append(items, item)
+		row = make(map[string]interface{}, 0)
+	}
+	if closeErr := queryResp.Close(); closeErr != nil {
+		return nil, wrapError(correlationId, closeErr)
+	}
+	c.Logger.Trace(correlationId, "Executed analytics query in %s and retrieved %d items", c.BucketName, len(items))
+	return items, nil
+}
+
+// NewQuery method are creates N1QL query with configured consistency and timeout.
+// Parameters:
+//   - statement         a N1QL statement.
+//   - consistency       a consistency used when options.consistency is not configured.
+// Returns: *gocb.N1qlQuery
+// a new query.
+func (c *CouchbasePersistence) NewQuery(statement string, consistency gocb.ConsistencyMode) *gocb.N1qlQuery {
+	return c.ComposeQueryOptions(consistency).NewN1qlQuery(statement)
+}
+
+// ComposeQueryOptions method are composes options of N1QL queries from the configuration:
+// options.consistency, options.query_timeout, options.query_pretty and options.query_metrics.
+// Parameters:
+//   - consistency       a consistency used when options.consistency is not configured.
+// Returns: QueryOptions
+// composed query options.
+func (c *CouchbasePersistence) ComposeQueryOptions(consistency gocb.ConsistencyMode) QueryOptions {
+	options := c.composeQueryFlags()
+	options.Consistency = c.getConsistency(consistency)
+	queryTimeout := c.Options.GetAsLongWithDefault("query_timeout", 0)
+	if queryTimeout > 0 {
+		options.Timeout = time.Duration(queryTimeout) * time.Millisecond
+	}
+	return options
+}
+
+// queryOptionsWithConsistency method composes query options with a given consistency.
+// When the consistency is 0, options.consistency or the default consistency is used.
+func (c *CouchbasePersistence) queryOptionsWithConsistency(consistency gocb.ConsistencyMode,
+	defaultConsistency gocb.ConsistencyMode) QueryOptions {
+	options := c.ComposeQueryOptions(defaultConsistency)
+	if consistency != 0 {
+		options.Consistency = consistency
+	}
+	return options
+}
+
+// composeQueryFlags method composes query options with configured pretty and metrics flags
+func (c *CouchbasePersistence) composeQueryFlags() QueryOptions {
+	return QueryOptions{
+		Pretty:  c.Options.GetAsNullableBoolean("query_pretty"),
+		Metrics: c.Options.GetAsNullableBoolean("query_metrics"),
+	}
+}
+
+// getConsistency method returns query consistency set by options.consistency or the default one
+func (c *CouchbasePersistence) getConsistency(defaultConsistency gocb.ConsistencyMode) gocb.ConsistencyMode {
+	switch strings.ToLower(c.Options.GetAsString("consistency")) {
+	case "not_bounded":
+		return gocb.NotBounded
+	case "request_plus":
+		return gocb.RequestPlus
+	case "statement_plus":
+		return gocb.StatementPlus
+	}
+	return defaultConsistency
+}
+
+// executeQuery method executes N1QL statement with given options. When the query fails because
+// the index is not ready yet, it is retried up to options.index_wait milliseconds.
+func (c *CouchbasePersistence) executeQuery(correlationId string, statement string, options QueryOptions,
+	params interface{}) (gocb.QueryResults, error) {
+
+	if openErr := c.checkOpened(correlationId); openErr != nil {
+		return nil, openErr
+	}
+	// Allows to find the query in the server logs and active requests
+	options.ClientContextId = correlationId
+	indexWait := c.Options.GetAsLongWithDefault("index_wait", 0)
+	deadline := time.Now().Add(time.Duration(indexWait) * time.Millisecond)
+	for {
+		queryResp, queryErr := c.bucketOperations().ExecuteN1qlQuery(statement, options, params)
+		if queryErr == nil || !IsIndexNotReadyError(queryErr) || time.Now().After(deadline) {
+			return queryResp, queryErr
+		}
+		if !c.acquireRetry() {
+			c.Logger.Debug(correlationId, "Retry budget of %s is exhausted, the query is not retried", c.BucketName)
+			return queryResp, queryErr
+		}
+		c.Logger.Debug(correlationId, "Index in %s is not ready, retrying the query", c.BucketName)
+		select {
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+}
+
+// logSlowQuery method logs a warning when the query with its results reading
+// took longer than options.slow_query_threshold_ms
+func (c *CouchbasePersistence) logSlowQuery(correlationId string, statement string, queryStart time.Time) {
+	threshold := c.Options.GetAsLongWithDefault("slow_query_threshold_ms", 0)
+	if threshold <= 0 {
+		return
+	}
+	elapsed := time.Since(queryStart).Milliseconds()
+	if elapsed >= threshold {
+		c.Logger.Warn(correlationId, "Slow query in %s took %d ms: %s", c.BucketName, elapsed, statement)
+	}
+}
+
+// acquireRetry method takes a retry from the shared retry budget.
+// It returns false when the budget is configured and exhausted.
+func (c *CouchbasePersistence) acquireRetry() bool {
+	return c.retryBudget == nil || c.retryBudget.TryAcquire()
+}
+
+// IsIndexNotReadyError checks if the N1QL query failed because
+// there is no index to serve it yet, i.e. the index is not built or still deferred.
+// Parameters:
+//   - err an error returned by the query.
+// Returns true if the query can be retried when the index becomes available.
+func IsIndexNotReadyError(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := strings.ToLower(err.Error())
+	return strings.Contains(message, "no index available") ||
+		strings.Contains(message, "index not ready") ||
+		strings.Contains(message, "not yet online") ||
+		strings.Contains(message, "is not online")
+}
+
+// normalizeQueryParams converts query parameters to the form accepted by gocb.
+// Empty parameters are replaced with nil.
+func normalizeQueryParams(params interface{}) interface{} {
+	switch value := params.(type) {
+	case *cdata.AnyValueMap:
+		if value == nil || value.Len() == 0 {
+			return nil
+		}
+		return value.Value()
+	case map[string]interface{}:
+		if len(value) == 0 {
+			return nil
+		}
+	case []interface{}:
+		if len(value) == 0 {
+			return nil
+		}
+	}
+	return params
+}
+
+// isKeyNotFoundError checks if the error is "Key does not exist on the server" error
+func isKeyNotFoundError(err error) bool {
+	return err == gocb.ErrKeyNotFound || gocb.IsKeyNotFoundError(err)
+}
+
+// isNotFoundError checks if the error is "Key does not exist on the server" error
+// or NotFoundError it was converted into
+func isNotFoundError(err error) bool {
+	if appErr, ok := err.(*cerr.ApplicationError); ok {
+		return appErr.Category == cerr.NotFound
+	}
+	return isKeyNotFoundError(err)
+}
+
+// wrapError converts errors returned by Couchbase SDK into application errors
+// keeping the original error as a cause. Application errors are returned as is.
+func wrapError(correlationId string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*cerr.ApplicationError); ok {
+		return err
+	}
+	if isKeyNotFoundError(err) {
+		return cerr.NewNotFoundError(correlationId, "NOT_FOUND", "Object was not found").
+			WithCause(err)
+	}
+	if gocb.IsKeyExistsError(err) {
+		return cerr.NewConflictError(correlationId, "DUPLICATE_KEY", "Object with the same key already exists").
+			WithCause(err)
+	}
+	switch gocb.ErrorCause(err) {
+	case gocb.ErrTimeout:
+		return cerr.NewConnectionError(correlationId, "TIMEOUT", "Couchbase operation timed out").
+			WithCause(err)
+	case gocb.ErrAuthError, gocb.ErrAccessError, gocb.ErrInvalidCredentials:
+		return cerr.NewUnauthorizedError(correlationId, "ACCESS_DENIED", "Access to couchbase was denied").
+			WithCause(err)
+	}
+	if isConnectionError(err) {
+		return cerr.NewConnectionError(correlationId, "CONNECTION_FAILED", "Connection to couchbase failed").
+			WithCause(err)
+	}
+	return cerr.NewInternalError(correlationId, "COUCHBASE_ERROR", "Couchbase operation failed").
+		WithCause(err)
+}
+
+// isConnectionError checks if the error is caused by lost or failed connection to couchbase
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch gocb.ErrorCause(err) {
+	case gocb.ErrNetwork, gocb.ErrShutdown, gocb.ErrBadHosts, gocb.ErrDispatchFail:
+		return true
+	}
+	return false
+}
+
+// ConvertFromMap method are converts from map[string]interface{} to object, defined by c.Prototype.
+// Fields that don't match the prototype are left empty and a warning is logged,
+// use ConvertFromMapWithError to handle such documents.
 func (c *CouchbasePersistence) ConvertFromMap(buf interface{}) interface{} {
+	item, err := c.ConvertFromMapWithError(buf)
+	if err != nil {
+		c.Logger.Warn("", "Document of %s doesn't match the prototype: %s", c.CollectionName, err.Error())
+	}
+	return item
+}
+
+// ConvertFromMapWithError method are converts from map[string]interface{} to object, defined by c.Prototype,
+// and returns an error when the document doesn't match the prototype.
+// Parameters:
+//   - buf   a document read from couchbase
+// Returns: item interface{}, err error
+// converted item, with fields that didn't match left empty, and conversion error.
+func (c *CouchbasePersistence) ConvertFromMapWithError(buf interface{}) (item interface{}, err error) {
+	if doc, ok := buf.(map[string]interface{}); ok && c.Options.GetAsBoolean("flatten_fields") {
+		buf = UnflattenDocument(doc)
+	}
 	docPointer := c.GetProtoPtr()
-	jsonBuf, _ := json.Marshal(buf)
-	json.Unmarshal(jsonBuf, docPointer.Interface())
-	return c.GetConvResult(docPointer)
+	jsonBuf, err := json.Marshal(buf)
+	if err == nil {
+		// Unmarshal fills all matching fields even when some of them fail
+		err = json.Unmarshal(jsonBuf, docPointer.Interface())
+	}
+	return c.GetConvResult(docPointer), err
+}
+
+// convertDocument method converts a document read from couchbase and logs a warning
+// with the document key when it doesn't match the prototype, for instance after schema changes
+func (c *CouchbasePersistence) convertDocument(correlationId string, key string, buf interface{}) interface{} {
+	item, err := c.ConvertFromMapWithError(buf)
+	if err != nil {
+		if key == "" {
+			key = "returned by query"
+		}
+		c.Logger.Warn(correlationId, "Document %s in %s doesn't match the prototype: %s", key, c.CollectionName, err.Error())
+	}
+	return item
 }
@@ -0,0 +1,55 @@
+package persistence
+
+import (
+	"strings"
+)
+
+// FlattenDocument converts nested object fields into top level fields with dotted keys.
+// For example {"address": {"city": "X"}} becomes {"address.city": "X"}.
+// Arrays and empty objects are kept as values.
+// Parameters:
+//   - doc a document to flatten.
+// Returns a new flattened document.
+func FlattenDocument(doc map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	flattenInto(result, "", doc)
+	return result
+}
+
+func flattenInto(result map[string]interface{}, prefix string, doc map[string]interface{}) {
+	for key, value := range doc {
+		name := key
+		if prefix != "" {
+			name = prefix + "." + key
+		}
+		nested, ok := value.(map[string]interface{})
+		if ok && len(nested) > 0 {
+			flattenInto(result, name, nested)
+		} else {
+			result[name] = value
+		}
+	}
+}
+
+// UnflattenDocument restores nested object fields from top level fields with dotted keys.
+// It reverses FlattenDocument.
+// Parameters:
+//   - doc a flattened document.
+// Returns a new document with nested objects.
+func UnflattenDocument(doc map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	for key, value := range doc {
+		path := strings.Split(key, ".")
+		current := result
+		for _, name := range path[:len(path)-1] {
+			nested, ok := current[name].(map[string]interface{})
+			if !ok {
+				nested = make(map[string]interface{})
+				current[name] = nested
+			}
+			current = nested
+		}
+		current[path[len(path)-1]] = value
+	}
+	return result
+}
@@ -0,0 +1,464 @@
+package persistence
+
+import (
+	"reflect"
+
+	cdata "github.com/pip-services3-go/pip-services3-commons-go/data"
+	cerr "github.com/pip-services3-go/pip-services3-commons-go/errors"
+	gocb "gopkg.in/couchbase/gocb.v1"
+)
+
+// GenericDataPage is a typed page of data items returned by GenericCouchbasePersistence
+type GenericDataPage[T any] struct {
+	Total *int64 `json:"total"`
+	Data  []T    `json:"data"`
+}
+
+/*
+GenericCouchbasePersistence typed persistence component that stores data in Couchbase
+and implements a number of CRUD operations over data items with unique ids.
+It is built on top of IdentifiableCouchbasePersistence and removes the need to write
+type assertions in every child class method.
+
+Type parameters:
+  - T type of data items (struct, pointer to struct or map[string]interface{})
+  - K type of data item unique ids
+
+The id type is a separate parameter because T doesn't constrain the type of its id field:
+it lets GetOneById, GetListByIds, DeleteById and other id based methods accept typed ids
+and return missing ids in the same type, so ids are checked at compile time like the items.
+
+Configuration parameters are the same as for IdentifiableCouchbasePersistence.
+
+Example:
+
+  persistence := NewGenericCouchbasePersistence[MyData, string]("mybucket", "mycollection")
+  persistence.Configure(cconf.NewConfigParamsFromTuples(
+      "connection.host", "localhost",
+      "connection.port", 8091,
+  ))
+
+  persitence.Open("123")
+      ...
+  item, err := persistence.Create("123", MyData{ Id: "1", Name: "ABC" })
+  item, err = persistence.GetOneById("123", "1")
+  fmt.Println(item.Name)  // Result: ABC
+*/
+type GenericCouchbasePersistence[T any, K any] struct {
+	IdentifiableCouchbasePersistence
+}
+
+// NewGenericCouchbasePersistence method are creates a new instance of the typed persistence component.
+// Parameters:
+//   - bucket string  couchbase bucket name
+//   - collection    a collection name.
+// Returns: *GenericCouchbasePersistence pointer on new instance
+func NewGenericCouchbasePersistence[T any, K any](bucket string, collection string) *GenericCouchbasePersistence[T, K] {
+	c := &GenericCouchbasePersistence[T, K]{}
+	c.IdentifiableCouchbasePersistence = *InheritIdentifiableCouchbasePersistence(c, reflect.TypeOf((*T)(nil)).Elem(), bucket, collection)
+	return c
+}
+
+// InheritGenericCouchbasePersistence method are creates a new instance of the typed persistence component
+// for child classes that override virtual methods.
+// Parameters:
+//   - overrides References to override virtual methods
+//   - bucket string  couchbase bucket name
+//   - collection    a collection name.
+// Returns: *GenericCouchbasePersistence pointer on new instance
+func InheritGenericCouchbasePersistence[T any, K any](overrides ICouchbasePersistenceOverrides, bucket string, collection string) *GenericCouchbasePersistence[T, K] {
+	c := &GenericCouchbasePersistence[T, K]{}
+	c.IdentifiableCouchbasePersistence = *InheritIdentifiableCouchbasePersistence(overrides, reflect.TypeOf((*T)(nil)).Elem(), bucket, collection)
+	return c
+}
+
+func (c *GenericCouchbasePersistence[T, K]) toTyped(correlationId string, value interface{}) (result T, err error) {
+	if value == nil {
+		return result, nil
+	}
+	result, ok := value.(T)
+	if !ok {
+		return result, cerr.NewInternalError(correlationId, "TYPE_MISMATCH", "Item type doesn't match the persistence type").
+			WithDetails("type", reflect.TypeOf(value).String())
+	}
+	return result, nil
+}
+
+func (c *GenericCouchbasePersistence[T, K]) toTypedList(correlationId string, values []interface{}) (items []T, err error) {
+	items = make([]T, 0, len(values))
+	for _, v := range values {
+		item, convErr := c.toTyped(correlationId, v)
+		if convErr != nil {
+			return nil, convErr
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (c *GenericCouchbasePersistence[T, K]) toIds(ids []K) []interface{} {
+	convIds := make([]interface{}, len(ids))
+	for i, v := range ids {
+		convIds[i] = v
+	}
+	return convIds
+}
+
+// GetPageByFilter method are gets a typed page of data items retrieved by a given filter and sorted according to sort parameters.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - filter            (optional) a filter query string after WHERE clause
+//   - paging            (optional) paging parameters
+//   - sort              (optional) sorting string after ORDER BY clause
+//   - sel               (optional) projection string after SELECT clause
+// Returns:  page *GenericDataPage[T], err error
+// data page or error.
+func (c *GenericCouchbasePersistence[T, K]) GetPageByFilter(correlationId string, filter string, paging *cdata.PagingParams,
+	sort string, sel string) (page *GenericDataPage[T], err error) {
+	tempPage, err := c.IdentifiableCouchbasePersistence.GetPageByFilter(correlationId, filter, paging, sort, sel)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.toTypedList(correlationId, tempPage.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &GenericDataPage[T]{Total: tempPage.Total, Data: data}, nil
+}
+
+// GetPageByFilterWithParams method are gets a typed page of data items retrieved by a given filter
+// with query parameters and sorted according to sort parameters.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - filter            (optional) a filter query string after WHERE clause with placeholders
+//   - params            (optional) named (map or *cdata.AnyValueMap) or positional (slice) query parameters
+//   - paging            (optional) paging parameters
+//   - sort              (optional) sorting string after ORDER BY clause
+//   - sel               (optional) projection string after SELECT clause
+// Returns:  page *GenericDataPage[T], err error
+// data page or error.
+func (c *GenericCouchbasePersistence[T, K]) GetPageByFilterWithParams(correlationId string, filter string, params interface{},
+	paging *cdata.PagingParams, sort string, sel string) (page *GenericDataPage[T], err error) {
+	tempPage, err := c.IdentifiableCouchbasePersistence.GetPageByFilterWithParams(correlationId, filter, params, paging, sort, sel)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.toTypedList(correlationId, tempPage.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &GenericDataPage[T]{Total: tempPage.Total, Data: data}, nil
+}
+
+// GetPageByFilterWithSort method are gets a typed page of data items retrieved by a given filter
+// with query parameters and sorted by typed sort fields.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - filter            (optional) a filter query string after WHERE clause with placeholders
+//   - params            (optional) named (map or *cdata.AnyValueMap) or positional (slice) query parameters
+//   - paging            (optional) paging parameters
+//   - sort              (optional) sort fields with their directions
+//   - sel               (optional) projection string after SELECT clause
+// Returns:  page *GenericDataPage[T], err error
+// data page or error.
+func (c *GenericCouchbasePersistence[T, K]) GetPageByFilterWithSort(correlationId string, filter string, params interface{},
+	paging *cdata.PagingParams, sort *cdata.SortParams, sel string) (page *GenericDataPage[T], err error) {
+	tempPage, err := c.IdentifiableCouchbasePersistence.GetPageByFilterWithSort(correlationId, filter, params, paging, sort, sel)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.toTypedList(correlationId, tempPage.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &GenericDataPage[T]{Total: tempPage.Total, Data: data}, nil
+}
+
+// GetPageByFilterWithConsistency method are gets a typed page of data items retrieved by a given filter
+// with query parameters and sorted according to sort parameters using a given query consistency.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - filter            (optional) a filter query string after WHERE clause with placeholders
+//   - params            (optional) named (map or *cdata.AnyValueMap) or positional (slice) query parameters
+//   - paging            (optional) paging parameters
+//   - sort              (optional) sorting string after ORDER BY clause
+//   - sel               (optional) projection string after SELECT clause
+//   - consistency       (optional) query consistency, 0 to use options.consistency
+// Returns:  page *GenericDataPage[T], err error
+// data page or error.
+func (c *GenericCouchbasePersistence[T, K]) GetPageByFilterWithConsistency(correlationId string, filter string, params interface{},
+	paging *cdata.PagingParams, sort string, sel string, consistency gocb.ConsistencyMode) (page *GenericDataPage[T], err error) {
+	tempPage, err := c.IdentifiableCouchbasePersistence.GetPageByFilterWithConsistency(correlationId, filter, params, paging, sort, sel, consistency)
+	if err != nil {
+		return nil, err
+	}
+	data, err := c.toTypedList(correlationId, tempPage.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &GenericDataPage[T]{Total: tempPage.Total, Data: data}, nil
+}
+
+// GetListByFilter method are gets a typed list of data items retrieved by a given filter and sorted according to sort parameters.
+// Parameters:
+//   - correlationId    (optional) transaction id to trace execution through call chain.
+//   - filter           (optional) a filter query string after WHERE clause
+//   - sort             (optional) sorting string after ORDER BY clause
+//   - sel              (optional) projection string after SELECT clause
+// Returns:  items []T, err error
+// data list or error.
+func (c *GenericCouchbasePersistence[T, K]) GetListByFilter(correlationId string, filter string, sort string, sel string) (items []T, err error) {
+	result, err := c.IdentifiableCouchbasePersistence.GetListByFilter(correlationId, filter, sort, sel)
+	if err != nil {
+		return nil, err
+	}
+	return c.toTypedList(correlationId, result)
+}
+
+// GetListByFilterWithParams method are gets a typed list of data items retrieved by a given filter
+// with query parameters and sorted according to sort parameters.
+// Parameters:
+//   - correlationId    (optional) transaction id to trace execution through call chain.
+//   - filter           (optional) a filter query string after WHERE clause with placeholders
+//   - params           (optional) named (map or *cdata.AnyValueMap) or positional (slice) query parameters
+//   - sort             (optional) sorting string after ORDER BY clause
+//   - sel              (optional) projection string after SELECT clause
+// Returns:  items []T, err error
+// data list or error.
+func (c *GenericCouchbasePersistence[T, K]) GetListByFilterWithParams(correlationId string, filter string, params interface{},
+	sort string, sel string) (items []T, err error) {
+	result, err := c.IdentifiableCouchbasePersistence.GetListByFilterWithParams(correlationId, filter, params, sort, sel)
+	if err != nil {
+		return nil, err
+	}
+	return c.toTypedList(correlationId, result)
+}
+
+// GetListByFilterWithConsistency method are gets a typed list of data items retrieved by a given filter
+// with query parameters and sorted according to sort parameters using a given query consistency.
+// Parameters:
+//   - correlationId    (optional) transaction id to trace execution through call chain.
+//   - filter           (optional) a filter query string after WHERE clause with placeholders
+//   - params           (optional) named (map or *cdata.AnyValueMap) or positional (slice) query parameters
+//   - sort             (optional) sorting string after ORDER BY clause
+//   - sel              (optional) projection string after SELECT clause
+//   - consistency      (optional) query consistency, 0 to use options.consistency
+// Returns:  items []T, err error
+// data list or error.
+func (c *GenericCouchbasePersistence[T, K]) GetListByFilterWithConsistency(correlationId string, filter string, params interface{},
+	sort string, sel string, consistency gocb.ConsistencyMode) (items []T, err error) {
+	result, err := c.IdentifiableCouchbasePersistence.GetListByFilterWithConsistency(correlationId, filter, params, sort, sel, consistency)
+	if err != nil {
+		return nil, err
+	}
+	return c.toTypedList(correlationId, result)
+}
+
+// GetPageByFilterWithCursor method are gets a typed page of data items using keyset pagination.
+// The cursor field must be unique and indexed, see CouchbasePersistence.GetPageByFilterWithCursor.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - filter            (optional) a filter query string after WHERE clause
+//   - afterKey          (optional) a cursor returned with the previous page, nil for the first page
+//   - take              a page size, 0 to use the maximum page size
+//   - sort              a cursor field path, optionally followed by DESC for descending order
+// Returns:  items []T, nextCursor interface{}, err error
+// data items, a cursor for the next page (nil on the last page) or error.
+func (c *GenericCouchbasePersistence[T, K]) GetPageByFilterWithCursor(correlationId string, filter string, afterKey interface{},
+	take int, sort string) (items []T, nextCursor interface{}, err error) {
+	result, nextCursor, err := c.IdentifiableCouchbasePersistence.GetPageByFilterWithCursor(correlationId, filter, afterKey, take, sort)
+	if err != nil {
+		return nil, nil, err
+	}
+	items, err = c.toTypedList(correlationId, result)
+	if err != nil {
+		return nil, nil, err
+	}
+	return items, nextCursor, nil
+}
+
+// GetOneByFilter method are gets the first typed data item retrieved by a given filter
+// and sorted according to sort parameters.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - filter            (optional) a filter query string after WHERE clause
+//   - sort              (optional) sorting string after ORDER BY clause
+// Returns:  item T, err error
+// data item (zero value if nothing matches) or error.
+func (c *GenericCouchbasePersistence[T, K]) GetOneByFilter(correlationId string, filter string, sort string) (item T, err error) {
+	result, err := c.IdentifiableCouchbasePersistence.GetOneByFilter(correlationId, filter, sort)
+	if err != nil {
+		return item, err
+	}
+	return c.toTyped(correlationId, result)
+}
+
+// GetListByIds method are gets a typed list of data items retrieved by given unique ids.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - ids               ids of data items to be retrieved
+// Returns:  items []T, err error
+// a data list or error.
+func (c *GenericCouchbasePersistence[T, K]) GetListByIds(correlationId string, ids []K) (items []T, err error) {
+	result, err := c.IdentifiableCouchbasePersistence.GetListByIds(correlationId, c.toIds(ids))
+	if err != nil {
+		return nil, err
+	}
+	return c.toTypedList(correlationId, result)
+}
+
+// GetListByIdsWithMissing method are gets a typed list of data items retrieved by given unique ids.
+// Items are aligned with the requested ids, missing items have zero values
+// and their ids are returned separately.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - ids               ids of data items to be retrieved
+// Returns:  items []T, missing []K, err error
+// data items in the order of ids, ids of missing items or error.
+func (c *GenericCouchbasePersistence[T, K]) GetListByIdsWithMissing(correlationId string, ids []K) (items []T, missing []K, err error) {
+	result, missingIds, err := c.IdentifiableCouchbasePersistence.GetListByIdsWithMissing(correlationId, c.toIds(ids))
+	if err != nil {
+		return nil, nil, err
+	}
+	items = make([]T, len(result))
+	for i, item := range result {
+		if item == nil {
+			continue
+		}
+		if items[i], err = c.toTyped(correlationId, item); err != nil {
+			return nil, nil, err
+		}
+	}
+	missing = make([]K, 0, len(missingIds))
+	for _, id := range missingIds {
+		missing = append(missing, id.(K))
+	}
+	return items, missing, nil
+}
+
+// GetOneById method are gets a typed data item by its unique id.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - id                an id of data item to be retrieved.
+// Returns:  item T, err error
+// data item (zero value if not found) or error.
+func (c *GenericCouchbasePersistence[T, K]) GetOneById(correlationId string, id K) (item T, err error) {
+	result, err := c.IdentifiableCouchbasePersistence.GetOneById(correlationId, id)
+	if err != nil {
+		return item, err
+	}
+	return c.toTyped(correlationId, result)
+}
+
+// Create method are creates a typed data item.
+// Parameters:
+//   - correlationId    (optional) transaction id to trace execution through call chain.
+//   - item              an item to be created.
+// Returns:  result T, err error
+// created item or error.
+func (c *GenericCouchbasePersistence[T, K]) Create(correlationId string, item T) (result T, err error) {
+	value, err := c.IdentifiableCouchbasePersistence.Create(correlationId, item)
+	if err != nil {
+		return result, err
+	}
+	return c.toTyped(correlationId, value)
+}
+
+// CreateWithTtl method are creates a typed data item that expires after a given time.
+// Parameters:
+//   - correlationId    (optional) transaction id to trace execution through call chain.
+//   - item              an item to be created.
+//   - ttl               time to live in seconds, 0 means no expiry.
+// Returns:  result T, err error
+// created item or error.
+func (c *GenericCouchbasePersistence[T, K]) CreateWithTtl(correlationId string, item T, ttl uint32) (result T, err error) {
+	value, err := c.IdentifiableCouchbasePersistence.CreateWithTtl(correlationId, item, ttl)
+	if err != nil {
+		return result, err
+	}
+	return c.toTyped(correlationId, value)
+}
+
+// Set method are sets a typed data item. If the data item exists it updates it,
+// otherwise it create a new data item.
+// Parameters:
+//   - correlationId    (optional) transaction id to trace execution through call chain.
+//   - item              a item to be set.
+// Returns:  result T, err error
+// updated item or error.
+func (c *GenericCouchbasePersistence[T, K]) Set(correlationId string, item T) (result T, err error) {
+	value, err := c.IdentifiableCouchbasePersistence.Set(correlationId, item)
+	if err != nil {
+		return result, err
+	}
+	return c.toTyped(correlationId, value)
+}
+
+// SetWithTtl method are sets a typed data item that expires after a given time.
+// If the data item exists it updates it, otherwise it create a new data item.
+// Parameters:
+//   - correlationId    (optional) transaction id to trace execution through call chain.
+//   - item              a item to be set.
+//   - ttl               time to live in seconds, 0 means no expiry.
+// Returns:  result T, err error
+// updated item or error.
+func (c *GenericCouchbasePersistence[T, K]) SetWithTtl(correlationId string, item T, ttl uint32) (result T, err error) {
+	value, err := c.IdentifiableCouchbasePersistence.SetWithTtl(correlationId, item, ttl)
+	if err != nil {
+		return result, err
+	}
+	return c.toTyped(correlationId, value)
+}
+
+// Update method are updates a typed data item.
+// Parameters:
+//   - correlationId    (optional) transaction id to trace execution through call chain.
+//   - item              an item to be updated.
+// Returns:  result T, err error
+// updated item or error.
+func (c *GenericCouchbasePersistence[T, K]) Update(correlationId string, item T) (result T, err error) {
+	value, err := c.IdentifiableCouchbasePersistence.Update(correlationId, item)
+	if err != nil {
+		return result, err
+	}
+	return c.toTyped(correlationId, value)
+}
+
+// UpdatePartially methos are updates only few selected fields in a typed data item.
+// Parameters:
+//   - correlationId    (optional) transaction id to trace execution through call chain.
+//   - id                an id of data item to be updated.
+//   - data              a map with fields to be updated.
+// Returns: item T, err error
+// updated item or error.
+func (c *GenericCouchbasePersistence[T, K]) UpdatePartially(correlationId string, id K, data *cdata.AnyValueMap) (item T, err error) {
+	value, err := c.IdentifiableCouchbasePersistence.UpdatePartially(correlationId, id, data)
+	if err != nil {
+		return item, err
+	}
+	return c.toTyped(correlationId, value)
+}
+
+// DeleteById mathod are deleted a typed data item by its unique id.
+// Parameters:
+//   - correlationId    (optional) transaction id to trace execution through call chain.
+//   - id                an id of the item to be deleted
+// Returns: item T, err error
+// deleted item or error.
+func (c *GenericCouchbasePersistence[T, K]) DeleteById(correlationId string, id K) (item T, err error) {
+	value, err := c.IdentifiableCouchbasePersistence.DeleteById(correlationId, id)
+	if err != nil {
+		return item, err
+	}
+	return c.toTyped(correlationId, value)
+}
+
+// DeleteByIds methos are deletes multiple data items by their unique ids.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - ids               ids of data items to be deleted.
+// Returns: error
+// error or nil for success.
+func (c *GenericCouchbasePersistence[T, K]) DeleteByIds(correlationId string, ids []K) (err error) {
+	return c.IdentifiableCouchbasePersistence.DeleteByIds(correlationId, c.toIds(ids))
+}
@@ -0,0 +1,74 @@
+package persistence
+
+import (
+	gocb "gopkg.in/couchbase/gocb.v1"
+)
+
+// IBucketOperations interface defines bucket operations the persistence runs to execute
+// N1QL queries, bulk operations, document inserts and field updates. By default they run on the opened bucket,
+// a custom implementation set by SetBucketOperations can intercept or simulate them.
+type IBucketOperations interface {
+	// ExecuteN1qlQuery executes N1QL statement with given query options and parameters.
+	ExecuteN1qlQuery(statement string, options QueryOptions, params interface{}) (gocb.QueryResults, error)
+	// Do executes bulk operations and sets their results into the operations.
+	Do(ops []gocb.BulkOp) error
+	// Get reads a document with a given key into valuePtr.
+	Get(key string, valuePtr interface{}) (gocb.Cas, error)
+	// Insert inserts a new document. Zero replicateTo and persistTo don't wait for durability.
+	Insert(key string, value interface{}, expiry uint32, replicateTo uint, persistTo uint) (gocb.Cas, error)
+	// UpsertField sets a field at a given path of the document with a matching cas, missing parents of the path are created.
+	UpsertField(key string, path string, value interface{}, cas gocb.Cas, expiry uint32, replicateTo uint, persistTo uint) (gocb.Cas, error)
+}
+
+// BucketOperations runs bucket operations on a gocb bucket.
+type BucketOperations struct {
+	Bucket *gocb.Bucket
+}
+
+// NewBucketOperations method creates a new instance of BucketOperations.
+// Parameters:
+//   - bucket   a bucket to run the operations on.
+// Returns *BucketOperations
+func NewBucketOperations(bucket *gocb.Bucket) *BucketOperations {
+	return &BucketOperations{Bucket: bucket}
+}
+
+// ExecuteN1qlQuery method executes N1QL statement with given query options and parameters.
+func (c *BucketOperations) ExecuteN1qlQuery(statement string, options QueryOptions, params interface{}) (gocb.QueryResults, error) {
+	return c.Bucket.ExecuteN1qlQuery(options.NewN1qlQuery(statement), params)
+}
+
+// Do method executes bulk operations and sets their results into the operations.
+func (c *BucketOperations) Do(ops []gocb.BulkOp) error {
+	return c.Bucket.Do(ops)
+}
+
+// Get method reads a document with a given key into valuePtr.
+func (c *BucketOperations) Get(key string, valuePtr interface{}) (gocb.Cas, error) {
+	return c.Bucket.Get(key, valuePtr)
+}
+
+// Insert method inserts a new document. Zero replicateTo and persistTo don't wait for durability.
+func (c *BucketOperations) Insert(key string, value interface{}, expiry uint32, replicateTo uint, persistTo uint) (gocb.Cas, error) {
+	if replicateTo > 0 || persistTo > 0 {
+		return c.Bucket.InsertDura(key, value, expiry, replicateTo, persistTo)
+	}
+	return c.Bucket.Insert(key, value, expiry)
+}
+
+// UpsertField method sets a field at a given path of the document with a matching cas,
+// missing parents of the path are created. Zero replicateTo and persistTo don't wait for durability.
+func (c *BucketOperations) UpsertField(key string, path string, value interface{}, cas gocb.Cas, expiry uint32,
+	replicateTo uint, persistTo uint) (gocb.Cas, error) {
+	var mutation *gocb.MutateInBuilder
+	if replicateTo > 0 || persistTo > 0 {
+		mutation = c.Bucket.MutateInExDura(key, 0, cas, expiry, replicateTo, persistTo)
+	} else {
+		mutation = c.Bucket.MutateIn(key, cas, expiry)
+	}
+	frag, err := mutation.Upsert(path, value, true).Execute()
+	if err != nil {
+		return 0, err
+	}
+	return frag.Cas(), nil
+}
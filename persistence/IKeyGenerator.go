@@ -0,0 +1,34 @@
+package persistence
+
+import (
+	cconv "github.com/pip-services3-go/pip-services3-commons-go/convert"
+)
+
+// IKeyGenerator interface generates keys of documents stored in the bucket.
+// It allows to control the key layout, e.g. to use natural business keys or custom prefixes.
+type IKeyGenerator interface {
+	// GenerateBucketId generates a unique bucket id for a public id in a given collection.
+	GenerateBucketId(collection string, value interface{}) string
+}
+
+// DefaultKeyGenerator composes keys of the collection name, a separator and the public id.
+type DefaultKeyGenerator struct {
+	Separator string
+}
+
+// NewDefaultKeyGenerator method creates a new instance of DefaultKeyGenerator.
+// Parameters:
+//   - separator   a separator between collection name and id.
+// Returns *DefaultKeyGenerator
+func NewDefaultKeyGenerator(separator string) *DefaultKeyGenerator {
+	return &DefaultKeyGenerator{Separator: separator}
+}
+
+// GenerateBucketId method generates a unique bucket id for a public id in a given collection.
+// Parameters:
+//   - collection  a collection name.
+//   - value       a public unique id.
+// Returns a unique bucket id.
+func (c *DefaultKeyGenerator) GenerateBucketId(collection string, value interface{}) string {
+	return collection + c.Separator + cconv.StringConverter.ToString(value)
+}
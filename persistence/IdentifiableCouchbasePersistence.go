@@ -3,18 +3,24 @@ package persistence
 import (
 	"encoding/json"
 	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	cconf "github.com/pip-services3-go/pip-services3-commons-go/config"
 
+	cconv "github.com/pip-services3-go/pip-services3-commons-go/convert"
 	cdata "github.com/pip-services3-go/pip-services3-commons-go/data"
-	refl "github.com/pip-services3-go/pip-services3-commons-go/reflect"
+	cerr "github.com/pip-services3-go/pip-services3-commons-go/errors"
 	cmpersist "github.com/pip-services3-go/pip-services3-data-go/persistence"
 	gocb "gopkg.in/couchbase/gocb.v1"
 )
 
 type IdentifiableCouchbasePersistence struct {
 	CouchbasePersistence
+
+	readCoalescer *ReadCoalescer
 }
 
 /*
@@ -31,12 +37,17 @@ accessing c.Bucket properties.
 
 Configuration parameters:
 
-  - bucket:                      (optional) Couchbase bucket name
+  - bucket:                      (optional) Couchbase bucket name (overrides connection.database)
   - collection:                  (optional) Couchbase collection name
   - connection(s):
     - discovery_key:             (optional) a key to retrieve the connection from connect.idiscovery.html IDiscovery
     - host:                      host name or IP address
     - port:                      port number (default: 27017)
+    - database:                  (optional) Couchbase bucket name, used when bucket is not set
+    - bucket_password:           (optional) bucket password for legacy (pre-RBAC) buckets
+    - protocol:                  (optional) connection protocol: couchbase or couchbases for TLS (default: couchbase)
+    - ssl:                       (optional) enable TLS connection, same as couchbases protocol (default: false)
+    - certpath:                  (optional) path to the certificate used to validate the server certificate
     - uri:                       resource URI or connection string with all parameters in it
   - credential(s):
     - store_key:                 (optional) a key to retrieve the credentials from auth.icredentialstore.html ICredentialStore
@@ -46,13 +57,29 @@ Configuration parameters:
     - max_pool_size:             (optional) maximum connection pool size (default: 2)
     - keep_alive:                (optional) enable connection keep alive (default: true)
     - connect_timeout:           (optional) connection timeout in milliseconds (default: 5 sec)
-    - auto_reconnect:            (optional) enable auto reconnection (default: true)
-    - max_page_size:             (optional) maximum page size (default: 100)
+    - operation_timeout:         (optional) key-value operation timeout in milliseconds (default: gocb default)
+    - auto_reconnect:            (optional) reopen lost own connection once and repeat GetOneById, Create and Update,
+                                 shared connections are left to their owner (default: true)
+    - max_page_size:             (optional) maximum page size, larger requested pages are clamped to it (default: 100)
     - debug:                     (optional) enable debug output (default: false).
+    - unset_nil_fields:          (optional) remove fields with nil values in UpdatePartially instead of ignoring them (default: false)
+    - verify_collection:         (optional) check that updated document belongs to the collection (default: true).
+                                 It reads the whole document before every Update, disable it to save the read
+    - history_collection:        (optional) collection to keep prior versions of updated and deleted items (default: none)
+    - coalesce_reads:            (optional) merge concurrent GetOneById reads of the same id into one call (default: false)
+    - subdoc_updates:            (optional) set only changed fields server-side in UpdatePartially when possible (default: false)
+    - key_separator:             (optional) separator between collection name and id in document keys,
+                                 set it to empty string to keep keys of version 1.1 and earlier (default: ":")
+    - max_write_concurrency:     (optional) maximum number of bulk write operations running in parallel (default: 0, no limit)
+    - persist_to:                (optional) number of nodes Create, Set, Update and Delete must be persisted to
+                                 before they are acknowledged, not applied to batch writes (default: 0)
+    - replicate_to:              (optional) number of replicas Create, Set, Update and Delete must be replicated to
+                                 before they are acknowledged, not applied to batch writes (default: 0)
 
 References:
 
 - *:logger:*:*:1.0           (optional) ILogger components to pass log messages components to pass log messages
+- *:counters:*:*:1.0         (optional) ICounters components to pass operation call counts and timings
 - *:discovery:*:*:1.0        (optional)  IDiscovery services
 - *:credential-store:*:*:1.0 (optional) Credential stores to resolve credentials
 
@@ -74,17 +101,19 @@ References:
       }
       name := filter.GetAsString("name")
       filterCondition := ""
+      params := make(map[string]interface{})
       if name != "" {
-          filterCondition += "name='" + name + "'"
+          filterCondition += "name=$name"
+          params["name"] = name
       }
-      tempPage, err := c.IdentifiableCouchbasePersistence.GetPageByFilter(correlationId, filterCondition, paging, "", "")
+      tempPage, err := c.IdentifiableCouchbasePersistence.GetPageByFilterWithParams(correlationId, filterCondition, params, paging, "", "")
       // Convert to MyDataPage
       dataLen := int64(len(tempPage.Data)) // For full release tempPage and delete this by GC
       data := make([]cbfixture.MyData, dataLen)
       for i, v := range tempPage.Data {
           data[i] = v.(cbfixture.MyData)
       }
-      page = cbfixture.NewMyDataPage(&dataLen, data)
+      page = cbfixture.NewMyDataPage(tempPage.Total, data)
       return page, err
   }
 
@@ -126,8 +155,9 @@ func InheritIdentifiableCouchbasePersistence(overrides ICouchbasePersistenceOver
 
 	c := IdentifiableCouchbasePersistence{}
 	c.CouchbasePersistence = *InheritCouchbasePersistence(overrides, proto, bucket)
-	c.MaxPageSize = 100
+	c.MaxPageSize = defaultMaxPageSize
 	c.CollectionName = collection
+	c.readCoalescer = NewReadCoalescer()
 	return &c
 }
 
@@ -142,34 +172,22 @@ func (c *IdentifiableCouchbasePersistence) Configure(config *cconf.ConfigParams)
 }
 
 // GetListByIds method are gets a list of data items retrieved by given unique ids.
+// Missing items are skipped.
 // Parameters:
 //   - correlationId     (optional) transaction id to trace execution through call chain.
 //   - ids               ids of data items to be retrieved
 // Returns:  items []interface{}, err error
 // a data list or error.
 func (c *IdentifiableCouchbasePersistence) GetListByIds(correlationId string, ids []interface{}) (items []interface{}, err error) {
-
 	if len(ids) == 0 {
 		return nil, nil
 	}
-	objectIds := c.GenerateBucketIds(ids)
-	var opItems []gocb.BulkOp
-	for _, id := range objectIds {
-		mapPointer := make(map[string]interface{}, 0)
-		opItems = append(opItems, &gocb.GetOp{Key: id, Value: mapPointer})
-	}
-	doErr := c.Bucket.Do(opItems)
-	if doErr != nil {
-		return nil, doErr
+	aligned, _, err := c.GetListByIdsWithMissing(correlationId, ids)
+	if err != nil {
+		return nil, err
 	}
 	items = make([]interface{}, 0)
-	for i := 0; i < len(opItems); i++ {
-		if opItems[i].(*gocb.GetOp).Err != nil {
-			continue
-		}
-		buf := opItems[i].(*gocb.GetOp).Value.(map[string]interface{})
-		item := c.ConvertFromMap(buf)
-
+	for _, item := range aligned {
 		if item != nil {
 			items = append(items, item)
 		}
@@ -177,149 +195,1109 @@ func (c *IdentifiableCouchbasePersistence) GetListByIds(correlationId string, id
 	return items, nil
 }
 
+// GetListByIdsWithMissing method are gets a list of data items retrieved by given unique ids
+// in a single bulk operation. Items are aligned with the requested ids,
+// missing items have nil slots and their ids are returned separately.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - ids               ids of data items to be retrieved
+// Returns:  items []interface{}, missing []interface{}, err error
+// data items in the order of ids, ids of missing items or error.
+func (c *IdentifiableCouchbasePersistence) GetListByIdsWithMissing(correlationId string, ids []interface{}) (items []interface{},
+	missing []interface{}, err error) {
+	defer c.trackOperation("GetListByIds")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if openErr := c.checkOpened(correlationId); openErr != nil {
+		return nil, nil, openErr
+	}
+
+	items = make([]interface{}, len(ids))
+	missing = make([]interface{}, 0)
+	if len(ids) == 0 {
+		return items, missing, nil
+	}
+	objectIds := c.GenerateBucketIds(ids)
+	opItems := make([]gocb.BulkOp, len(objectIds))
+	for i, id := range objectIds {
+		buf := make(map[string]interface{}, 0)
+		opItems[i] = &gocb.GetOp{Key: id, Value: &buf}
+	}
+	doErr := c.bucketOperations().Do(opItems)
+	if doErr != nil {
+		return nil, nil, wrapError(correlationId, doErr)
+	}
+	for i, op := range opItems {
+		getOp := op.(*gocb.GetOp)
+		if getOp.Err != nil {
+			if isKeyNotFoundError(getOp.Err) {
+				missing = append(missing, ids[i])
+				continue
+			}
+			return nil, nil, wrapError(correlationId, getOp.Err)
+		}
+		items[i] = c.convertDocument(correlationId, getOp.Key, *getOp.Value.(*map[string]interface{}))
+	}
+	c.Logger.Trace(correlationId, "Retrieved %d from %s, %d ids are missing", len(ids)-len(missing), c.BucketName, len(missing))
+	return items, missing, nil
+}
+
 // GetOneById method are gets a data item by its unique id.
 //   - correlationId     (optional) transaction id to trace execution through call chain.
 //   - id                an id of data item to be retrieved.
 // Returns:  item interface{}, err error
 // data item or error.
 func (c *IdentifiableCouchbasePersistence) GetOneById(correlationId string, id interface{}) (item interface{}, err error) {
+	defer c.trackOperation("GetOneById")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if openErr := c.checkOpened(correlationId); openErr != nil {
+		return nil, openErr
+	}
+	objectId := c.GenerateBucketId(id)
+
+	var buf map[string]interface{}
+	if c.Options.GetAsBoolean("coalesce_reads") {
+		// Concurrent reads of the same id share one call, each caller converts the document separately
+		result, getErr, _ := c.readCoalescer.Do(objectId, func() (result interface{}, err error) {
+			err = c.withReconnect(correlationId, func() (getErr error) {
+				result, getErr = c.getDocument(objectId)
+				return getErr
+			})
+			return result, err
+		})
+		if getErr != nil {
+			return nil, wrapError(correlationId, getErr)
+		}
+		buf, _ = result.(map[string]interface{})
+	} else {
+		getErr := c.withReconnect(correlationId, func() (getErr error) {
+			buf, getErr = c.getDocument(objectId)
+			return getErr
+		})
+		if getErr != nil {
+			return nil, wrapError(correlationId, getErr)
+		}
+	}
+	if buf == nil {
+		return nil, nil
+	}
+	c.Logger.Trace(correlationId, "Retrieved from %s by id = %s", c.BucketName, objectId)
+	item = c.convertDocument(correlationId, objectId, buf)
+	return item, nil
+}
+
+// GetOneByIdWithCas method are gets a data item by its unique id with the CAS value of its document.
+// The CAS value can be passed to UpdateWithCas, UpdatePartiallyWithCas or DeleteByIdWithCas
+// to detect concurrent changes.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - id                an id of data item to be retrieved.
+// Returns:  item interface{}, cas gocb.Cas, err error
+// data item and its CAS value, nil and 0 if the item doesn't exist, or error.
+func (c *IdentifiableCouchbasePersistence) GetOneByIdWithCas(correlationId string, id interface{}) (item interface{}, cas gocb.Cas, err error) {
+	defer c.trackOperation("GetOneByIdWithCas")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if openErr := c.checkOpened(correlationId); openErr != nil {
+		return nil, 0, openErr
+	}
 	objectId := c.GenerateBucketId(id)
 
 	buf := make(map[string]interface{}, 0)
-	_, getErr := c.Bucket.Get(objectId, &buf)
+	cas, getErr := c.getBucket().Get(objectId, &buf)
+	if getErr != nil {
+		// Ignore "Key does not exist on the server" error
+		if isKeyNotFoundError(getErr) {
+			return nil, 0, nil
+		}
+		return nil, 0, wrapError(correlationId, getErr)
+	}
+	c.Logger.Trace(correlationId, "Retrieved from %s by id = %s", c.BucketName, objectId)
+	item = c.convertDocument(correlationId, objectId, buf)
+	return item, cas, nil
+}
+
+// getDocument method reads a document by its key, it returns nil when the document doesn't exist
+func (c *IdentifiableCouchbasePersistence) getDocument(objectId string) (map[string]interface{}, error) {
+	buf := make(map[string]interface{}, 0)
+	_, getErr := c.getBucket().Get(objectId, &buf)
 	if getErr != nil {
 		// Ignore "Key does not exist on the server" error
-		if getErr == gocb.ErrKeyNotFound {
+		if isKeyNotFoundError(getErr) {
 			return nil, nil
 		}
 		return nil, getErr
 	}
-	c.Logger.Trace(correlationId, "Retrieved from %s by id = %s", c.BucketName, objectId)
-	item = c.ConvertFromMap(buf)
-	return item, nil
+	return buf, nil
 }
 
 // Create method are creates a data item.
+// Create is insert-only: when an item with the same id already exists the ConflictError
+// with "DUPLICATE_KEY" code is returned, use Set to insert or replace the item.
+// The item expires after options.default_ttl seconds when it is set.
 // Parameters:
 //   - correlation_id    (optional) transaction id to trace execution through call chain.
 //   - item              an item to be created.
 // Returns:  result interface{}, err error
 // created item or error.
 func (c *IdentifiableCouchbasePersistence) Create(correlationId string, item interface{}) (result interface{}, err error) {
+	return c.CreateWithTtl(correlationId, item, c.DefaultTtl())
+}
+
+// CreateWithTtl method are creates a data item that expires after a given time.
+// Following Couchbase rules, ttl up to 30 days (2592000 seconds) is relative to the current time,
+// larger values are treated as absolute Unix time.
+// Parameters:
+//   - correlation_id    (optional) transaction id to trace execution through call chain.
+//   - item              an item to be created.
+//   - ttl               time to live in seconds, 0 means no expiry.
+// Returns:  result interface{}, err error
+// created item or error.
+func (c *IdentifiableCouchbasePersistence) CreateWithTtl(correlationId string, item interface{}, ttl uint32) (result interface{}, err error) {
+	defer c.trackOperation("Create")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if typeErr := c.CheckItemType(correlationId, item); typeErr != nil {
+		return nil, typeErr
+	}
+	if writeErr := c.checkWritable(correlationId); writeErr != nil {
+		return nil, writeErr
+	}
 	if item == nil {
 		return nil, nil
 	}
 	var newItem interface{}
 	newItem = cmpersist.CloneObject(item, c.Prototype)
 	// Assign unique id if not exist
-	cmpersist.GenerateObjectId(&newItem)
-	insertedItem := c.Overrides.ConvertFromPublic(newItem)
-	id := cmpersist.GetObjectId(newItem)
+	c.GenerateObjectId(&newItem)
+	insertedItem, convErr := c.convertFromPublic(correlationId, newItem)
+	if convErr != nil {
+		return nil, convErr
+	}
+	id := c.ComposeId(newItem)
 	objectId := c.GenerateBucketId(id)
 
-	_, insErr := c.Bucket.Insert(objectId, insertedItem, 0)
+	insErr := c.withReconnect(correlationId, func() (insErr error) {
+		_, insErr = c.InsertDocument(correlationId, objectId, insertedItem, ttl)
+		return insErr
+	})
 
 	if insErr != nil {
-		return nil, insErr
+		return nil, c.wrapCreateError(correlationId, id, objectId, insErr)
 	}
 	c.Logger.Trace(correlationId, "Created in %s with id = %s", c.BucketName, id)
-	c.Overrides.ConvertToPublic(newItem)
+	if _, convErr := c.convertToPublic(correlationId, newItem); convErr != nil {
+		return nil, convErr
+	}
 	return c.GetPtrIfNeed(newItem), nil
 }
 
+// CreateMissing method are creates data items which ids don't exist yet.
+// Items with existing ids are skipped without errors.
+// The items expire after options.default_ttl seconds when it is set.
+// Parameters:
+//   - correlation_id    (optional) transaction id to trace execution through call chain.
+//   - items             items to be created.
+// Returns:  created []interface{}, skipped []interface{}, err error
+// created items, skipped items that already exist or error.
+func (c *IdentifiableCouchbasePersistence) CreateMissing(correlationId string, items []interface{}) (created []interface{}, skipped []interface{}, err error) {
+	defer c.trackOperation("CreateMissing")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if writeErr := c.checkWritable(correlationId); writeErr != nil {
+		return nil, nil, writeErr
+	}
+	created = make([]interface{}, 0)
+	skipped = make([]interface{}, 0)
+	if len(items) == 0 {
+		return created, skipped, nil
+	}
+
+	ttl := c.DefaultTtl()
+	newItems := make([]interface{}, 0, len(items))
+	var opItems []gocb.BulkOp
+	for _, item := range items {
+		if typeErr := c.CheckItemType(correlationId, item); typeErr != nil {
+			return nil, nil, typeErr
+		}
+		newItem := cmpersist.CloneObject(item, c.Prototype)
+		// Assign unique id if not exist
+		c.GenerateObjectId(&newItem)
+		objectId := c.GenerateBucketId(c.ComposeId(newItem))
+		insertedItem, convErr := c.convertFromPublic(correlationId, newItem)
+		if convErr != nil {
+			return nil, nil, convErr
+		}
+		opItems = append(opItems, &gocb.InsertOp{Key: objectId, Value: insertedItem, Expiry: ttl})
+		newItems = append(newItems, newItem)
+	}
+
+	// Insert fails for existing keys, so the existence check is atomic
+	doErr := c.DoBulkWrite(opItems)
+	if doErr != nil {
+		return nil, nil, wrapError(correlationId, doErr)
+	}
+	for i, op := range opItems {
+		insErr := op.(*gocb.InsertOp).Err
+		if insErr == nil {
+			if _, convErr := c.convertToPublic(correlationId, newItems[i]); convErr != nil {
+				return nil, nil, convErr
+			}
+			created = append(created, c.GetPtrIfNeed(newItems[i]))
+		} else if gocb.IsKeyExistsError(insErr) {
+			skipped = append(skipped, items[i])
+		} else if err == nil {
+			err = wrapError(correlationId, insErr)
+		}
+	}
+	c.Logger.Trace(correlationId, "Created %d and skipped %d existing items in %s", len(created), len(skipped), c.BucketName)
+	return created, skipped, err
+}
+
 // Set method are sets a data item. If the data item exists it updates it,
 // otherwise it create a new data item.
+// The item expires after options.default_ttl seconds when it is set.
 // Parameters:
 //   - correlation_id    (optional) transaction id to trace execution through call chain.
 //   - item              a item to be set.
 //   - callback          (optional) callback function that receives updated item or error.
 func (c *IdentifiableCouchbasePersistence) Set(correlationId string, item interface{}) (result interface{}, err error) {
+	return c.SetWithTtl(correlationId, item, c.DefaultTtl())
+}
+
+// SetWithTtl method are sets a data item that expires after a given time.
+// If the data item exists it updates it, otherwise it create a new data item.
+// Following Couchbase rules, ttl up to 30 days (2592000 seconds) is relative to the current time,
+// larger values are treated as absolute Unix time.
+// Parameters:
+//   - correlation_id    (optional) transaction id to trace execution through call chain.
+//   - item              a item to be set.
+//   - ttl               time to live in seconds, 0 means no expiry.
+// Returns:  result interface{}, err error
+// set item or error.
+func (c *IdentifiableCouchbasePersistence) SetWithTtl(correlationId string, item interface{}, ttl uint32) (result interface{}, err error) {
+	defer c.trackOperation("Set")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if typeErr := c.CheckItemType(correlationId, item); typeErr != nil {
+		return nil, typeErr
+	}
+	if writeErr := c.checkWritable(correlationId); writeErr != nil {
+		return nil, writeErr
+	}
 	if item == nil {
 		return nil, nil
 	}
 	var newItem interface{}
 	newItem = cmpersist.CloneObject(item, c.Prototype)
 	// Assign unique id if not exist
-	cmpersist.GenerateObjectId(&newItem)
-	id := cmpersist.GetObjectId(newItem)
-	setItem := c.Overrides.ConvertFromPublic(newItem)
+	c.GenerateObjectId(&newItem)
+	id := c.ComposeId(newItem)
+	setItem, convErr := c.convertFromPublic(correlationId, newItem)
+	if convErr != nil {
+		return nil, convErr
+	}
 	objectId := c.GenerateBucketId(id)
 
-	_, upsertErr := c.Bucket.Upsert(objectId, setItem, 0)
+	_, upsertErr := c.upsertDocument(objectId, setItem, ttl)
 
 	if upsertErr != nil {
-		return nil, upsertErr
+		return nil, wrapError(correlationId, upsertErr)
 	}
 
 	c.Logger.Trace(correlationId, "Set in %s with id = %s", c.BucketName, id)
-	c.Overrides.ConvertToPublic(newItem)
+	if _, convErr := c.convertToPublic(correlationId, newItem); convErr != nil {
+		return nil, convErr
+	}
 	return c.GetPtrIfNeed(newItem), nil
 }
 
+// CreateBatch method are creates data items in a single bulk operation.
+// Items without ids get generated ids. When some items fail, the others are still created.
+// Parameters:
+//   - correlation_id    (optional) transaction id to trace execution through call chain.
+//   - items             items to be created.
+// Returns:  results []interface{}, err error
+// created items or error. Results have the same order as items, failed items are nil
+// and their ids are listed in the "failed_ids" details of the error.
+func (c *IdentifiableCouchbasePersistence) CreateBatch(correlationId string, items []interface{}) (results []interface{}, err error) {
+	defer c.trackOperation("CreateBatch")()
+	return c.writeBatch(correlationId, items, true)
+}
+
+// SetBatch method are sets data items in a single bulk operation.
+// Existing items are replaced, missing items are created. Items without ids get generated ids.
+// Parameters:
+//   - correlation_id    (optional) transaction id to trace execution through call chain.
+//   - items             items to be set.
+// Returns:  results []interface{}, err error
+// set items or error. Results have the same order as items, failed items are nil
+// and their ids are listed in the "failed_ids" details of the error.
+func (c *IdentifiableCouchbasePersistence) SetBatch(correlationId string, items []interface{}) (results []interface{}, err error) {
+	defer c.trackOperation("SetBatch")()
+	return c.writeBatch(correlationId, items, false)
+}
+
+func (c *IdentifiableCouchbasePersistence) writeBatch(correlationId string, items []interface{}, insert bool) (results []interface{}, err error) {
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if writeErr := c.checkWritable(correlationId); writeErr != nil {
+		return nil, writeErr
+	}
+	results = make([]interface{}, len(items))
+	if len(items) == 0 {
+		return results, nil
+	}
+
+	ttl := c.DefaultTtl()
+	newItems := make([]interface{}, len(items))
+	ids := make([]interface{}, len(items))
+	opItems := make([]gocb.BulkOp, len(items))
+	for i, item := range items {
+		if typeErr := c.CheckItemType(correlationId, item); typeErr != nil {
+			return nil, typeErr
+		}
+		newItem := cmpersist.CloneObject(item, c.Prototype)
+		// Assign unique id if not exist
+		c.GenerateObjectId(&newItem)
+		ids[i] = c.ComposeId(newItem)
+		objectId := c.GenerateBucketId(ids[i])
+		value, convErr := c.convertFromPublic(correlationId, newItem)
+		if convErr != nil {
+			return nil, convErr
+		}
+		if insert {
+			opItems[i] = &gocb.InsertOp{Key: objectId, Value: value, Expiry: ttl}
+		} else {
+			opItems[i] = &gocb.UpsertOp{Key: objectId, Value: value, Expiry: ttl}
+		}
+		newItems[i] = newItem
+	}
+
+	doErr := c.DoBulkWrite(opItems)
+	if doErr != nil {
+		return nil, doErr
+	}
+
+	var firstErr error
+	failedIds := make([]interface{}, 0)
+	for i, op := range opItems {
+		var opErr error
+		if insert {
+			opErr = op.(*gocb.InsertOp).Err
+		} else {
+			opErr = op.(*gocb.UpsertOp).Err
+		}
+		if opErr != nil {
+			if firstErr == nil {
+				firstErr = opErr
+			}
+			failedIds = append(failedIds, ids[i])
+			continue
+		}
+		if _, convErr := c.convertToPublic(correlationId, newItems[i]); convErr != nil {
+			return nil, convErr
+		}
+		results[i] = c.GetPtrIfNeed(newItems[i])
+	}
+
+	c.Logger.Trace(correlationId, "Wrote %d of %d items in %s", len(items)-len(failedIds), len(items), c.BucketName)
+	if firstErr != nil {
+		return results, cerr.NewInternalError(correlationId, "BATCH_FAILED", "Failed to write "+strconv.Itoa(len(failedIds))+" items").
+			WithDetails("failed_ids", failedIds).
+			WithCause(firstErr)
+	}
+	return results, nil
+}
+
 // Update method are updates a data item.
+// When the item doesn't exist the NotFoundError with "OBJECT_NOT_FOUND" code is returned.
+// When the document is read to verify its collection and it is changed concurrently
+// before the replace, the ConflictError with "CAS_MISMATCH" code is returned.
 // Parameters:
 //   - correlation_id    (optional) transaction id to trace execution through call chain.
 //   - item              an item to be updated.
 // Returns:  result interface{}, err error
 // updated item or error.
 func (c *IdentifiableCouchbasePersistence) Update(correlationId string, item interface{}) (result interface{}, err error) {
+	return c.UpdateWithCas(correlationId, item, 0)
+}
+
+// UpdateWithCas method are updates a data item only if it wasn't changed since it was read
+// (optimistic concurrency). When the stored document has a different CAS value
+// the ConflictError with "CAS_MISMATCH" code is returned.
+// Parameters:
+//   - correlation_id    (optional) transaction id to trace execution through call chain.
+//   - item              an item to be updated.
+//   - cas               a CAS value of the document when it was read, 0 to skip the check.
+// Returns:  result interface{}, err error
+// updated item or error.
+func (c *IdentifiableCouchbasePersistence) UpdateWithCas(correlationId string, item interface{}, cas gocb.Cas) (result interface{}, err error) {
+	defer c.trackOperation("Update")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if typeErr := c.CheckItemType(correlationId, item); typeErr != nil {
+		return nil, typeErr
+	}
+	if writeErr := c.checkWritable(correlationId); writeErr != nil {
+		return nil, writeErr
+	}
 	var newItem interface{}
 	newItem = cmpersist.CloneObject(item, c.Prototype)
 	// Assign unique id if not exist
-	cmpersist.GenerateObjectId(&newItem)
-	id := cmpersist.GetObjectId(newItem)
-	updateItem := c.Overrides.ConvertFromPublic(newItem)
+	c.GenerateObjectId(&newItem)
+	id := c.ComposeId(newItem)
+	updateItem, convErr := c.convertFromPublic(correlationId, newItem)
+	if convErr != nil {
+		return nil, convErr
+	}
 	objectId := c.GenerateBucketId(id)
 
-	_, repErr := c.Bucket.Replace(objectId, updateItem, 0, 0)
+	replaceCas := cas
+	verifyCollection := c.Options.GetAsBooleanWithDefault("verify_collection", true)
+	if verifyCollection || c.isHistoryEnabled() {
+		buf := make(map[string]interface{})
+		var getCas gocb.Cas
+		getErr := c.withReconnect(correlationId, func() (getErr error) {
+			getCas, getErr = c.getBucket().Get(objectId, &buf)
+			return getErr
+		})
+		if getErr != nil {
+			return nil, c.wrapUpdateError(correlationId, id, getErr)
+		}
+		if cas != 0 && cas != getCas {
+			return nil, c.casMismatchError(correlationId, id)
+		}
+		// Replace only the document that was checked, so concurrent writes are not overwritten
+		replaceCas = getCas
+		if verifyCollection {
+			colErr := c.checkCollection(correlationId, objectId, buf)
+			if colErr != nil {
+				return nil, colErr
+			}
+		}
+		histErr := c.writeHistory(correlationId, objectId, buf)
+		if histErr != nil {
+			return nil, histErr
+		}
+	}
+
+	repErr := c.withReconnect(correlationId, func() (repErr error) {
+		_, repErr = c.replaceDocument(objectId, updateItem, replaceCas, 0)
+		return repErr
+	})
 
 	if repErr != nil {
-		return nil, repErr
+		if replaceCas != 0 && gocb.IsKeyExistsError(repErr) {
+			return nil, c.casMismatchError(correlationId, id)
+		}
+		return nil, c.wrapUpdateError(correlationId, id, repErr)
 	}
 	c.Logger.Trace(correlationId, "Updated in %s with id = %s", c.BucketName, id)
-	c.Overrides.ConvertToPublic(newItem)
+	if _, convErr := c.convertToPublic(correlationId, newItem); convErr != nil {
+		return nil, convErr
+	}
 	return c.GetPtrIfNeed(newItem), nil
 }
 
+// CompareAndSet method are atomically sets a field of data item to a new value
+// only if its current value equals to the expected one.
+// Concurrent changes of the item are detected by CAS and the comparison is repeated.
+// Parameters:
+//   - correlation_id    (optional) transaction id to trace execution through call chain.
+//   - id                an id of data item to be updated.
+//   - field             a name (path) of the field in the stored document.
+//   - expected          an expected current value of the field.
+//   - newValue          a new value of the field.
+// Returns: changed bool, err error
+// true if the field was set, false if the current value didn't match or the item doesn't exist, or error.
+func (c *IdentifiableCouchbasePersistence) CompareAndSet(correlationId string, id interface{}, field string,
+	expected interface{}, newValue interface{}) (changed bool, err error) {
+	defer c.trackOperation("CompareAndSet")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if writeErr := c.checkWritable(correlationId); writeErr != nil {
+		return false, writeErr
+	}
+
+	objectId := c.GenerateBucketId(id)
+	// Fields are addressed by the same dotted paths as in UpdatePartially,
+	// names that don't match the prototype are used as document paths as is
+	path, ok := c.documentPath(field)
+	if !ok {
+		path = field
+	}
+	// Flattened documents keep dotted paths as top level field names
+	flatten := c.Options.GetAsBoolean("flatten_fields")
+	subDocPath := path
+	if flatten {
+		subDocPath = escapeName(path)
+	}
+	// Normalize the expected value the same way as values read from JSON
+	var expectedValue interface{}
+	jsonBuf, _ := json.Marshal(expected)
+	json.Unmarshal(jsonBuf, &expectedValue)
+
+	operations := c.bucketOperations()
+	replicateTo, persistTo := c.durability()
+	for attempt := 0; attempt < 10; attempt++ {
+		buf := make(map[string]interface{})
+		getCas, getErr := operations.Get(objectId, &buf)
+		if getErr != nil {
+			if isKeyNotFoundError(getErr) {
+				return false, nil
+			}
+			return false, wrapError(correlationId, getErr)
+		}
+		if c.Options.GetAsBooleanWithDefault("verify_collection", true) {
+			colErr := c.checkCollection(correlationId, objectId, buf)
+			if colErr != nil {
+				return false, colErr
+			}
+		}
+
+		var current interface{}
+		if flatten {
+			current = buf[path]
+		} else {
+			current, _ = documentValue(buf, path)
+		}
+		if !reflect.DeepEqual(current, expectedValue) {
+			return false, nil
+		}
+
+		_, mutErr := operations.UpsertField(objectId, subDocPath, newValue, getCas, 0, replicateTo, persistTo)
+		if mutErr == nil {
+			c.Logger.Trace(correlationId, "Set %s in %s with id = %s", field, c.BucketName, id)
+			return true, nil
+		}
+		// The item was changed concurrently, compare again
+		if !gocb.IsKeyExistsError(mutErr) {
+			return false, wrapError(correlationId, mutErr)
+		}
+		if !c.acquireRetry() {
+			break
+		}
+	}
+	return false, cerr.NewConflictError(correlationId, "CONCURRENT_UPDATE", "Item was changed concurrently too many times").
+		WithDetails("id", id)
+}
+
+// casMismatchError method creates error for the document that was changed after it was read
+func (c *IdentifiableCouchbasePersistence) casMismatchError(correlationId string, id interface{}) error {
+	return cerr.NewConflictError(correlationId, "CAS_MISMATCH", "Item was changed by another operation").
+		WithDetails("id", id).
+		WithDetails("collection", c.CollectionName)
+}
+
+// wrapCreateError method converts errors of create operations.
+// An existing document is reported as ConflictError with "DUPLICATE_KEY" code carrying
+// the item id and collection, or with "COLLECTION_MISMATCH" code when the document
+// with the same key belongs to another collection sharing the bucket.
+func (c *IdentifiableCouchbasePersistence) wrapCreateError(correlationId string, id interface{}, objectId string, err error) error {
+	if !gocb.IsKeyExistsError(err) {
+		return wrapError(correlationId, err)
+	}
+	frag, lookErr := c.getBucket().LookupIn(objectId).Get(c.CollectionField).Execute()
+	if lookErr == nil || frag != nil {
+		var collection interface{}
+		frag.Content(c.CollectionField, &collection)
+		colErr := c.checkCollection(correlationId, objectId, map[string]interface{}{c.CollectionField: collection})
+		if colErr != nil {
+			return colErr
+		}
+	}
+	return cerr.NewConflictError(correlationId, "DUPLICATE_KEY", "Object with id "+
+		cconv.StringConverter.ToString(id)+" already exists in "+c.CollectionName).
+		WithDetails("id", id).
+		WithDetails("collection", c.CollectionName).
+		WithCause(err)
+}
+
+// wrapUpdateError method converts errors of update operations.
+// A missing document is reported as NotFoundError with "OBJECT_NOT_FOUND" code
+// carrying the item id and collection.
+func (c *IdentifiableCouchbasePersistence) wrapUpdateError(correlationId string, id interface{}, err error) error {
+	if isKeyNotFoundError(err) {
+		return cerr.NewNotFoundError(correlationId, "OBJECT_NOT_FOUND", "Object with id "+
+			cconv.StringConverter.ToString(id)+" was not found in "+c.CollectionName).
+			WithDetails("id", id).
+			WithDetails("collection", c.CollectionName).
+			WithCause(err)
+	}
+	return wrapError(correlationId, err)
+}
+
+// checkCollection method verifies that the stored document belongs to the persistence collection.
+// Bucket ids of different collections may collide, so the document could belong to another collection.
+func (c *IdentifiableCouchbasePersistence) checkCollection(correlationId string, objectId string, doc map[string]interface{}) error {
+	collection := cconv.StringConverter.ToString(doc[c.CollectionField])
+	if collection != c.CollectionName {
+		return cerr.NewConflictError(correlationId, "COLLECTION_MISMATCH", "Document "+objectId+" belongs to another collection").
+			WithDetails("id", objectId).
+			WithDetails("collection", c.CollectionName).
+			WithDetails("document_collection", collection)
+	}
+	return nil
+}
+
+// UpdateIfExists method are updates a data item only if it exists.
+// Unlike Update, a missing data item is not treated as an error.
+// Parameters:
+//   - correlation_id    (optional) transaction id to trace execution through call chain.
+//   - item              an item to be updated.
+// Returns:  result interface{}, existed bool, err error
+// updated item and true, nil and false if the item doesn't exist, or error.
+func (c *IdentifiableCouchbasePersistence) UpdateIfExists(correlationId string, item interface{}) (result interface{}, existed bool, err error) {
+	result, err = c.Update(correlationId, item)
+	if err != nil {
+		if isNotFoundError(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return result, true, nil
+}
+
 // UpdatePartially methos are updates only few selected fields in a data item.
+// When the item doesn't exist the NotFoundError with "OBJECT_NOT_FOUND" code is returned.
 // Parameters:
 //   - correlation_id    (optional) transaction id to trace execution through call chain.
 //   - id                an id of data item to be updated.
-//   - data              a map with fields to be updated.
+//   - data              a map with fields to be updated, nested fields are set by dotted names like "address.city".
 // Returns: result interface{}, err error
 // updated item or error.
 func (c *IdentifiableCouchbasePersistence) UpdatePartially(correlationId string, id interface{}, data *cdata.AnyValueMap) (item interface{}, err error) {
+	item, _, err = c.UpdatePartiallyWithCas(correlationId, id, data, 0)
+	return item, err
+}
+
+// UpdatePartiallyWithCas method are updates only few selected fields in a data item
+// only if it wasn't changed since it was read (optimistic concurrency).
+// When the stored document has a different CAS value the ConflictError with "CAS_MISMATCH" code is returned.
+// Parameters:
+//   - correlation_id    (optional) transaction id to trace execution through call chain.
+//   - id                an id of data item to be updated.
+//   - data              a map with fields to be updated.
+//   - cas               a CAS value of the document when it was read, 0 to skip the check.
+// Returns: item interface{}, newCas gocb.Cas, err error
+// updated item and its new CAS value or error.
+func (c *IdentifiableCouchbasePersistence) UpdatePartiallyWithCas(correlationId string, id interface{}, data *cdata.AnyValueMap,
+	cas gocb.Cas) (item interface{}, newCas gocb.Cas, err error) {
+	defer c.trackOperation("UpdatePartially")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if writeErr := c.checkWritable(correlationId); writeErr != nil {
+		return nil, 0, writeErr
+	}
 	if data == nil || id == nil {
-		return nil, nil
+		return nil, 0, nil
 	}
 
 	objectId := c.GenerateBucketId(id)
+	item, newCas, applied, subErr := c.updateSubDocument(correlationId, id, objectId, data, cas)
+	if applied {
+		return item, newCas, subErr
+	}
+
 	// Get document for update
 	buf := make(map[string]interface{})
-	getCas, getErr := c.Bucket.Get(objectId, &buf)
+	getCas, getErr := c.getBucket().Get(objectId, &buf)
 	if getErr != nil {
-		return nil, getErr
+		return nil, 0, c.wrapUpdateError(correlationId, id, getErr)
 	}
-	// Convert from map to protype object and reject "_c" field
-	newItem := c.GetProtoPtr()
+	if cas != 0 && cas != getCas {
+		return nil, 0, c.casMismatchError(correlationId, id)
+	}
+	if c.Options.GetAsBooleanWithDefault("verify_collection", true) {
+		colErr := c.checkCollection(correlationId, objectId, buf)
+		if colErr != nil {
+			return nil, 0, colErr
+		}
+	}
+	prevDoc := buf
+	if c.Options.GetAsBoolean("flatten_fields") {
+		buf = UnflattenDocument(buf)
+	}
+	// Make changes in a copy of the document, nested fields are set by dotted paths
+	changed := make(map[string]interface{})
 	jsonBuf, _ := json.Marshal(buf)
+	json.Unmarshal(jsonBuf, &changed)
+	// Split nil values that are either ignored or unset
+	unsetNil := c.Options.GetAsBooleanWithDefault("unset_nil_fields", false)
+	unsetPaths := make([]string, 0)
+	for key, value := range data.Value() {
+		path, ok := c.documentPath(key)
+		if !ok {
+			continue
+		}
+		if value == nil {
+			if unsetNil {
+				unsetPaths = append(unsetPaths, path)
+				removePath(changed, path)
+			}
+		} else {
+			setPath(changed, path, value)
+		}
+	}
+
+	// Convert from map to protype object
+	newItem := c.GetProtoPtr()
+	jsonBuf, _ = json.Marshal(changed)
 	json.Unmarshal(jsonBuf, newItem.Interface())
-	// Make changes in gets document
-	if c.Prototype.Kind() == reflect.Map {
-		refl.ObjectWriter.SetProperties(newItem.Elem().Interface(), data.Value())
-	} else {
-		refl.ObjectWriter.SetProperties(newItem.Interface(), data.Value())
+
+	// Compose the document keeping the collection field
+	doc := make(map[string]interface{})
+	jsonBuf, _ = json.Marshal(newItem.Interface())
+	json.Unmarshal(jsonBuf, &doc)
+	doc[c.CollectionField] = c.CollectionName
+	for _, path := range unsetPaths {
+		removePath(doc, path)
 	}
 
-	_, replErr := c.Bucket.Replace(objectId, newItem.Interface(), getCas, 0)
+	if c.Options.GetAsBoolean("flatten_fields") {
+		doc = FlattenDocument(doc)
+	}
+
+	histErr := c.writeHistory(correlationId, objectId, prevDoc)
+	if histErr != nil {
+		return nil, 0, histErr
+	}
+	newCas, replErr := c.replaceDocument(objectId, doc, getCas, 0)
 
 	if replErr != nil {
-		return nil, replErr
+		if cas != 0 && gocb.IsKeyExistsError(replErr) {
+			return nil, 0, c.casMismatchError(correlationId, id)
+		}
+		return nil, 0, c.wrapUpdateError(correlationId, id, replErr)
 	}
 	c.Logger.Trace(correlationId, "Updated partially in %s with id = %s", c.BucketName, id)
 	// Convert to return type
 	item = c.GetConvResult(newItem)
-	return item, nil
+	return item, newCas, nil
+}
+
+// maxSubDocPaths is the maximum number of paths in a single sub-document operation
+const maxSubDocPaths = 16
+
+// updateSubDocument method sets changed fields server-side with a sub-document mutation
+// when options.subdoc_updates is enabled. It returns applied = false when the update
+// needs the whole document: history is kept, fields are flattened, nil fields are unset
+// or the fields can't be mapped to document paths.
+func (c *IdentifiableCouchbasePersistence) updateSubDocument(correlationId string, id interface{}, objectId string,
+	data *cdata.AnyValueMap, cas gocb.Cas) (item interface{}, newCas gocb.Cas, applied bool, err error) {
+	if !c.Options.GetAsBoolean("subdoc_updates") || c.isHistoryEnabled() || c.Options.GetAsBoolean("flatten_fields") {
+		return nil, 0, false, nil
+	}
+	values := data.Value()
+	if len(values) > maxSubDocPaths {
+		return nil, 0, false, nil
+	}
+	unsetNil := c.Options.GetAsBooleanWithDefault("unset_nil_fields", false)
+	paths := make(map[string]interface{})
+	for key, value := range values {
+		if value == nil {
+			if unsetNil {
+				return nil, 0, false, nil
+			}
+			continue
+		}
+		path, ok := c.documentPath(key)
+		if !ok {
+			return nil, 0, false, nil
+		}
+		paths[path] = value
+	}
+
+	if c.Options.GetAsBooleanWithDefault("verify_collection", true) {
+		frag, lookErr := c.getBucket().LookupIn(objectId).Get(c.CollectionField).Execute()
+		if lookErr != nil && frag == nil {
+			return nil, 0, true, c.wrapUpdateError(correlationId, id, lookErr)
+		}
+		var collection interface{}
+		frag.Content(c.CollectionField, &collection)
+		colErr := c.checkCollection(correlationId, objectId, map[string]interface{}{c.CollectionField: collection})
+		if colErr != nil {
+			return nil, 0, true, colErr
+		}
+	}
+
+	if len(paths) > 0 {
+		mutation := c.mutateDocument(objectId, cas, 0)
+		for path, value := range paths {
+			mutation.Upsert(path, value, true)
+		}
+		_, mutErr := mutation.Execute()
+		if mutErr != nil {
+			if cas != 0 && gocb.IsKeyExistsError(mutErr) {
+				return nil, 0, true, c.casMismatchError(correlationId, id)
+			}
+			return nil, 0, true, c.wrapUpdateError(correlationId, id, mutErr)
+		}
+	}
+	c.Logger.Trace(correlationId, "Updated partially in %s with id = %s", c.BucketName, id)
+
+	// Read the updated item to return it
+	buf := make(map[string]interface{})
+	newCas, getErr := c.getBucket().Get(objectId, &buf)
+	if getErr != nil {
+		return nil, 0, true, c.wrapUpdateError(correlationId, id, getErr)
+	}
+	return c.convertDocument(correlationId, objectId, buf), newCas, true, nil
+}
+
+// documentPath method maps a property name to the JSON name of the matching prototype field.
+// Nested fields are set by dotted names like "address.city", keys of maps are kept as is.
+func (c *IdentifiableCouchbasePersistence) documentPath(name string) (path string, ok bool) {
+	proto := c.Prototype
+	names := strings.Split(name, ".")
+	for i, n := range names {
+		if n == "" {
+			return "", false
+		}
+		for proto.Kind() == reflect.Ptr {
+			proto = proto.Elem()
+		}
+		switch proto.Kind() {
+		case reflect.Map:
+			proto = proto.Elem()
+		case reflect.Interface:
+			// Any value, keep the rest of the path
+		case reflect.Struct:
+			field, jsonName, found := fieldByName(proto, n)
+			if !found {
+				return "", false
+			}
+			names[i] = jsonName
+			proto = field.Type
+		default:
+			return "", false
+		}
+	}
+	return strings.Join(names, "."), true
+}
+
+// fieldByName finds exported struct field by its JSON name or field name case insensitive
+func fieldByName(proto reflect.Type, name string) (field reflect.StructField, jsonName string, ok bool) {
+	for i := 0; i < proto.NumField(); i++ {
+		field := proto.Field(i)
+		if field.PkgPath != "" || field.Anonymous {
+			continue
+		}
+		jsonName := strings.Split(field.Tag.Get("json"), ",")[0]
+		if jsonName == "-" {
+			continue
+		}
+		if jsonName == "" {
+			jsonName = field.Name
+		}
+		if jsonName == name || strings.EqualFold(field.Name, name) {
+			return field, jsonName, true
+		}
+	}
+	return reflect.StructField{}, "", false
+}
+
+// GetFields method are gets only given fields of a data item without reading the whole document.
+// Missing fields are not included into the result.
+// Parameters:
+//   - correlationId     (optional) transaction id to trace execution through call chain.
+//   - id                an id of data item.
+//   - fields            paths of the fields in the stored document, like "content" or "address.city".
+// Returns: values map[string]interface{}, err error
+// field values by their paths, nil if the item doesn't exist, or error.
+func (c *IdentifiableCouchbasePersistence) GetFields(correlationId string, id interface{}, fields []string) (values map[string]interface{}, err error) {
+	defer c.trackOperation("GetFields")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if openErr := c.checkOpened(correlationId); openErr != nil {
+		return nil, openErr
+	}
+	objectId := c.GenerateBucketId(id)
+	values = make(map[string]interface{})
+	if len(fields) == 0 {
+		return values, nil
+	}
+
+	// Sub-document operations are limited in number of paths, so more fields are taken from the whole document
+	if len(fields) > maxSubDocPaths {
+		buf, getErr := c.getDocument(objectId)
+		if getErr != nil {
+			return nil, wrapError(correlationId, getErr)
+		}
+		if buf == nil {
+			return nil, nil
+		}
+		for _, field := range fields {
+			if value, ok := documentValue(buf, field); ok {
+				values[field] = value
+			}
+		}
+		return values, nil
+	}
+
+	lookup := c.getBucket().LookupIn(objectId)
+	for _, field := range fields {
+		lookup.Get(field)
+	}
+	// Missing paths fail only their own lookups, so the fragment is returned with an error
+	frag, lookErr := lookup.Execute()
+	if frag == nil {
+		if isKeyNotFoundError(lookErr) {
+			return nil, nil
+		}
+		return nil, wrapError(correlationId, lookErr)
+	}
+	for i, field := range fields {
+		var value interface{}
+		if frag.ContentByIndex(i, &value) == nil {
+			values[field] = value
+		}
+	}
+	c.Logger.Trace(correlationId, "Retrieved %d fields from %s by id = %s", len(values), c.BucketName, objectId)
+	return values, nil
+}
+
+// documentValue method gets a value from the document by a dotted path
+func documentValue(doc map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = doc
+	for _, name := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = m[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// isHistoryEnabled method checks if prior versions of items are kept in history collection
+func (c *IdentifiableCouchbasePersistence) isHistoryEnabled() bool {
+	return c.Options.GetAsString("history_collection") != ""
+}
+
+// historyKey method composes a key of history document for a given bucket id and version
+func (c *IdentifiableCouchbasePersistence) historyKey(objectId string, version string) string {
+	return c.Options.GetAsString("history_collection") + objectId + ":" + version
+}
+
+// writeHistory method stores a copy of the document as its next version in history collection
+func (c *IdentifiableCouchbasePersistence) writeHistory(correlationId string, objectId string, doc map[string]interface{}) error {
+	if !c.isHistoryEnabled() {
+		return nil
+	}
+
+	version, _, cntErr := c.getBucket().Counter(c.historyKey(objectId, "version"), 1, 1, 0)
+	if cntErr != nil {
+		return wrapError(correlationId, cntErr)
+	}
+	entry := map[string]interface{}{
+		c.CollectionField: c.Options.GetAsString("history_collection"),
+		"key":             objectId,
+		"version":         version,
+		"time":            time.Now().UTC(),
+		"item":            doc,
+	}
+	_, insErr := c.getBucket().Insert(c.historyKey(objectId, strconv.FormatUint(version, 10)), entry, 0)
+	if insErr != nil {
+		return wrapError(correlationId, insErr)
+	}
+	c.Logger.Trace(correlationId, "Saved version %d of %s to history", version, objectId)
+	return nil
+}
+
+// GetHistory method are gets prior versions of a data item kept in history collection,
+// from the oldest to the newest. It requires options.history_collection to be set.
+// Parameters:
+//   - correlation_id    (optional) transaction id to trace execution through call chain.
+//   - id                an id of data item.
+// Returns: items []interface{}, err error
+// prior versions of the data item or error.
+func (c *IdentifiableCouchbasePersistence) GetHistory(correlationId string, id interface{}) (items []interface{}, err error) {
+	defer c.trackOperation("GetHistory")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if openErr := c.checkOpened(correlationId); openErr != nil {
+		return nil, openErr
+	}
+	items = make([]interface{}, 0)
+	if !c.isHistoryEnabled() {
+		return items, nil
+	}
+
+	objectId := c.GenerateBucketId(id)
+	var version uint64
+	_, getErr := c.getBucket().Get(c.historyKey(objectId, "version"), &version)
+	if getErr != nil {
+		if isKeyNotFoundError(getErr) {
+			return items, nil
+		}
+		return nil, wrapError(correlationId, getErr)
+	}
+
+	var opItems []gocb.BulkOp
+	for v := uint64(1); v <= version; v++ {
+		buf := make(map[string]interface{}, 0)
+		opItems = append(opItems, &gocb.GetOp{
+			Key:   c.historyKey(objectId, strconv.FormatUint(v, 10)),
+			Value: &buf,
+		})
+	}
+	doErr := c.bucketOperations().Do(opItems)
+	if doErr != nil {
+		return nil, wrapError(correlationId, doErr)
+	}
+	for _, op := range opItems {
+		getOp := op.(*gocb.GetOp)
+		if getOp.Err != nil {
+			continue
+		}
+		entry := *getOp.Value.(*map[string]interface{})
+		items = append(items, c.convertDocument(correlationId, getOp.Key, entry["item"]))
+	}
+	c.Logger.Trace(correlationId, "Retrieved %d versions from history of %s", len(items), objectId)
+	return items, nil
+}
+
+// removeKey removes map key matching the name case insensitive
+func removeKey(m map[string]interface{}, name string) {
+	for key := range m {
+		if strings.EqualFold(key, name) {
+			delete(m, key)
+		}
+	}
+}
+
+// findKey returns map key matching the name case insensitive or the name itself
+func findKey(m map[string]interface{}, name string) string {
+	if _, ok := m[name]; ok {
+		return name
+	}
+	for key := range m {
+		if strings.EqualFold(key, name) {
+			return key
+		}
+	}
+	return name
+}
+
+// setPath sets value in the document by dotted path creating missing nested objects
+func setPath(doc map[string]interface{}, path string, value interface{}) {
+	names := strings.Split(path, ".")
+	for _, name := range names[:len(names)-1] {
+		key := findKey(doc, name)
+		nested, ok := doc[key].(map[string]interface{})
+		if !ok {
+			nested = make(map[string]interface{})
+			doc[key] = nested
+		}
+		doc = nested
+	}
+	doc[findKey(doc, names[len(names)-1])] = value
+}
+
+// removePath removes value from the document by dotted path
+func removePath(doc map[string]interface{}, path string) {
+	names := strings.Split(path, ".")
+	for _, name := range names[:len(names)-1] {
+		nested, ok := doc[findKey(doc, name)].(map[string]interface{})
+		if !ok {
+			return
+		}
+		doc = nested
+	}
+	removeKey(doc, names[len(names)-1])
 }
 
 // DeleteById mathod are deleted a data item by its unique id.
@@ -329,24 +1307,59 @@ func (c *IdentifiableCouchbasePersistence) UpdatePartially(correlationId string,
 // Returns: item interface{}, err error
 // deleted item or error.
 func (c *IdentifiableCouchbasePersistence) DeleteById(correlationId string, id interface{}) (item interface{}, err error) {
+	return c.DeleteByIdWithCas(correlationId, id, 0)
+}
+
+// DeleteByIdWithCas method are deletes a data item by its unique id
+// only if it wasn't changed since it was read (optimistic concurrency).
+// When the stored document has a different CAS value the ConflictError with "CAS_MISMATCH" code is returned.
+// Parameters:
+//   - correlation_id    (optional) transaction id to trace execution through call chain.
+//   - id                an id of the item to be deleted
+//   - cas               a CAS value of the document when it was read, 0 to skip the check.
+// Returns: item interface{}, err error
+// deleted item or error.
+func (c *IdentifiableCouchbasePersistence) DeleteByIdWithCas(correlationId string, id interface{}, cas gocb.Cas) (item interface{}, err error) {
+	defer c.trackOperation("DeleteById")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if writeErr := c.checkWritable(correlationId); writeErr != nil {
+		return nil, writeErr
+	}
 
 	objectId := c.GenerateBucketId(id)
 	buf := make(map[string]interface{})
 
-	_, getErr := c.Bucket.Get(objectId, &buf)
-	if getErr != nil || len(buf) == 0 {
-		return nil, getErr
+	getCas, getErr := c.getBucket().Get(objectId, &buf)
+	if getErr != nil {
+		// Ignore "Key does not exist on the server" error
+		if isKeyNotFoundError(getErr) {
+			return nil, nil
+		}
+		return nil, wrapError(correlationId, getErr)
+	}
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	if cas != 0 && cas != getCas {
+		return nil, c.casMismatchError(correlationId, id)
 	}
-	_, remErr := c.Bucket.Remove(objectId, 0)
+	histErr := c.writeHistory(correlationId, objectId, buf)
+	if histErr != nil {
+		return nil, histErr
+	}
+	_, remErr := c.removeDocument(objectId, cas)
 	if remErr != nil {
 		// Ignore "Key does not exist on the server" error
-		if remErr == gocb.ErrKeyNotFound {
+		if isKeyNotFoundError(remErr) {
 			return nil, nil
 		}
-		return nil, remErr
+		if cas != 0 && gocb.IsKeyExistsError(remErr) {
+			return nil, c.casMismatchError(correlationId, id)
+		}
+		return nil, wrapError(correlationId, remErr)
 	}
 	c.Logger.Trace(correlationId, "Deleted from %s with id = %s", c.BucketName, id)
-	oldItem := c.ConvertFromMap(buf)
+	oldItem := c.convertDocument(correlationId, objectId, buf)
 	return oldItem, nil
 }
 
@@ -356,26 +1369,40 @@ func (c *IdentifiableCouchbasePersistence) DeleteById(correlationId string, id i
 // Returns: error
 // error or nil for success.
 func (c *IdentifiableCouchbasePersistence) DeleteByIds(correlationId string, ids []interface{}) (err error) {
-	count := 0
+	defer c.trackOperation("DeleteByIds")()
+	correlationId = c.ResolveCorrelationId(correlationId)
+	if writeErr := c.checkWritable(correlationId); writeErr != nil {
+		return writeErr
+	}
+	// Each goroutine writes only its own slot, so results are collected without locks
+	removed := make([]bool, len(ids))
+	errs := make([]error, len(ids))
 	var wg sync.WaitGroup
-	err = nil
-	for _, id := range ids {
+	for index, id := range ids {
 		wg.Add(1)
-		go func(i interface{}) {
+		go func(index int, id interface{}) {
 			defer wg.Done()
-			objectId := c.GenerateBucketId(i)
-			_, remErr := c.Bucket.Remove(objectId, 0)
+			objectId := c.GenerateBucketId(id)
+			_, remErr := c.removeDocument(objectId, 0)
 			// Ignore "Key does not exist on the server" error
-			if remErr != nil && remErr != gocb.ErrKeyNotFound {
-				err = remErr
-			}
-			if remErr == nil {
-				count++
+			if remErr != nil && !isKeyNotFoundError(remErr) {
+				errs[index] = remErr
 			}
-		}(id)
+			removed[index] = remErr == nil
+		}(index, id)
 	}
-
 	wg.Wait()
+
+	count := 0
+	for index := range ids {
+		if removed[index] {
+			count++
+		}
+		// Return the error of the first failed id
+		if err == nil && errs[index] != nil {
+			err = errs[index]
+		}
+	}
 	c.Logger.Trace(correlationId, "Deleted %d items from %s", count, c.BucketName)
 	return err
 }
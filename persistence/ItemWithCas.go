@@ -0,0 +1,14 @@
+package persistence
+
+import (
+	gocb "gopkg.in/couchbase/gocb.v1"
+)
+
+// ItemWithCas is a data item paired with the CAS value of its document.
+// The CAS value can be used to update the item with optimistic concurrency.
+type ItemWithCas struct {
+	// The data item.
+	Item interface{} `json:"item"`
+	// The CAS value of the document.
+	Cas gocb.Cas `json:"cas"`
+}
@@ -0,0 +1,47 @@
+package persistence
+
+import (
+	"time"
+
+	gocb "gopkg.in/couchbase/gocb.v1"
+)
+
+// QueryOptions defines options applied to N1QL queries executed by the persistence.
+// Zero values are not passed to the query, so the server defaults are used.
+type QueryOptions struct {
+	// Scan consistency (gocb.NotBounded, gocb.RequestPlus or gocb.StatementPlus)
+	Consistency gocb.ConsistencyMode
+	// Query timeout
+	Timeout time.Duration
+	// True to format query results, false to return them compact
+	Pretty *bool
+	// True to return query metrics, false to skip them
+	Metrics *bool
+	// Context id to find the query in the server logs and active requests
+	ClientContextId string
+}
+
+// NewN1qlQuery method creates N1QL query with the options applied.
+// Parameters:
+//   - statement         a N1QL statement.
+// Returns: *gocb.N1qlQuery
+// a new query.
+func (c QueryOptions) NewN1qlQuery(statement string) *gocb.N1qlQuery {
+	query := gocb.NewN1qlQuery(statement)
+	if c.Consistency != 0 {
+		query.Consistency(c.Consistency)
+	}
+	if c.Timeout > 0 {
+		query.Timeout(c.Timeout)
+	}
+	if c.Pretty != nil {
+		query.Custom("pretty", *c.Pretty)
+	}
+	if c.Metrics != nil {
+		query.Custom("metrics", *c.Metrics)
+	}
+	if c.ClientContextId != "" {
+		query.Custom("client_context_id", c.ClientContextId)
+	}
+	return query
+}
@@ -0,0 +1,39 @@
+package persistence
+
+import (
+	"time"
+
+	gocb "gopkg.in/couchbase/gocb.v1"
+)
+
+// QueryStats are metrics of an executed N1QL query reported by the server.
+// They help to tune queries and indexes and to plan capacity.
+type QueryStats struct {
+	// Total time of the request including queueing
+	ElapsedTime time.Duration `json:"elapsed_time"`
+	// Time of the query execution
+	ExecutionTime time.Duration `json:"execution_time"`
+	// Number of returned rows
+	ResultCount int64 `json:"result_count"`
+	// Size of returned rows in bytes
+	ResultSize int64 `json:"result_size"`
+	// Number of sorted documents
+	SortCount int64 `json:"sort_count"`
+	// Number of changed documents
+	MutationCount int64 `json:"mutation_count"`
+}
+
+// NewQueryStats creates query stats from metrics of closed query results.
+// Parameters:
+//   - metrics   metrics of the query results
+// Returns QueryStats
+func NewQueryStats(metrics gocb.QueryResultMetrics) QueryStats {
+	return QueryStats{
+		ElapsedTime:   metrics.ElapsedTime,
+		ExecutionTime: metrics.ExecutionTime,
+		ResultCount:   int64(metrics.ResultCount),
+		ResultSize:    int64(metrics.ResultSize),
+		SortCount:     int64(metrics.SortCount),
+		MutationCount: int64(metrics.MutationCount),
+	}
+}
@@ -0,0 +1,54 @@
+package persistence
+
+import (
+	"sync"
+)
+
+type coalescedRead struct {
+	done   chan struct{}
+	result interface{}
+	err    error
+}
+
+// ReadCoalescer merges concurrent reads of the same key into a single call.
+// While a read of a key is in flight, other readers of that key wait for it
+// and receive the same result instead of issuing their own calls.
+type ReadCoalescer struct {
+	lock  sync.Mutex
+	calls map[string]*coalescedRead
+}
+
+// NewReadCoalescer method creates a new instance of ReadCoalescer.
+// Returns *ReadCoalescer
+func NewReadCoalescer() *ReadCoalescer {
+	return &ReadCoalescer{
+		calls: make(map[string]*coalescedRead),
+	}
+}
+
+// Do method executes read function for a given key. When a read of the same key
+// is already in flight it waits for it and returns its result.
+// Parameters:
+//   - key     a key of the read.
+//   - read    a function that performs the read.
+// Returns: result interface{}, err error, shared bool
+// the read result, error and true when the result was received from a read started by another caller.
+func (c *ReadCoalescer) Do(key string, read func() (interface{}, error)) (result interface{}, err error, shared bool) {
+	c.lock.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.lock.Unlock()
+		<-call.done
+		return call.result, call.err, true
+	}
+	call := &coalescedRead{done: make(chan struct{})}
+	c.calls[key] = call
+	c.lock.Unlock()
+
+	call.result, call.err = read()
+
+	c.lock.Lock()
+	delete(c.calls, key)
+	c.lock.Unlock()
+	close(call.done)
+	return call.result, call.err, false
+}
@@ -0,0 +1,49 @@
+package persistence
+
+import (
+	"sync"
+	"time"
+)
+
+// RetryBudget limits the rate of retries shared by all operations of a persistence.
+// It is a token bucket that is refilled with the configured number of retries per second
+// and holds at most one second of retries, so a storm of transient failures
+// can't cause unbounded retries.
+type RetryBudget struct {
+	lock       sync.Mutex
+	perSec     float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+// NewRetryBudget method creates a new instance of RetryBudget.
+// Parameters:
+//   - perSec   a number of retries allowed per second.
+// Returns *RetryBudget
+func NewRetryBudget(perSec float64) *RetryBudget {
+	return &RetryBudget{
+		perSec:     perSec,
+		tokens:     perSec,
+		lastRefill: time.Now(),
+	}
+}
+
+// TryAcquire method takes a retry from the budget.
+// Returns true if the retry is allowed and false when the budget is exhausted.
+func (c *RetryBudget) TryAcquire() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	c.tokens += now.Sub(c.lastRefill).Seconds() * c.perSec
+	if c.tokens > c.perSec {
+		c.tokens = c.perSec
+	}
+	c.lastRefill = now
+
+	if c.tokens < 1 {
+		return false
+	}
+	c.tokens--
+	return true
+}
@@ -0,0 +1,32 @@
+package persistence
+
+import (
+	gocb "gopkg.in/couchbase/gocb.v1"
+)
+
+// ViewOptions defines parameters of design document view queries.
+// Zero values are not passed to the view query.
+type ViewOptions struct {
+	// Exact key to query
+	Key interface{}
+	// Set of keys to query
+	Keys []interface{}
+	// Start of the key range
+	StartKey interface{}
+	// End of the key range (inclusive)
+	EndKey interface{}
+	// Number of rows to skip
+	Skip uint
+	// Maximum number of rows to return
+	Limit uint
+	// True to apply the view reduce function
+	Reduce bool
+	// True to group reduce results by key
+	Group bool
+	// Level of grouping for array keys
+	GroupLevel uint
+	// Index update mode (gocb.Before, gocb.None or gocb.After)
+	Stale gocb.StaleMode
+	// True to return documents fetched by the emitted ids instead of emitted values
+	IncludeDocs bool
+}
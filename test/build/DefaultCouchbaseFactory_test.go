@@ -0,0 +1,66 @@
+package test_build
+
+import (
+	"testing"
+
+	cconf "github.com/pip-services3-go/pip-services3-commons-go/config"
+	cref "github.com/pip-services3-go/pip-services3-commons-go/refer"
+	cbuild "github.com/pip-services3-go/pip-services3-couchbase-go/build"
+	connect "github.com/pip-services3-go/pip-services3-couchbase-go/connect"
+	cbpersist "github.com/pip-services3-go/pip-services3-couchbase-go/test/persistence"
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestDefaultCouchbaseFactoryDescriptorDefaults(t *testing.T) {
+	dummiesDescriptor := cref.NewDescriptor("pip-services", "persistence", "couchbase", "dummies", "1.0")
+	reportsDescriptor := cref.NewDescriptor("pip-services", "persistence", "couchbase", "reports", "1.0")
+
+	factory := cbuild.NewDefaultCouchbaseFactory()
+	factory.RegisterType(dummiesDescriptor, cbpersist.NewDummyCouchbasePersistence)
+	factory.RegisterType(reportsDescriptor, cbpersist.NewDummyCouchbasePersistence)
+	factory.Configure(cconf.NewConfigParamsFromTuples(
+		"dummies.options.consistency", "request_plus",
+		"reports.options.consistency", "not_bounded",
+		"reports.options.query_timeout", 30000,
+	))
+
+	component, err := factory.Create(dummiesDescriptor)
+	assert.Nil(t, err)
+	dummies := component.(*cbpersist.DummyCouchbasePersistence)
+	assert.Equal(t, "request_plus", dummies.Options.GetAsString("consistency"))
+
+	component, err = factory.Create(reportsDescriptor)
+	assert.Nil(t, err)
+	reports := component.(*cbpersist.DummyCouchbasePersistence)
+	assert.Equal(t, "not_bounded", reports.Options.GetAsString("consistency"))
+
+	// Instance configuration overrides only the keys it sets
+	reports.Configure(cconf.NewConfigParamsFromTuples("options.query_timeout", 1000))
+	assert.Equal(t, "not_bounded", reports.Options.GetAsString("consistency"))
+	assert.Equal(t, int64(1000), reports.Options.GetAsLong("query_timeout"))
+}
+
+func TestDefaultCouchbaseFactoryCreate(t *testing.T) {
+	factory := cbuild.NewDefaultCouchbaseFactory()
+	factory.RegisterPersistence("dummies", cbpersist.NewDummyCouchbasePersistence)
+	factory.Configure(cconf.NewConfigParamsFromTuples(
+		"default.bucket", "test",
+	))
+
+	component, err := factory.Create(cref.NewDescriptor("pip-services", "connection", "couchbase", "default", "1.0"))
+	assert.Nil(t, err)
+	connection, ok := component.(*connect.CouchbaseConnection)
+	assert.True(t, ok)
+	if ok {
+		assert.Equal(t, "test", connection.GetBucketName())
+	}
+
+	component, err = factory.Create(cref.NewDescriptor("pip-services", "persistence", "couchbase", "dummies", "1.0"))
+	assert.Nil(t, err)
+	_, ok = component.(*cbpersist.DummyCouchbasePersistence)
+	assert.True(t, ok)
+
+	component, err = factory.Create(cref.NewDescriptor("pip-services", "persistence", "couchbase", "reports", "1.0"))
+	assert.NotNil(t, err)
+	assert.Nil(t, component)
+}
@@ -1,9 +1,14 @@
 package test_connect
 
 import (
+	"strings"
 	"testing"
+	"time"
 
 	cconf "github.com/pip-services3-go/pip-services3-commons-go/config"
+	cerr "github.com/pip-services3-go/pip-services3-commons-go/errors"
+	cref "github.com/pip-services3-go/pip-services3-commons-go/refer"
+	ccon "github.com/pip-services3-go/pip-services3-components-go/connect"
 	cbcon "github.com/pip-services3-go/pip-services3-couchbase-go/connect"
 	"github.com/stretchr/testify/assert"
 )
@@ -13,6 +18,17 @@ func TestCouchbaseConnectionResolver(t *testing.T) {
 	t.Run("CouchbaseConnectionResolver:Single Connection", SingleConnection)
 	t.Run("CouchbaseConnectionResolver:Multiple Connections", MultipleConnections)
 	t.Run("CouchbaseConnectionResolver:Connection with Credentials", ConnectionCredentials)
+	t.Run("CouchbaseConnectionResolver:Allowed Options", AllowedOptions)
+	t.Run("CouchbaseConnectionResolver:Validated Options", ValidatedOptions)
+	t.Run("CouchbaseConnectionResolver:Bucket Password", BucketPassword)
+	t.Run("CouchbaseConnectionResolver:Cache", ResolveCache)
+	t.Run("CouchbaseConnectionResolver:Single SSL Connection", SingleSslConnection)
+	t.Run("CouchbaseConnectionResolver:Multiple SSL Connections", MultipleSslConnections)
+	t.Run("CouchbaseConnectionResolver:SSL Connection with Credentials", SslConnectionCredentials)
+	t.Run("CouchbaseConnectionResolver:Unsupported Protocol", UnsupportedProtocol)
+	t.Run("CouchbaseConnectionResolver:Discovered Connections", DiscoveredConnections)
+	t.Run("CouchbaseConnectionResolver:IPv6 Connection", Ipv6Connection)
+	t.Run("CouchbaseConnectionResolver:Missing Password", MissingPassword)
 
 }
 func SingleConnection(t *testing.T) {
@@ -73,3 +89,306 @@ func ConnectionCredentials(t *testing.T) {
 	assert.Equal(t, "password123", connection.Password)
 
 }
+
+func AllowedOptions(t *testing.T) {
+	config := cconf.NewConfigParamsFromTuples(
+		"connection.host", "localhost",
+		"connection.port", "8092",
+		"connection.database", "test",
+		"connection.kv_pool_size", "2",
+		"connection.bogus_option", "abc",
+		"connection.custom_option", "1",
+		"options.allowed_connection_options", "custom_option",
+	)
+
+	resolver := cbcon.NewCouchbaseConnectionResolver()
+	resolver.Configure(config)
+	connection, err := resolver.Resolve("")
+	assert.Nil(t, err)
+	assert.NotNil(t, connection)
+	assert.True(t, strings.HasPrefix(connection.Uri, "couchbase://localhost:8092/test?"))
+	assert.Contains(t, connection.Uri, "kv_pool_size=2")
+	assert.Contains(t, connection.Uri, "custom_option=1")
+	assert.NotContains(t, connection.Uri, "bogus_option")
+}
+
+func ValidatedOptions(t *testing.T) {
+	config := cconf.NewConfigParamsFromTuples(
+		"connection.host", "localhost",
+		"connection.port", "8092",
+		"connection.database", "test",
+		"connection.Config_Total_Timeout", "5000",
+		"connection.query_timeout", "10000",
+		"connection.compression", "false",
+	)
+
+	resolver := cbcon.NewCouchbaseConnectionResolver()
+	resolver.Configure(config)
+	connection, err := resolver.Resolve("")
+	assert.Nil(t, err)
+	assert.Contains(t, connection.Uri, "config_total_timeout=5000")
+	assert.Contains(t, connection.Uri, "n1ql_timeout=10000")
+	assert.Contains(t, connection.Uri, "compression=false")
+	assert.NotContains(t, connection.Uri, "query_timeout")
+
+	config = cconf.NewConfigParamsFromTuples(
+		"connection.host", "localhost",
+		"connection.port", "8092",
+		"connection.n1ql_timeout", "10s",
+	)
+	resolver = cbcon.NewCouchbaseConnectionResolver()
+	resolver.Configure(config)
+	_, err = resolver.Resolve("123")
+	assert.NotNil(t, err)
+	appErr, ok := err.(*cerr.ApplicationError)
+	assert.True(t, ok)
+	if ok {
+		assert.Equal(t, "INVALID_CONNECTION_OPTION", appErr.Code)
+		assert.Equal(t, "n1ql_timeout", appErr.Details["option"])
+	}
+}
+
+func BucketPassword(t *testing.T) {
+	config := cconf.NewConfigParamsFromTuples(
+		"connection.host", "localhost",
+		"connection.port", "8091",
+		"connection.database", "test",
+		"connection.bucket_password", "secret",
+	)
+
+	resolver := cbcon.NewCouchbaseConnectionResolver()
+	resolver.Configure(config)
+	connection, err := resolver.Resolve("")
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", connection.BucketPassword)
+	assert.Equal(t, "couchbase://localhost/test", connection.Uri)
+}
+
+type countingDiscovery struct {
+	calls int
+}
+
+func (c *countingDiscovery) Register(correlationId string, key string,
+	connection *ccon.ConnectionParams) (*ccon.ConnectionParams, error) {
+	return connection, nil
+}
+
+func (c *countingDiscovery) ResolveOne(correlationId string, key string) (*ccon.ConnectionParams, error) {
+	c.calls++
+	return ccon.NewConnectionParamsFromTuples("host", "localhost", "port", 8092, "database", "test"), nil
+}
+
+func (c *countingDiscovery) ResolveAll(correlationId string, key string) ([]*ccon.ConnectionParams, error) {
+	connection, err := c.ResolveOne(correlationId, key)
+	return []*ccon.ConnectionParams{connection}, err
+}
+
+func ResolveCache(t *testing.T) {
+	config := cconf.NewConfigParamsFromTuples(
+		"connection.discovery_key", "couchbase",
+		"options.resolve_cache_ttl", 60000,
+	)
+	discovery := &countingDiscovery{}
+
+	resolver := cbcon.NewCouchbaseConnectionResolver()
+	resolver.Configure(config)
+	resolver.SetReferences(cref.NewReferencesFromTuples(
+		cref.NewDescriptor("pip-services", "discovery", "counting", "default", "1.0"), discovery,
+	))
+
+	connection, err := resolver.Resolve("")
+	assert.Nil(t, err)
+	assert.Equal(t, "couchbase://localhost:8092/test", connection.Uri)
+	calls := discovery.calls
+	assert.True(t, calls > 0)
+
+	// Changes of the result must not affect the cache
+	connection.Uri = "changed"
+	connection, err = resolver.Resolve("")
+	assert.Nil(t, err)
+	assert.Equal(t, "couchbase://localhost:8092/test", connection.Uri)
+	assert.Equal(t, calls, discovery.calls)
+
+	resolver.Invalidate()
+	_, err = resolver.Resolve("")
+	assert.Nil(t, err)
+	assert.True(t, discovery.calls > calls)
+
+	// Expired parameters are resolved again
+	resolver.CacheTimeout = time.Millisecond
+	resolver.Invalidate()
+	_, err = resolver.Resolve("")
+	assert.Nil(t, err)
+	calls = discovery.calls
+	time.Sleep(5 * time.Millisecond)
+	_, err = resolver.Resolve("")
+	assert.Nil(t, err)
+	assert.True(t, discovery.calls > calls)
+}
+
+func SingleSslConnection(t *testing.T) {
+	config := cconf.NewConfigParamsFromTuples(
+		"connection.host", "localhost",
+		"connection.port", "18091",
+		"connection.database", "test",
+		"connection.ssl", "true",
+		"connection.certpath", "/etc/couchbase/ca.pem",
+	)
+
+	resolver := cbcon.NewCouchbaseConnectionResolver()
+	resolver.Configure(config)
+	connection, err := resolver.Resolve("")
+	assert.Nil(t, err)
+	assert.NotNil(t, connection)
+	assert.Equal(t, "couchbases://localhost/test?certpath=/etc/couchbase/ca.pem", connection.Uri)
+}
+
+func MultipleSslConnections(t *testing.T) {
+	config := cconf.NewConfigParamsFromTuples(
+		"connections.1.protocol", "couchbases",
+		"connections.1.host", "host1",
+		"connections.1.port", "11207",
+		"connections.1.database", "test",
+		"connections.2.protocol", "couchbases",
+		"connections.2.host", "host2",
+		"connections.2.port", "11207",
+		"connections.2.database", "test",
+	)
+
+	resolver := cbcon.NewCouchbaseConnectionResolver()
+	resolver.Configure(config)
+	connection, err := resolver.Resolve("")
+	assert.Nil(t, err)
+	assert.NotNil(t, connection)
+	assert.True(t, strings.HasPrefix(connection.Uri, "couchbases://"))
+	assert.Contains(t, connection.Uri, "host1:11207")
+	assert.Contains(t, connection.Uri, "host2:11207")
+	assert.NotContains(t, connection.Uri, "protocol")
+}
+
+func SslConnectionCredentials(t *testing.T) {
+	config := cconf.NewConfigParamsFromTuples(
+		"connection.protocol", "couchbases",
+		"connection.host", "localhost",
+		"connection.port", "8092",
+		"connection.database", "test",
+		"credential.username", "admin",
+		"credential.password", "password123",
+	)
+
+	resolver := cbcon.NewCouchbaseConnectionResolver()
+	resolver.Configure(config)
+	connection, err := resolver.Resolve("")
+	assert.Nil(t, err)
+	assert.NotNil(t, connection)
+	assert.Equal(t, "couchbases://localhost:8092/test", connection.Uri)
+	assert.Equal(t, "admin", connection.Username)
+	assert.Equal(t, "password123", connection.Password)
+}
+
+func UnsupportedProtocol(t *testing.T) {
+	config := cconf.NewConfigParamsFromTuples(
+		"connection.protocol", "http",
+		"connection.host", "localhost",
+		"connection.port", "8092",
+		"connection.database", "test",
+	)
+
+	resolver := cbcon.NewCouchbaseConnectionResolver()
+	resolver.Configure(config)
+	_, err := resolver.Resolve("")
+	assert.NotNil(t, err)
+}
+
+func DiscoveredConnections(t *testing.T) {
+	config := cconf.NewConfigParamsFromTuples(
+		"connection.discovery_key", "couchbase",
+		"connection.database", "test",
+	)
+
+	discovery := ccon.NewEmptyMemoryDiscovery()
+	discovery.Register("", "couchbase", ccon.NewConnectionParamsFromTuples("host", "node1", "port", 8092))
+	discovery.Register("", "couchbase", ccon.NewConnectionParamsFromTuples("host", "node2", "port", 8092))
+	discovery.Register("", "couchbase", ccon.NewConnectionParamsFromTuples("host", "node3", "port", 8091))
+	// The same node may be registered more than once
+	discovery.Register("", "couchbase", ccon.NewConnectionParamsFromTuples("host", "node1", "port", 8092))
+
+	resolver := cbcon.NewCouchbaseConnectionResolver()
+	resolver.Configure(config)
+	resolver.SetReferences(cref.NewReferencesFromTuples(
+		cref.NewDescriptor("pip-services", "discovery", "memory", "default", "1.0"), discovery,
+	))
+	connection, err := resolver.Resolve("")
+	assert.Nil(t, err)
+	assert.NotNil(t, connection)
+	assert.Equal(t, "couchbase://node1:8092,node2:8092,node3/test", connection.Uri)
+}
+
+func Ipv6Connection(t *testing.T) {
+	config := cconf.NewConfigParamsFromTuples(
+		"connection.host", "::1",
+		"connection.port", "8092",
+		"connection.database", "test",
+	)
+
+	resolver := cbcon.NewCouchbaseConnectionResolver()
+	resolver.Configure(config)
+	connection, err := resolver.Resolve("")
+	assert.Nil(t, err)
+	assert.NotNil(t, connection)
+	assert.Equal(t, "couchbase://[::1]:8092/test", connection.Uri)
+
+	// Default port is omitted, but the address is still in brackets
+	config.SetAsObject("connection.port", "8091")
+	resolver = cbcon.NewCouchbaseConnectionResolver()
+	resolver.Configure(config)
+	connection, err = resolver.Resolve("")
+	assert.Nil(t, err)
+	assert.NotNil(t, connection)
+	assert.Equal(t, "couchbase://[::1]/test", connection.Uri)
+}
+
+func MissingPassword(t *testing.T) {
+	config := cconf.NewConfigParamsFromTuples(
+		"connection.host", "localhost",
+		"connection.port", "8092",
+		"connection.database", "test",
+		"credential.username", "admin",
+	)
+
+	resolver := cbcon.NewCouchbaseConnectionResolver()
+	resolver.Configure(config)
+	_, err := resolver.Resolve("123")
+	assert.NotNil(t, err)
+	appErr, ok := err.(*cerr.ApplicationError)
+	assert.True(t, ok)
+	if ok {
+		assert.Equal(t, "NO_PASSWORD", appErr.Code)
+		assert.Equal(t, cerr.Misconfiguration, appErr.Category)
+	}
+
+	// Password is resolved later from the credential store
+	config = cconf.NewConfigParamsFromTuples(
+		"connection.host", "localhost",
+		"connection.port", "8092",
+		"credential.username", "admin",
+		"credential.store_key", "couchbase",
+	)
+	resolver = cbcon.NewCouchbaseConnectionResolver()
+	resolver.Configure(config)
+	_, err = resolver.Resolve("123")
+	assert.Nil(t, err)
+
+	// Buckets accessed by name without a password
+	config = cconf.NewConfigParamsFromTuples(
+		"connection.host", "localhost",
+		"connection.port", "8092",
+		"credential.username", "test",
+		"options.validate_credentials", false,
+	)
+	resolver = cbcon.NewCouchbaseConnectionResolver()
+	resolver.Configure(config)
+	connection, err := resolver.Resolve("123")
+	assert.Nil(t, err)
+	assert.Equal(t, "test", connection.Username)
+}
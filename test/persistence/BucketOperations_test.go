@@ -0,0 +1,206 @@
+package test_persistence
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+
+	cconf "github.com/pip-services3-go/pip-services3-commons-go/config"
+	cerr "github.com/pip-services3-go/pip-services3-commons-go/errors"
+	cref "github.com/pip-services3-go/pip-services3-commons-go/refer"
+	connect "github.com/pip-services3-go/pip-services3-couchbase-go/connect"
+	persist "github.com/pip-services3-go/pip-services3-couchbase-go/persistence"
+	cbfixture "github.com/pip-services3-go/pip-services3-couchbase-go/test/fixture"
+	assert "github.com/stretchr/testify/assert"
+	gocb "gopkg.in/couchbase/gocb.v1"
+)
+
+// stubQueryResults returns rows of a simulated N1QL query
+type stubQueryResults struct {
+	rows    []interface{}
+	metrics gocb.QueryResultMetrics
+}
+
+func (c *stubQueryResults) One(valuePtr interface{}) error {
+	if !c.Next(valuePtr) {
+		return gocb.ErrNoResults
+	}
+	return nil
+}
+
+func (c *stubQueryResults) Next(valuePtr interface{}) bool {
+	data := c.NextBytes()
+	return data != nil && json.Unmarshal(data, valuePtr) == nil
+}
+
+func (c *stubQueryResults) NextBytes() []byte {
+	if len(c.rows) == 0 {
+		return nil
+	}
+	data, _ := json.Marshal(c.rows[0])
+	c.rows = c.rows[1:]
+	return data
+}
+
+func (c *stubQueryResults) Close() error                     { return nil }
+func (c *stubQueryResults) RequestId() string                { return "" }
+func (c *stubQueryResults) ClientContextId() string          { return "" }
+func (c *stubQueryResults) Metrics() gocb.QueryResultMetrics { return c.metrics }
+func (c *stubQueryResults) Profile() interface{}             { return nil }
+func (c *stubQueryResults) SourceEndpoint() string           { return "" }
+
+// stubBucketOperations simulates bucket operations and records executed queries.
+// Operations without a set function succeed with empty results.
+type stubBucketOperations struct {
+	lock       sync.Mutex
+	statements []string
+	queries    []persist.QueryOptions
+
+	query  func(statement string) (gocb.QueryResults, error)
+	do     func(ops []gocb.BulkOp) error
+	get    func(key string, valuePtr interface{}) (gocb.Cas, error)
+	insert func(key string, value interface{}) (gocb.Cas, error)
+	upsert func(key string, path string, value interface{}, cas gocb.Cas) (gocb.Cas, error)
+}
+
+func (c *stubBucketOperations) ExecuteN1qlQuery(statement string, options persist.QueryOptions, params interface{}) (gocb.QueryResults, error) {
+	c.lock.Lock()
+	c.statements = append(c.statements, statement)
+	c.queries = append(c.queries, options)
+	c.lock.Unlock()
+	if c.query == nil {
+		return &stubQueryResults{}, nil
+	}
+	return c.query(statement)
+}
+
+func (c *stubBucketOperations) Do(ops []gocb.BulkOp) error {
+	if c.do == nil {
+		return nil
+	}
+	return c.do(ops)
+}
+
+func (c *stubBucketOperations) Get(key string, valuePtr interface{}) (gocb.Cas, error) {
+	if c.get == nil {
+		return 0, gocb.ErrKeyNotFound
+	}
+	return c.get(key, valuePtr)
+}
+
+func (c *stubBucketOperations) Insert(key string, value interface{}, expiry uint32, replicateTo uint, persistTo uint) (gocb.Cas, error) {
+	if c.insert == nil {
+		return 1, nil
+	}
+	return c.insert(key, value)
+}
+
+func (c *stubBucketOperations) UpsertField(key string, path string, value interface{}, cas gocb.Cas, expiry uint32,
+	replicateTo uint, persistTo uint) (gocb.Cas, error) {
+	if c.upsert == nil {
+		return cas + 1, nil
+	}
+	return c.upsert(key, path, value, cas)
+}
+
+// Queries returns options of the executed queries
+func (c *stubBucketOperations) Queries() []persist.QueryOptions {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]persist.QueryOptions{}, c.queries...)
+}
+
+// stubDummyPersistence doesn't define schema, so it is opened without a server
+type stubDummyPersistence struct {
+	persist.IdentifiableCouchbasePersistence
+}
+
+func newStubDummyPersistence() *stubDummyPersistence {
+	c := &stubDummyPersistence{}
+	c.IdentifiableCouchbasePersistence = *persist.InheritIdentifiableCouchbasePersistence(c, reflect.TypeOf(cbfixture.Dummy{}), "test", "dummies")
+	return c
+}
+
+func (c *stubDummyPersistence) DefineSchema() {}
+
+// openStubPersistence opens the persistence over a shared connection that is marked as opened,
+// all operations of the persistence run through the stub bucket operations.
+// Options are set as "options.<name>" tuples. The persistence is closed when the test ends.
+func openStubPersistence(t *testing.T, operations persist.IBucketOperations, tuples ...interface{}) *stubDummyPersistence {
+	connection := connect.NewCouchbaseConnection("test")
+	connection.Connection = &gocb.Cluster{}
+	connection.Bucket = &gocb.Bucket{}
+
+	persistence := newStubDummyPersistence()
+	persistence.Configure(cconf.NewConfigParamsFromTuples(tuples...))
+	persistence.SetReferences(cref.NewReferencesFromTuples(
+		cref.NewDescriptor("pip-services", "connection", "couchbase", "default", "1.0"), connection,
+	))
+	persistence.SetBucketOperations(operations)
+
+	opnErr := persistence.Open("")
+	assert.Nil(t, opnErr)
+	t.Cleanup(func() { persistence.Close("") })
+	return persistence
+}
+
+func TestCouchbasePersistenceIsSameDocument(t *testing.T) {
+	stored := map[string]interface{}{"id": "1", "key": "Key 1", "count": float64(2)}
+
+	assert.True(t, persist.IsSameDocument(map[string]interface{}{"id": "1", "key": "Key 1", "count": 2}, stored))
+	assert.True(t, persist.IsSameDocument(struct {
+		Id    string `json:"id"`
+		Key   string `json:"key"`
+		Count int    `json:"count"`
+	}{Id: "1", Key: "Key 1", Count: 2}, stored))
+
+	assert.False(t, persist.IsSameDocument(map[string]interface{}{"id": "1", "key": "Key 2", "count": 2}, stored))
+	assert.False(t, persist.IsSameDocument(map[string]interface{}{"id": "1", "key": "Key 1"}, stored))
+	assert.False(t, persist.IsSameDocument(map[string]interface{}{"id": "1", "key": "Key 1", "count": 2, "content": ""}, stored))
+	assert.False(t, persist.IsSameDocument(make(chan int), stored))
+	assert.False(t, persist.IsSameDocument(map[string]interface{}{"id": "1"}, nil))
+}
+
+func TestCouchbasePersistenceInsertAmbiguousTimeout(t *testing.T) {
+	documents := map[string][]byte{}
+	written := true
+	operations := &stubBucketOperations{
+		// Insert times out whether the document was written or not
+		insert: func(key string, value interface{}) (gocb.Cas, error) {
+			if written {
+				documents[key], _ = json.Marshal(value)
+			}
+			return 0, gocb.ErrTimeout
+		},
+		get: func(key string, valuePtr interface{}) (gocb.Cas, error) {
+			data, ok := documents[key]
+			if !ok {
+				return 0, gocb.ErrKeyNotFound
+			}
+			return 5, json.Unmarshal(data, valuePtr)
+		},
+	}
+	persistence := openStubPersistence(t, operations)
+
+	// The written document is reported as created
+	dummy, err := persistence.Create("", cbfixture.Dummy{Id: "1", Key: "Key 1", Content: "Content 1"})
+	assert.Nil(t, err)
+	assert.Equal(t, "Key 1", dummy.(cbfixture.Dummy).Key)
+
+	cas, err := persistence.InsertDocument("", "dummies:2", map[string]interface{}{"id": "2", "key": "Key 2"}, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, gocb.Cas(5), cas)
+
+	// The timeout is returned when the document was not written
+	written = false
+	_, err = persistence.Create("", cbfixture.Dummy{Id: "3", Key: "Key 3", Content: "Content 3"})
+	assert.NotNil(t, err)
+	assert.Equal(t, "TIMEOUT", err.(*cerr.ApplicationError).Code)
+
+	// and when another document is stored with the same key
+	documents["dummies:4"], _ = json.Marshal(map[string]interface{}{"id": "4", "key": "Other Key", "_c": "dummies"})
+	_, err = persistence.Create("", cbfixture.Dummy{Id: "4", Key: "Key 4", Content: "Content 4"})
+	assert.NotNil(t, err)
+	assert.Equal(t, "TIMEOUT", err.(*cerr.ApplicationError).Code)
+}
@@ -0,0 +1,71 @@
+package test_persistence
+
+import (
+	"testing"
+
+	persist "github.com/pip-services3-go/pip-services3-couchbase-go/persistence"
+	assert "github.com/stretchr/testify/assert"
+)
+
+type compositeDummy struct {
+	TenantId string `json:"tenant_id"`
+	UserId   string `json:"user_id"`
+	Content  string `json:"content"`
+}
+
+func newCompositeCouchbasePersistence() *persist.GenericCouchbasePersistence[compositeDummy, string] {
+	persistence := persist.NewGenericCouchbasePersistence[compositeDummy, string]("test", "composite_dummies")
+	persistence.IdComposer = func(item interface{}) interface{} {
+		dummy := item.(compositeDummy)
+		return dummy.TenantId + ":" + dummy.UserId
+	}
+	return persistence
+}
+
+func TestCouchbasePersistenceCompositeId(t *testing.T) {
+	persistence := newCompositeCouchbasePersistence()
+
+	dummy := compositeDummy{TenantId: "t1", UserId: "u1"}
+	assert.Equal(t, "t1:u1", persistence.ComposeId(dummy))
+	assert.Equal(t, "composite_dummies:t1:u1", persistence.GenerateBucketId(dummy))
+	assert.Equal(t, "composite_dummies:t1:u1", persistence.GenerateBucketId("t1:u1"))
+}
+
+func TestCompositeKeyCouchbasePersistence(t *testing.T) {
+	persistence := newCompositeCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	dummy, err := persistence.Create("", compositeDummy{TenantId: "t1", UserId: "u1", Content: "Content 1"})
+	assert.Nil(t, err)
+	_, err = persistence.Create("", compositeDummy{TenantId: "t2", UserId: "u1", Content: "Content 2"})
+	assert.Nil(t, err)
+
+	result, err := persistence.GetOneById("", "t1:u1")
+	assert.Nil(t, err)
+	assert.Equal(t, dummy, result)
+
+	dummy.Content = "Updated Content 1"
+	_, err = persistence.Update("", dummy)
+	assert.Nil(t, err)
+
+	dummy.Content = "Set Content 1"
+	_, err = persistence.Set("", dummy)
+	assert.Nil(t, err)
+
+	result, err = persistence.GetOneById("", "t1:u1")
+	assert.Nil(t, err)
+	assert.Equal(t, "Set Content 1", result.Content)
+
+	result, err = persistence.GetOneById("", "t2:u1")
+	assert.Nil(t, err)
+	assert.Equal(t, "Content 2", result.Content)
+
+	_, err = persistence.DeleteById("", "t1:u1")
+	assert.Nil(t, err)
+
+	result, err = persistence.GetOneById("", "t1:u1")
+	assert.Nil(t, err)
+	assert.Equal(t, compositeDummy{}, result)
+}
@@ -0,0 +1,498 @@
+package test_persistence
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	cconf "github.com/pip-services3-go/pip-services3-commons-go/config"
+	cdata "github.com/pip-services3-go/pip-services3-commons-go/data"
+	cerr "github.com/pip-services3-go/pip-services3-commons-go/errors"
+	cref "github.com/pip-services3-go/pip-services3-commons-go/refer"
+	connect "github.com/pip-services3-go/pip-services3-couchbase-go/connect"
+	persist "github.com/pip-services3-go/pip-services3-couchbase-go/persistence"
+	cbfixture "github.com/pip-services3-go/pip-services3-couchbase-go/test/fixture"
+	assert "github.com/stretchr/testify/assert"
+	gocb "gopkg.in/couchbase/gocb.v1"
+)
+
+func TestCouchbasePersistenceCollectionField(t *testing.T) {
+	persistence := NewDummyMapCouchbasePersistence()
+	persistence.Configure(cconf.NewConfigParamsFromTuples(
+		"options.collection_field", "_collection",
+	))
+	assert.Equal(t, "_collection", persistence.CollectionField)
+
+	item := map[string]interface{}{"id": "1", "_c": "own value"}
+	persistence.ConvertFromPublic(item)
+	assert.Equal(t, "dummies", item["_collection"])
+	assert.Equal(t, "own value", item["_c"])
+
+	persistence.ConvertToPublic(item)
+	_, ok := item["_collection"]
+	assert.False(t, ok)
+	assert.Equal(t, "own value", item["_c"])
+}
+
+func TestCouchbasePersistenceKeySeparator(t *testing.T) {
+	persistence := persist.NewGenericCouchbasePersistence[cbfixture.Dummy, string]("test", "dummies")
+	otherPersistence := persist.NewGenericCouchbasePersistence[cbfixture.Dummy, string]("test", "dummi")
+	assert.Equal(t, "dummies:1", persistence.GenerateBucketId("1"))
+	assert.Equal(t, "dummi:es1", otherPersistence.GenerateBucketId("es1"))
+	assert.NotEqual(t, persistence.GenerateBucketId("1"), otherPersistence.GenerateBucketId("es1"))
+
+	persistence.Configure(cconf.NewConfigParamsFromTuples(
+		"options.key_separator", "::",
+	))
+	assert.Equal(t, "dummies::1", persistence.GenerateBucketId("1"))
+
+	// Empty separator keeps legacy keys
+	persistence.Configure(cconf.NewConfigParamsFromTuples(
+		"options.key_separator", "",
+	))
+	assert.Equal(t, "dummies1", persistence.GenerateBucketId("1"))
+}
+
+type emailKeyGenerator struct{}
+
+func (c *emailKeyGenerator) GenerateBucketId(collection string, value interface{}) string {
+	return "user::" + strings.ToLower(value.(string))
+}
+
+func TestCouchbasePersistenceKeyGenerator(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	persistence.SetKeyGenerator(&emailKeyGenerator{})
+	assert.Equal(t, "user::john@example.com", persistence.GenerateBucketId("John@Example.com"))
+	assert.Equal(t, []string{"user::a@b.c"}, persistence.GenerateBucketIds([]interface{}{"A@b.c"}))
+
+	// Default generator is restored
+	persistence.SetKeyGenerator(nil)
+	assert.Equal(t, "dummies:1", persistence.GenerateBucketId("1"))
+
+	generator := persist.NewDefaultKeyGenerator("/")
+	assert.Equal(t, "dummies/1", generator.GenerateBucketId("dummies", 1))
+}
+
+func TestCouchbasePersistenceBucketName(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	persistence.Configure(cconf.NewConfigParamsFromTuples(
+		"connection.database", "other",
+	))
+	assert.Equal(t, "other", persistence.BucketName)
+
+	persistence = NewDummyCouchbasePersistence()
+	persistence.Configure(cconf.NewConfigParamsFromTuples(
+		"bucket", "main",
+		"connection.database", "other",
+	))
+	assert.Equal(t, "main", persistence.BucketName)
+}
+
+func TestCouchbasePersistenceStatus(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	persistence.Configure(cconf.NewEmptyConfigParams())
+
+	status := persistence.GetStatus("")
+	assert.False(t, status.Open)
+	assert.Equal(t, "test", status.Bucket)
+}
+
+func TestCouchbasePersistenceIndexNotReadyError(t *testing.T) {
+	assert.False(t, persist.IsIndexNotReadyError(nil))
+	assert.False(t, persist.IsIndexNotReadyError(errors.New("[3000] syntax error - at WHERE")))
+	assert.True(t, persist.IsIndexNotReadyError(errors.New("[4000] No index available on keyspace test that matches your query.")))
+	assert.True(t, persist.IsIndexNotReadyError(errors.New("[12008] Index not ready for serving queries")))
+}
+
+func TestCouchbasePersistenceIndexWait(t *testing.T) {
+	indexErr := errors.New("[4000] No index available on keyspace test that matches your query.")
+	failures := 1
+	operations := &stubBucketOperations{
+		query: func(statement string) (gocb.QueryResults, error) {
+			if failures > 0 {
+				failures--
+				return nil, indexErr
+			}
+			return &stubQueryResults{rows: []interface{}{map[string]interface{}{"count": 3}}}, nil
+		},
+	}
+
+	// The query is retried until the index becomes ready
+	persistence := openStubPersistence(t, operations, "options.index_wait", 5000)
+	count, err := persistence.GetCountByFilter("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), count)
+	assert.Len(t, operations.Queries(), 2)
+
+	// Without index_wait the query is not retried
+	operations.queries = nil
+	failures = 1
+	persistence = openStubPersistence(t, operations)
+	_, err = persistence.GetCountByFilter("", "")
+	assert.Equal(t, indexErr, err)
+	assert.Len(t, operations.Queries(), 1)
+
+	// The query gives up when the index is not ready within index_wait
+	operations.queries = nil
+	failures = 1000
+	persistence = openStubPersistence(t, operations, "options.index_wait", 150)
+	start := time.Now()
+	_, err = persistence.GetCountByFilter("", "")
+	assert.Equal(t, indexErr, err)
+	assert.True(t, time.Since(start) < 2*time.Second)
+	assert.True(t, len(operations.Queries()) > 1)
+	assert.True(t, len(operations.Queries()) <= 4)
+}
+
+func TestCouchbasePersistenceItemType(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	persistence.Configure(cconf.NewEmptyConfigParams())
+
+	assert.Nil(t, persistence.CheckItemType("", cbfixture.Dummy{}))
+	assert.Nil(t, persistence.CheckItemType("", &cbfixture.Dummy{}))
+
+	wrongItems := []interface{}{
+		map[string]interface{}{"key": "Key 1"},
+		struct{ Key string }{Key: "Key 1"},
+	}
+	for _, item := range wrongItems {
+		_, err := persistence.IdentifiableCouchbasePersistence.Create("", item)
+		assert.NotNil(t, err)
+		assert.Equal(t, "TYPE_MISMATCH", err.(*cerr.ApplicationError).Code)
+
+		_, err = persistence.IdentifiableCouchbasePersistence.Set("", item)
+		assert.NotNil(t, err)
+		assert.Equal(t, "TYPE_MISMATCH", err.(*cerr.ApplicationError).Code)
+
+		_, err = persistence.IdentifiableCouchbasePersistence.Update("", item)
+		assert.NotNil(t, err)
+		assert.Equal(t, "TYPE_MISMATCH", err.(*cerr.ApplicationError).Code)
+	}
+
+	mapPersistence := NewDummyMapCouchbasePersistence()
+	assert.Nil(t, mapPersistence.CheckItemType("", map[string]interface{}{"key": "Key 1"}))
+	assert.NotNil(t, mapPersistence.CheckItemType("", cbfixture.Dummy{}))
+}
+
+func TestCouchbasePersistenceQueryOptions(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	persistence.Configure(cconf.NewEmptyConfigParams())
+
+	options := persistence.ComposeQueryOptions(gocb.RequestPlus)
+	assert.Equal(t, gocb.RequestPlus, options.Consistency)
+	assert.Equal(t, time.Duration(0), options.Timeout)
+
+	persistence = NewDummyCouchbasePersistence()
+	persistence.Configure(cconf.NewConfigParamsFromTuples(
+		"options.consistency", "not_bounded",
+		"options.query_timeout", 1500,
+	))
+
+	options = persistence.ComposeQueryOptions(gocb.RequestPlus)
+	assert.Equal(t, gocb.NotBounded, options.Consistency)
+	assert.Equal(t, 1500*time.Millisecond, options.Timeout)
+
+	// Options are applied to counting and DML statements
+	operations := &stubBucketOperations{
+		query: func(statement string) (gocb.QueryResults, error) {
+			return &stubQueryResults{
+				rows:    []interface{}{map[string]interface{}{"count": 2}},
+				metrics: gocb.QueryResultMetrics{MutationCount: 2},
+			}, nil
+		},
+	}
+	stubPersistence := openStubPersistence(t, operations,
+		"options.consistency", "statement_plus",
+		"options.query_timeout", 2500,
+	)
+	data := cdata.NewAnyValueMapFromTuples("content", "New Content")
+
+	_, err := stubPersistence.GetCountByFilter("", "")
+	assert.Nil(t, err)
+	count, err := stubPersistence.DeleteByFilter("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), count)
+	count, err = stubPersistence.UpdateManyByFilter("", "", data)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), count)
+	_, err = stubPersistence.UpdateManyByFilterReturning("", "", data)
+	assert.Nil(t, err)
+
+	queries := operations.Queries()
+	assert.Len(t, queries, 4)
+	for i, query := range queries {
+		assert.Equal(t, gocb.StatementPlus, query.Consistency, operations.statements[i])
+		assert.Equal(t, 2500*time.Millisecond, query.Timeout, operations.statements[i])
+	}
+	// Mutation counts are taken from query metrics
+	for _, query := range queries[1:3] {
+		if assert.NotNil(t, query.Metrics) {
+			assert.True(t, *query.Metrics)
+		}
+	}
+
+	// DML statements wait for prior mutations by default
+	operations.queries = nil
+	stubPersistence = openStubPersistence(t, operations)
+	_, err = stubPersistence.DeleteByFilter("", "")
+	assert.Nil(t, err)
+	_, err = stubPersistence.UpdateManyByFilter("", "", data)
+	assert.Nil(t, err)
+	_, err = stubPersistence.UpdateManyByFilterReturning("", "", data)
+	assert.Nil(t, err)
+	for _, query := range operations.Queries() {
+		assert.Equal(t, gocb.RequestPlus, query.Consistency)
+	}
+}
+
+func TestCouchbasePersistenceQueryFlags(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	persistence.Configure(cconf.NewEmptyConfigParams())
+
+	options := persistence.ComposeQueryOptions(gocb.RequestPlus)
+	assert.Nil(t, options.Pretty)
+	assert.Nil(t, options.Metrics)
+
+	persistence = NewDummyCouchbasePersistence()
+	persistence.Configure(cconf.NewConfigParamsFromTuples(
+		"options.query_pretty", false,
+		"options.query_metrics", false,
+	))
+
+	options = persistence.ComposeQueryOptions(gocb.RequestPlus)
+	if assert.NotNil(t, options.Pretty) {
+		assert.False(t, *options.Pretty)
+	}
+	if assert.NotNil(t, options.Metrics) {
+		assert.False(t, *options.Metrics)
+	}
+}
+
+func TestCouchbasePersistenceResolveCorrelationId(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	persistence.Configure(cconf.NewEmptyConfigParams())
+	assert.Equal(t, "", persistence.ResolveCorrelationId(""))
+	assert.Equal(t, "123", persistence.ResolveCorrelationId("123"))
+
+	persistence = NewDummyCouchbasePersistence()
+	persistence.Configure(cconf.NewConfigParamsFromTuples(
+		"options.generate_correlation_id", true,
+	))
+	assert.Equal(t, "123", persistence.ResolveCorrelationId("123"))
+	correlationId := persistence.ResolveCorrelationId("")
+	assert.NotEqual(t, "", correlationId)
+	assert.NotEqual(t, correlationId, persistence.ResolveCorrelationId(""))
+}
+
+func TestCouchbasePersistenceReadOnly(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	persistence.Configure(cconf.NewConfigParamsFromTuples(
+		"options.read_only", true,
+	))
+	dummy := cbfixture.Dummy{Id: "1", Key: "Key 1", Content: "Content 1"}
+
+	// The bucket is not opened, so mutations must be rejected before touching it
+	errs := make([]error, 0)
+	_, err := persistence.Create("", dummy)
+	errs = append(errs, err)
+	_, err = persistence.IdentifiableCouchbasePersistence.Set("", dummy)
+	errs = append(errs, err)
+	_, err = persistence.Update("", dummy)
+	errs = append(errs, err)
+	_, err = persistence.UpdatePartially("", "1", cdata.NewAnyValueMapFromTuples("content", "New Content"))
+	errs = append(errs, err)
+	_, err = persistence.CompareAndSet("", "1", "content", "Content 1", "New Content")
+	errs = append(errs, err)
+	_, _, err = persistence.CreateMissing("", []interface{}{dummy})
+	errs = append(errs, err)
+	_, err = persistence.DeleteById("", "1")
+	errs = append(errs, err)
+	errs = append(errs, persistence.DeleteByIds("", []string{"1"}))
+	_, err = persistence.DeleteByFilter("", "key='Key 1'")
+	errs = append(errs, err)
+	errs = append(errs, persistence.DeleteAll(""))
+	_, err = persistence.UpdateManyByFilter("", "", cdata.NewAnyValueMapFromTuples("content", "New Content"))
+	errs = append(errs, err)
+	errs = append(errs, persistence.Clear(""))
+
+	for _, err := range errs {
+		assert.NotNil(t, err)
+		assert.Equal(t, "READ_ONLY", err.(*cerr.ApplicationError).Code)
+	}
+}
+
+func TestCouchbasePersistenceUnsetReferences(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	persistence.Configure(cconf.NewEmptyConfigParams())
+
+	// Setting references again without a shared connection keeps the owned local one
+	persistence.SetReferences(cref.NewEmptyReferences())
+	connection := persistence.Connection
+	assert.NotNil(t, connection)
+	persistence.SetReferences(cref.NewEmptyReferences())
+	assert.Same(t, connection, persistence.Connection)
+
+	shared := connect.NewCouchbaseConnection("test")
+	persistence.SetReferences(cref.NewReferencesFromTuples(
+		cref.NewDescriptor("pip-services", "connection", "couchbase", "default", "1.0"), shared,
+	))
+	assert.Same(t, shared, persistence.Connection)
+
+	persistence.UnsetReferences()
+	assert.Nil(t, persistence.Connection)
+	assert.False(t, persistence.IsOpen())
+
+	_, err := persistence.GetOneById("", "1")
+	assert.NotNil(t, err)
+	assert.Equal(t, "NOT_OPENED", err.(*cerr.ApplicationError).Code)
+
+	_, err = persistence.Create("", cbfixture.Dummy{Id: "1", Key: "Key 1"})
+	assert.NotNil(t, err)
+	assert.Equal(t, "NOT_OPENED", err.(*cerr.ApplicationError).Code)
+}
+
+func TestCouchbasePersistenceQueryStats(t *testing.T) {
+	stats := persist.NewQueryStats(gocb.QueryResultMetrics{
+		ExecutionTime: 5 * time.Millisecond,
+		ResultCount:   10,
+		SortCount:     10,
+		MutationCount: 2,
+	})
+	assert.Equal(t, 5*time.Millisecond, stats.ExecutionTime)
+	assert.Equal(t, int64(10), stats.ResultCount)
+	assert.Equal(t, int64(10), stats.SortCount)
+	assert.Equal(t, int64(2), stats.MutationCount)
+}
+
+func TestCouchbasePersistenceConvertFromMapErrors(t *testing.T) {
+	logger := newCaptureLogger()
+	persistence := NewDummyCouchbasePersistence()
+	persistence.Configure(cconf.NewEmptyConfigParams())
+	persistence.SetReferences(cref.NewReferencesFromTuples(
+		cref.NewDescriptor("pip-services", "logger", "capture", "default", "1.0"), logger,
+	))
+
+	// A document left with an old shape after schema changes
+	doc := map[string]interface{}{"id": "1", "key": "Key 1", "content": 123}
+	item, err := persistence.ConvertFromMapWithError(doc)
+	assert.NotNil(t, err)
+	assert.Equal(t, "Key 1", item.(cbfixture.Dummy).Key)
+
+	item = persistence.ConvertFromMap(doc)
+	assert.Equal(t, "Key 1", item.(cbfixture.Dummy).Key)
+	found := false
+	for _, message := range logger.Messages() {
+		if strings.Contains(message, "doesn't match the prototype") {
+			found = true
+		}
+	}
+	assert.True(t, found)
+
+	item, err = persistence.ConvertFromMapWithError(map[string]interface{}{"id": "1", "key": "Key 1"})
+	assert.Nil(t, err)
+	assert.Equal(t, "Key 1", item.(cbfixture.Dummy).Key)
+}
+
+func TestCouchbasePersistenceDefaultTtl(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	persistence.Configure(cconf.NewEmptyConfigParams())
+	assert.Equal(t, uint32(0), persistence.DefaultTtl())
+
+	persistence.Configure(cconf.NewConfigParamsFromTuples(
+		"options.default_ttl", 3600,
+	))
+	assert.Equal(t, uint32(3600), persistence.DefaultTtl())
+}
+
+func TestCouchbasePersistenceConvertPublicErrors(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	persistence.Configure(cconf.NewEmptyConfigParams())
+
+	for _, item := range []interface{}{nil, 123, "abc", []string{"a"}} {
+		_, err := persistence.ConvertFromPublicWithError(item)
+		assert.NotNil(t, err)
+		assert.Equal(t, "INVALID_ITEM", err.(*cerr.ApplicationError).Code)
+
+		_, err = persistence.ConvertToPublicWithError(item)
+		assert.NotNil(t, err)
+	}
+
+	// Pointers to structs are dereferenced instead of failing
+	dummy := cbfixture.Dummy{Id: "1", Key: "Key 1", Content: "Content 1"}
+	value, err := persistence.ConvertFromPublicWithError(&dummy)
+	assert.Nil(t, err)
+	doc := (*value.(*interface{})).(map[string]interface{})
+	assert.Equal(t, "Key 1", doc["key"])
+	assert.Equal(t, "dummies", doc["_c"])
+
+	_, err = persistence.ConvertToPublicWithError(&dummy)
+	assert.Nil(t, err)
+
+	assert.Panics(t, func() { persistence.ConvertFromPublic(123) })
+}
+
+func TestCouchbasePersistenceComposeSort(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	persistence.Configure(cconf.NewEmptyConfigParams())
+
+	assert.Equal(t, "", persistence.ComposeSort(nil))
+	assert.Equal(t, "", persistence.ComposeSort(cdata.NewEmptySortParams()))
+
+	sort := cdata.NewSortParams([]cdata.SortField{
+		cdata.NewSortField("key", false),
+		cdata.NewSortField("", true),
+		cdata.NewSortField("address.city", true),
+		cdata.NewSortField("na`me", true),
+	})
+	assert.Equal(t, "`key` DESC, `address`.`city` ASC, `na``me` ASC", persistence.ComposeSort(sort))
+
+	persistence.Configure(cconf.NewConfigParamsFromTuples("options.flatten_fields", true))
+	assert.Equal(t, "`address.city` ASC", persistence.ComposeSort(
+		cdata.NewSortParams([]cdata.SortField{cdata.NewSortField("address.city", true)})))
+}
+
+func TestCouchbasePersistenceQuoteIdentifier(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+
+	assert.Equal(t, "", persistence.QuoteIdentifier(""))
+	assert.Equal(t, "`type`", persistence.QuoteIdentifier("type"))
+	assert.Equal(t, "`order`", persistence.QuoteIdentifier("order"))
+	assert.Equal(t, "`my-bucket`", persistence.QuoteIdentifier("my-bucket"))
+	assert.Equal(t, "`na``me`", persistence.QuoteIdentifier("na`me"))
+	// Already quoted names are kept
+	assert.Equal(t, "`my-bucket`", persistence.QuoteIdentifier("`my-bucket`"))
+
+	sort := cdata.NewSortParams([]cdata.SortField{
+		cdata.NewSortField("order", true),
+		cdata.NewSortField("my-field.type", false),
+	})
+	assert.Equal(t, "`order` ASC, `my-field`.`type` DESC", persistence.ComposeSort(sort))
+}
+
+func TestCouchbasePersistenceComposeTake(t *testing.T) {
+	logger := newCaptureLogger()
+	persistence := NewDummyCouchbasePersistence()
+	persistence.Configure(cconf.NewConfigParamsFromTuples("options.max_page_size", 50))
+	persistence.SetReferences(cref.NewReferencesFromTuples(
+		cref.NewDescriptor("pip-services", "logger", "capture", "default", "1.0"), logger,
+	))
+
+	assert.Equal(t, int64(50), persistence.ComposeTake("", nil))
+	assert.Equal(t, int64(50), persistence.ComposeTake("", cdata.NewEmptyPagingParams()))
+	assert.Equal(t, int64(10), persistence.ComposeTake("", cdata.NewPagingParams(0, 10, false)))
+	assert.Equal(t, int64(50), persistence.ComposeTake("", cdata.NewPagingParams(0, 50, false)))
+	assert.Len(t, logger.Messages(), 0)
+
+	// Requested take larger than max page size is clamped
+	assert.Equal(t, int64(50), persistence.ComposeTake("123", cdata.NewPagingParams(0, 1000000, false)))
+	messages := logger.Messages()
+	assert.Len(t, messages, 1)
+	assert.True(t, strings.Contains(messages[0], "clamped to 50"))
+
+	// Default page size is used when max page size is not set
+	persistence.MaxPageSize = 0
+	assert.Equal(t, int64(100), persistence.ComposeTake("", nil))
+	assert.Equal(t, int64(10), persistence.ComposeTake("", cdata.NewPagingParams(0, 10, false)))
+	assert.Equal(t, int64(100), persistence.ComposeTake("", cdata.NewPagingParams(0, 500, false)))
+}
@@ -0,0 +1,74 @@
+package test_persistence
+
+import (
+	"os"
+	"testing"
+
+	cconf "github.com/pip-services3-go/pip-services3-commons-go/config"
+	assert "github.com/stretchr/testify/assert"
+)
+
+// testPersistence is the lifecycle shared by the persistences under test
+type testPersistence interface {
+	Configure(config *cconf.ConfigParams)
+	Open(correlationId string) error
+	Close(correlationId string) error
+	Clear(correlationId string) error
+}
+
+// getCouchbaseTestConfig returns connection config for tests built from environment variables
+func getCouchbaseTestConfig() *cconf.ConfigParams {
+	couchbaseUri := os.Getenv("COUCHBASE_URI")
+	couchbaseHost := os.Getenv("COUCHBASE_HOST")
+	if couchbaseHost == "" {
+		couchbaseHost = "localhost"
+	}
+	couchbasePort := os.Getenv("COUCHBASE_PORT")
+	if couchbasePort == "" {
+		couchbasePort = "8091"
+	}
+	couchbaseUser := os.Getenv("COUCHBASE_USER")
+	if couchbaseUser == "" {
+		couchbaseUser = "Administrator"
+	}
+	couchbasePass := os.Getenv("COUCHBASE_PASS")
+	if couchbasePass == "" {
+		couchbasePass = "password"
+	}
+
+	if couchbaseUri == "" && couchbaseHost == "" {
+		return nil
+	}
+
+	return cconf.NewConfigParamsFromTuples(
+		"options.auto_create", false,
+		"options.auto_index", true,
+		"connection.uri", couchbaseUri,
+		"connection.host", couchbaseHost,
+		"connection.port", couchbasePort,
+		"connection.operation_timeout", 2,
+		"connection.detailed_errcodes", 1,
+		"credential.username", couchbaseUser,
+		"credential.password", couchbasePass,
+	)
+}
+
+// openTestPersistence configures the persistence with the test config overridden by
+// the given tuples, opens and clears it. The persistence is closed when the test ends.
+// Returns false when couchbase is not configured or the persistence can't be opened.
+func openTestPersistence(t *testing.T, persistence testPersistence, tuples ...interface{}) bool {
+	dbConfig := getCouchbaseTestConfig()
+	if dbConfig == nil {
+		return false
+	}
+	persistence.Configure(dbConfig.Override(cconf.NewConfigParamsFromTuples(tuples...)))
+
+	opnErr := persistence.Open("")
+	if opnErr != nil {
+		assert.Nil(t, opnErr)
+		return false
+	}
+	t.Cleanup(func() { persistence.Close("") })
+	persistence.Clear("")
+	return true
+}
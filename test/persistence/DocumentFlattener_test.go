@@ -0,0 +1,64 @@
+package test_persistence
+
+import (
+	"encoding/json"
+	"testing"
+
+	cconf "github.com/pip-services3-go/pip-services3-commons-go/config"
+	persist "github.com/pip-services3-go/pip-services3-couchbase-go/persistence"
+	assert "github.com/stretchr/testify/assert"
+)
+
+type nestedAddress struct {
+	City   string   `json:"city"`
+	Street string   `json:"street"`
+	Lines  []string `json:"lines"`
+}
+
+type nestedDummy struct {
+	Id      string `json:"id"`
+	Name    string `json:"name"`
+	Address struct {
+		Home nestedAddress `json:"home"`
+		Work nestedAddress `json:"work"`
+	} `json:"address"`
+}
+
+func TestDocumentFlattener(t *testing.T) {
+	dummy := nestedDummy{Id: "1", Name: "Name 1"}
+	dummy.Address.Home = nestedAddress{City: "City 1", Street: "Street 1", Lines: []string{"Line 1"}}
+	dummy.Address.Work = nestedAddress{City: "City 2"}
+
+	jsonBuf, _ := json.Marshal(dummy)
+	doc := make(map[string]interface{})
+	json.Unmarshal(jsonBuf, &doc)
+
+	flat := persist.FlattenDocument(doc)
+	assert.Equal(t, "City 1", flat["address.home.city"])
+	assert.Equal(t, "City 2", flat["address.work.city"])
+	assert.Equal(t, []interface{}{"Line 1"}, flat["address.home.lines"])
+	_, ok := flat["address"]
+	assert.False(t, ok)
+
+	jsonBuf, _ = json.Marshal(persist.UnflattenDocument(flat))
+	var result nestedDummy
+	json.Unmarshal(jsonBuf, &result)
+	assert.Equal(t, dummy, result)
+}
+
+func TestCouchbasePersistenceFlattenFields(t *testing.T) {
+	persistence := persist.NewGenericCouchbasePersistence[nestedDummy, string]("test", "nested_dummies")
+	persistence.Configure(cconf.NewConfigParamsFromTuples(
+		"options.flatten_fields", true,
+	))
+
+	dummy := nestedDummy{Id: "1", Name: "Name 1"}
+	dummy.Address.Home.City = "City 1"
+
+	doc := (*persistence.ConvertFromPublic(dummy).(*interface{})).(map[string]interface{})
+	assert.Equal(t, "City 1", doc["address.home.city"])
+	assert.Equal(t, "nested_dummies", doc["_c"])
+
+	result := persistence.ConvertFromMap(doc)
+	assert.Equal(t, dummy, result)
+}
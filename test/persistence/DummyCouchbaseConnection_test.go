@@ -87,3 +87,95 @@ func TestDummyCouchbaseConnection(t *testing.T) {
 	persistence.Clear("")
 	t.Run("Paging", fixture.TestPaging)
 }
+
+func TestDummyCouchbaseConnectionWarmUp(t *testing.T) {
+	dbConfig := getCouchbaseTestConfig()
+	if dbConfig == nil {
+		return
+	}
+	dbConfig.SetAsObject("options.warm_up", true)
+	dbConfig.SetAsObject("options.warm_up_reads", 2)
+
+	connection := connect.NewCouchbaseConnection("test")
+	connection.Configure(dbConfig)
+
+	// Warm-up reads of a missing document fail, but opening must succeed
+	err := connection.Open("")
+	assert.Nil(t, err)
+	defer connection.Close("")
+	assert.True(t, connection.IsOpen())
+}
+
+func TestDummyCouchbaseConnectionManagement(t *testing.T) {
+	dbConfig := getCouchbaseTestConfig()
+	if dbConfig == nil {
+		return
+	}
+
+	connection := connect.NewCouchbaseConnection("test")
+	connection.Configure(dbConfig)
+
+	err := connection.Open("")
+	if err != nil {
+		assert.Nil(t, err)
+		return
+	}
+	defer connection.Close("")
+
+	buckets, err := connection.ListBuckets("")
+	assert.Nil(t, err)
+	found := false
+	for _, bucket := range buckets {
+		if bucket.Name == connection.GetBucketName() {
+			found = true
+		}
+	}
+	assert.True(t, found)
+
+	stats, err := connection.GetBucketStats("", "")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, stats)
+
+	indexes, err := connection.GetIndexes("")
+	assert.Nil(t, err)
+	assert.NotNil(t, indexes)
+}
+
+func TestDummyCouchbaseConnectionSharedNotReconnected(t *testing.T) {
+	dbConfig := getCouchbaseTestConfig()
+	if dbConfig == nil {
+		return
+	}
+
+	connection := connect.NewCouchbaseConnection("test")
+	connection.Configure(dbConfig)
+	opnErr := connection.Open("")
+	if opnErr != nil {
+		assert.Nil(t, opnErr)
+		return
+	}
+	defer connection.Close("")
+
+	persistence := NewDummyCouchbasePersistence()
+	persistence.SetReferences(cref.NewReferencesFromTuples(
+		cref.NewDescriptor("pip-services", "connection", "couchbase", "default", "1.0"), connection,
+	))
+	opnErr = persistence.Open("")
+	if opnErr != nil {
+		assert.Nil(t, opnErr)
+		return
+	}
+	defer persistence.Close("")
+	persistence.Clear("")
+
+	dummy, err := persistence.Create("", cbfixture.Dummy{Key: "Key 1", Content: "Content 1"})
+	assert.Nil(t, err)
+
+	// Simulate dropped connection, the shared connection is reopened only by its owner
+	bucket := connection.GetBucket()
+	bucket.Close()
+
+	_, err = persistence.GetOneById("", dummy.Id)
+	assert.NotNil(t, err)
+	assert.Equal(t, bucket, connection.GetBucket())
+}
@@ -96,11 +96,17 @@ func (c *DummyCouchbasePersistence) GetPageByFilter(correlationId string, filter
 	}
 	key := filter.GetAsString("key")
 	filterCondition := ""
+	params := make(map[string]interface{})
 	if key != "" {
-		filterCondition += "key='" + key + "'"
+		filterCondition += "key=$key"
+		params["key"] = key
 	}
 
-	tempPage, err := c.IdentifiableCouchbasePersistence.GetPageByFilter(correlationId, filterCondition, paging, "'key' DESC", "")
+	tempPage, err := c.IdentifiableCouchbasePersistence.GetPageByFilterWithSort(correlationId, filterCondition, params, paging,
+		cdata.NewSortParams([]cdata.SortField{cdata.NewSortField("key", false)}), "")
+	if err != nil {
+		return nil, err
+	}
 
 	// Convert to DummyPage
 	dataLen := int64(len(tempPage.Data)) // For full release tempPage and delete this by GC
@@ -108,7 +114,7 @@ func (c *DummyCouchbasePersistence) GetPageByFilter(correlationId string, filter
 	for i, v := range tempPage.Data {
 		data[i] = v.(cbfixture.Dummy)
 	}
-	page = cbfixture.NewDummyPage(&dataLen, data)
+	page = cbfixture.NewDummyPage(tempPage.Total, data)
 	return page, err
 
 }
@@ -1,14 +1,52 @@
 package test_persistence
 
 import (
+	"errors"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	cconf "github.com/pip-services3-go/pip-services3-commons-go/config"
+	cdata "github.com/pip-services3-go/pip-services3-commons-go/data"
+	cerr "github.com/pip-services3-go/pip-services3-commons-go/errors"
+	cref "github.com/pip-services3-go/pip-services3-commons-go/refer"
+	ccount "github.com/pip-services3-go/pip-services3-components-go/count"
+	clog "github.com/pip-services3-go/pip-services3-components-go/log"
+	persist "github.com/pip-services3-go/pip-services3-couchbase-go/persistence"
 	cbfixture "github.com/pip-services3-go/pip-services3-couchbase-go/test/fixture"
 	assert "github.com/stretchr/testify/assert"
+	gocb "gopkg.in/couchbase/gocb.v1"
 )
 
+type captureLogger struct {
+	*clog.Logger
+	lock     sync.Mutex
+	messages []string
+}
+
+func newCaptureLogger() *captureLogger {
+	c := &captureLogger{}
+	c.Logger = clog.InheritLogger(c)
+	c.SetLevel(clog.Trace)
+	return c
+}
+
+func (c *captureLogger) Write(level int, correlationId string, err error, message string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.messages = append(c.messages, correlationId+" "+message)
+}
+
+func (c *captureLogger) Messages() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string{}, c.messages...)
+}
+
 func TestDummyCouchbasePersistence(t *testing.T) {
 	var persistence *DummyCouchbasePersistence
 	var fixture *cbfixture.DummyPersistenceFixture
@@ -71,3 +109,1578 @@ func TestDummyCouchbasePersistence(t *testing.T) {
 	t.Run("Paging", fixture.TestPaging)
 
 }
+
+func TestDummyCouchbasePersistenceClearWait(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence, "options.flush_enabled", true, "options.clear_wait_timeout", 5000) {
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := persistence.Create("", cbfixture.Dummy{Key: "Key " + strconv.Itoa(i), Content: "Content"})
+		assert.Nil(t, err)
+	}
+
+	err := persistence.Clear("")
+	assert.Nil(t, err)
+
+	count, err := persistence.GetCountByFilter("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestDummyCouchbasePersistenceGetByKeyPrefix(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	for _, id := range []string{"order_1", "order_2", "invoice_1"} {
+		_, err := persistence.Create("", cbfixture.Dummy{Id: id, Key: id, Content: "Content"})
+		assert.Nil(t, err)
+	}
+
+	items, err := persistence.GetByKeyPrefix("", "order_", 0)
+	assert.Nil(t, err)
+	assert.Len(t, items, 2)
+	for _, item := range items {
+		assert.Contains(t, item.(cbfixture.Dummy).Id, "order_")
+	}
+
+	items, err = persistence.GetByKeyPrefix("", "order_", 1)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+}
+
+func TestDummyCouchbasePersistenceBulkTimeout(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence, "options.bulk_timeout", 1500) {
+		return
+	}
+
+	assert.Equal(t, 1500*time.Millisecond, persistence.Bucket.BulkOperationTimeout())
+}
+
+func TestDummyCouchbasePersistenceBulkTimeoutSharedConnection(t *testing.T) {
+	// The shared bucket is configured by the connection owner
+	persistence := openStubPersistence(t, &stubBucketOperations{}, "options.bulk_timeout", 1500)
+	assert.Equal(t, time.Duration(0), persistence.Bucket.BulkOperationTimeout())
+}
+
+func TestDummyCouchbasePersistenceUpdateIfExists(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	result, existed, err := persistence.UpdateIfExists("", cbfixture.Dummy{Id: "missing", Key: "Key", Content: "Content"})
+	assert.Nil(t, err)
+	assert.False(t, existed)
+	assert.Nil(t, result)
+
+	dummy, err := persistence.Create("", cbfixture.Dummy{Key: "Key", Content: "Content"})
+	assert.Nil(t, err)
+	dummy.Content = "Updated Content"
+	result, existed, err = persistence.UpdateIfExists("", dummy)
+	assert.Nil(t, err)
+	assert.True(t, existed)
+	assert.Equal(t, "Updated Content", result.(cbfixture.Dummy).Content)
+}
+
+func TestDummyCouchbasePersistenceUpdateManyByFilter(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	for _, key := range []string{"pending", "pending", "done"} {
+		_, err := persistence.Create("", cbfixture.Dummy{Key: key, Content: "Content"})
+		assert.Nil(t, err)
+	}
+
+	count, err := persistence.UpdateManyByFilter("", "key='pending'",
+		cdata.NewAnyValueMapFromTuples("content", "Cancelled"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), count)
+
+	count, err = persistence.GetCountByFilter("", "content='Cancelled'")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), count)
+}
+
+func TestDummyCouchbasePersistenceUpdateManyByFilterReturning(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	for _, key := range []string{"pending", "pending", "done"} {
+		_, err := persistence.Create("", cbfixture.Dummy{Key: key, Content: "Content"})
+		assert.Nil(t, err)
+	}
+
+	items, err := persistence.UpdateManyByFilterReturning("", "key='pending'",
+		cdata.NewAnyValueMapFromTuples("content", "Cancelled"))
+	assert.Nil(t, err)
+	assert.Len(t, items, 2)
+	for _, item := range items {
+		dummy := item.(cbfixture.Dummy)
+		assert.Equal(t, "pending", dummy.Key)
+		assert.Equal(t, "Cancelled", dummy.Content)
+		assert.NotEqual(t, "", dummy.Id)
+	}
+}
+
+func TestDummyCouchbasePersistenceMaxScan(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence, "options.max_scan", 2) {
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := persistence.Create("", cbfixture.Dummy{Key: "Key " + strconv.Itoa(i), Content: "Content"})
+		assert.Nil(t, err)
+	}
+
+	_, err := persistence.GetPageByFilter("", cdata.NewEmptyFilterParams(), nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, "SCAN_LIMIT_EXCEEDED", err.(*cerr.ApplicationError).Code)
+
+	page, err := persistence.GetPageByFilter("", cdata.NewFilterParamsFromTuples("key", "Key 1"), nil)
+	assert.Nil(t, err)
+	assert.Len(t, page.Data, 1)
+}
+
+func TestDummyCouchbasePersistenceGetPageWithCas(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := persistence.Create("", cbfixture.Dummy{Key: "Key " + strconv.Itoa(i), Content: "Content"})
+		assert.Nil(t, err)
+	}
+
+	page, err := persistence.GetPageWithCasByFilter("", "", cdata.NewPagingParams(0, 10, false), "")
+	assert.Nil(t, err)
+	assert.Len(t, page.Data, 3)
+	for _, v := range page.Data {
+		item := v.(*persist.ItemWithCas)
+		assert.NotEqual(t, gocb.Cas(0), item.Cas)
+		assert.NotEqual(t, "", item.Item.(cbfixture.Dummy).Id)
+	}
+}
+
+func TestDummyCouchbasePersistenceCollectionMismatch(t *testing.T) {
+	// Legacy keys without separator: "dummies" + "1abc" collides with "dummies1" + "abc"
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence, "options.key_separator", "") {
+		return
+	}
+	otherPersistence := persist.NewGenericCouchbasePersistence[cbfixture.Dummy, string]("test", "dummies1")
+	if !openTestPersistence(t, otherPersistence, "options.key_separator", "") {
+		return
+	}
+
+	_, err := persistence.Create("", cbfixture.Dummy{Id: "1abc", Key: "Key 1", Content: "Content 1"})
+	assert.Nil(t, err)
+
+	_, err = otherPersistence.Update("", cbfixture.Dummy{Id: "abc", Key: "Key 2", Content: "Content 2"})
+	assert.NotNil(t, err)
+	assert.Equal(t, "COLLECTION_MISMATCH", err.(*cerr.ApplicationError).Code)
+
+	_, err = otherPersistence.UpdatePartially("", "abc", cdata.NewAnyValueMapFromTuples("content", "Content 2"))
+	assert.NotNil(t, err)
+	assert.Equal(t, "COLLECTION_MISMATCH", err.(*cerr.ApplicationError).Code)
+
+	_, err = otherPersistence.Create("", cbfixture.Dummy{Id: "abc", Key: "Key 2", Content: "Content 2"})
+	assert.NotNil(t, err)
+	assert.Equal(t, "COLLECTION_MISMATCH", err.(*cerr.ApplicationError).Code)
+
+	dummy, err := persistence.GetOneById("", "1abc")
+	assert.Nil(t, err)
+	assert.Equal(t, "Content 1", dummy.Content)
+}
+
+func TestDummyCouchbasePersistenceViewQuery(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	ddoc := &gocb.DesignDocument{
+		Name: "dummies",
+		Views: map[string]gocb.View{
+			"by_key": {
+				Map:    "function (doc, meta) { if (doc._c == 'dummies') { emit(doc.key, null); } }",
+				Reduce: "_count",
+			},
+		},
+	}
+	dbConfig := getCouchbaseTestConfig()
+	manager := persistence.Bucket.Manager(dbConfig.GetAsString("credential.username"), dbConfig.GetAsString("credential.password"))
+	if err := manager.UpsertDesignDocument(ddoc); err != nil {
+		t.Skip("Design document views are not available: " + err.Error())
+	}
+	defer manager.RemoveDesignDocument(ddoc.Name)
+
+	for i := 0; i < 3; i++ {
+		_, err := persistence.Create("", cbfixture.Dummy{Key: "Key " + strconv.Itoa(i), Content: "Content"})
+		assert.Nil(t, err)
+	}
+
+	items, err := persistence.ExecuteViewQuery("", "dummies", "by_key", persist.ViewOptions{Reduce: true, Stale: gocb.Before})
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, float64(3), items[0])
+
+	items, err = persistence.ExecuteViewQuery("", "dummies", "by_key",
+		persist.ViewOptions{Key: "Key 1", IncludeDocs: true, Stale: gocb.Before})
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, "Key 1", items[0].(cbfixture.Dummy).Key)
+}
+
+func TestDummyCouchbasePersistenceQueryRaw(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := persistence.Create("", cbfixture.Dummy{Key: "Key " + strconv.Itoa(i), Content: "Content"})
+		assert.Nil(t, err)
+	}
+
+	results, err := persistence.QueryRaw("", "SELECT RAW key FROM `test` WHERE _c=$collection ORDER BY key",
+		map[string]interface{}{"collection": "dummies"})
+	assert.Nil(t, err)
+
+	keys := make([]string, 0)
+	var key string
+	for results.Next(&key) {
+		keys = append(keys, key)
+	}
+	assert.Nil(t, results.Close())
+	assert.Equal(t, []string{"Key 0", "Key 1", "Key 2"}, keys)
+	assert.Equal(t, uint(3), results.Metrics().ResultCount)
+}
+
+func TestDummyCouchbasePersistenceExecuteQuery(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := persistence.Create("", cbfixture.Dummy{Key: "Key " + strconv.Itoa(i%2), Content: "Content"})
+		assert.Nil(t, err)
+	}
+
+	rows, err := persistence.ExecuteQuery("", "SELECT key, COUNT(*) AS total FROM `test` WHERE _c=$1 GROUP BY key ORDER BY key",
+		[]interface{}{"dummies"})
+	assert.Nil(t, err)
+	assert.Len(t, rows, 2)
+	assert.Equal(t, "Key 0", rows[0]["key"])
+	assert.Equal(t, float64(2), rows[0]["total"])
+	assert.Equal(t, "Key 1", rows[1]["key"])
+	assert.Equal(t, float64(1), rows[1]["total"])
+}
+
+func TestDummyCouchbasePersistenceSampleRandom(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	for i := 0; i < 5; i++ {
+		_, err := persistence.Create("", cbfixture.Dummy{Key: "Key " + strconv.Itoa(i), Content: "Content"})
+		assert.Nil(t, err)
+	}
+
+	items, err := persistence.SampleRandom("", 3)
+	assert.Nil(t, err)
+	assert.Len(t, items, 3)
+	for _, item := range items {
+		assert.NotEqual(t, "", item.(cbfixture.Dummy).Id)
+	}
+
+	items, err = persistence.SampleRandom("", 10)
+	assert.Nil(t, err)
+	assert.Len(t, items, 5)
+}
+
+func TestDummyCouchbasePersistenceRequireFilterForDelete(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence, "options.require_filter_for_delete", true) {
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := persistence.Create("", cbfixture.Dummy{Key: "Key " + strconv.Itoa(i), Content: "Content"})
+		assert.Nil(t, err)
+	}
+
+	_, err := persistence.DeleteByFilter("", "")
+	assert.NotNil(t, err)
+	assert.Equal(t, "FILTER_REQUIRED", err.(*cerr.ApplicationError).Code)
+
+	count, err := persistence.GetCountByFilter("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), count)
+
+	deleted, err := persistence.DeleteByFilter("", "key='Key 0'")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), deleted)
+
+	err = persistence.DeleteAll("")
+	assert.Nil(t, err)
+
+	count, err = persistence.GetCountByFilter("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestDummyCouchbasePersistenceDeleteWithoutFilter(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	_, err := persistence.Create("", cbfixture.Dummy{Key: "Key 1", Content: "Content"})
+	assert.Nil(t, err)
+
+	deleted, err := persistence.DeleteByFilter("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), deleted)
+}
+
+func TestDummyCouchbasePersistenceDrainAndClose(t *testing.T) {
+	dbConfig := getCouchbaseTestConfig()
+	if dbConfig == nil {
+		return
+	}
+
+	persistence := NewDummyCouchbasePersistence()
+	persistence.Configure(dbConfig)
+
+	opnErr := persistence.Open("")
+	if opnErr != nil {
+		assert.Nil(t, opnErr)
+		return
+	}
+	persistence.Clear("")
+
+	var started sync.WaitGroup
+	var completed sync.WaitGroup
+	errs := make([]error, 10)
+	for i := 0; i < 10; i++ {
+		started.Add(1)
+		completed.Add(1)
+		go func(i int) {
+			defer completed.Done()
+			started.Done()
+			_, errs[i] = persistence.Create("", cbfixture.Dummy{Key: "Key " + strconv.Itoa(i), Content: "Content"})
+		}(i)
+	}
+	started.Wait()
+	time.Sleep(10 * time.Millisecond)
+
+	err := persistence.DrainAndClose("", 5*time.Second)
+	assert.Nil(t, err)
+	completed.Wait()
+	for _, err := range errs {
+		assert.Nil(t, err)
+	}
+}
+
+func TestDummyCouchbasePersistenceCreateMissing(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	_, err := persistence.Create("", cbfixture.Dummy{Id: "1", Key: "Key 1", Content: "Content 1"})
+	assert.Nil(t, err)
+	_, err = persistence.Create("", cbfixture.Dummy{Id: "2", Key: "Key 2", Content: "Content 2"})
+	assert.Nil(t, err)
+
+	created, skipped, err := persistence.CreateMissing("", []interface{}{
+		cbfixture.Dummy{Id: "1", Key: "Key 1", Content: "New Content 1"},
+		cbfixture.Dummy{Id: "3", Key: "Key 3", Content: "Content 3"},
+		cbfixture.Dummy{Id: "2", Key: "Key 2", Content: "New Content 2"},
+		cbfixture.Dummy{Id: "4", Key: "Key 4", Content: "Content 4"},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, created, 2)
+	assert.Len(t, skipped, 2)
+	assert.Equal(t, "3", created[0].(cbfixture.Dummy).Id)
+	assert.Equal(t, "4", created[1].(cbfixture.Dummy).Id)
+	assert.Equal(t, "1", skipped[0].(cbfixture.Dummy).Id)
+	assert.Equal(t, "2", skipped[1].(cbfixture.Dummy).Id)
+
+	dummy, err := persistence.GetOneById("", "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "Content 1", dummy.Content)
+}
+
+func TestDummyCouchbasePersistenceBatch(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	_, err := persistence.Create("", cbfixture.Dummy{Id: "1", Key: "Key 1", Content: "Content 1"})
+	assert.Nil(t, err)
+
+	results, err := persistence.CreateBatch("", []interface{}{
+		cbfixture.Dummy{Id: "1", Key: "Key 1", Content: "New Content 1"},
+		cbfixture.Dummy{Key: "Key 2", Content: "Content 2"},
+		cbfixture.Dummy{Id: "3", Key: "Key 3", Content: "Content 3"},
+	})
+	assert.NotNil(t, err)
+	assert.Len(t, results, 3)
+	assert.Nil(t, results[0])
+	assert.NotEqual(t, "", results[1].(cbfixture.Dummy).Id)
+	assert.Equal(t, "3", results[2].(cbfixture.Dummy).Id)
+	appErr, ok := err.(*cerr.ApplicationError)
+	assert.True(t, ok)
+	if ok {
+		assert.Equal(t, []interface{}{"1"}, appErr.Details["failed_ids"])
+	}
+
+	results, err = persistence.SetBatch("", []interface{}{
+		cbfixture.Dummy{Id: "1", Key: "Key 1", Content: "New Content 1"},
+		cbfixture.Dummy{Id: "4", Key: "Key 4", Content: "Content 4"},
+	})
+	assert.Nil(t, err)
+	assert.Len(t, results, 2)
+
+	dummy, err := persistence.GetOneById("", "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "New Content 1", dummy.Content)
+
+	count, err := persistence.GetCountByFilter("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), count)
+}
+
+func TestDummyCouchbasePersistenceOrFilter(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+	otherPersistence := persist.NewGenericCouchbasePersistence[cbfixture.Dummy, string]("test", "other_dummies")
+	if !openTestPersistence(t, otherPersistence) {
+		return
+	}
+
+	_, err := persistence.Create("", cbfixture.Dummy{Key: "Key 1", Content: "Content 1"})
+	assert.Nil(t, err)
+	_, err = otherPersistence.Create("", cbfixture.Dummy{Key: "Key 2", Content: "Content 2"})
+	assert.Nil(t, err)
+
+	page, err := persistence.IdentifiableCouchbasePersistence.GetPageByFilter("", "key='Key 1' OR key='Key 2'", nil, "", "")
+	assert.Nil(t, err)
+	assert.Len(t, page.Data, 1)
+	assert.Equal(t, "Key 1", page.Data[0].(cbfixture.Dummy).Key)
+}
+
+func TestDummyCouchbasePersistenceCompareAndSet(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	dummy, err := persistence.Create("", cbfixture.Dummy{Key: "Key 1", Content: "new"})
+	assert.Nil(t, err)
+
+	changed, err := persistence.CompareAndSet("", dummy.Id, "content", "new", "active")
+	assert.Nil(t, err)
+	assert.True(t, changed)
+
+	// Out of order transition is rejected
+	changed, err = persistence.CompareAndSet("", dummy.Id, "content", "new", "closed")
+	assert.Nil(t, err)
+	assert.False(t, changed)
+
+	result, err := persistence.GetOneById("", dummy.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, "active", result.Content)
+}
+
+func TestDummyCouchbasePersistenceMaxWriteConcurrency(t *testing.T) {
+	// Records the peak number of bulk operations running in parallel
+	var lock sync.Mutex
+	inFlight, peak, calls := 0, 0, 0
+	operations := &stubBucketOperations{
+		do: func(ops []gocb.BulkOp) error {
+			lock.Lock()
+			calls++
+			inFlight++
+			if inFlight > peak {
+				peak = inFlight
+			}
+			lock.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+			for _, op := range ops {
+				if insertOp := op.(*gocb.InsertOp); insertOp.Key == "dummies:1" {
+					insertOp.Err = gocb.ErrKeyExists
+				}
+			}
+
+			lock.Lock()
+			inFlight--
+			lock.Unlock()
+			return nil
+		},
+	}
+	items := []interface{}{
+		cbfixture.Dummy{Id: "1", Key: "Key 1", Content: "New Content 1"},
+		cbfixture.Dummy{Id: "2", Key: "Key 2", Content: "Content 2"},
+		cbfixture.Dummy{Id: "3", Key: "Key 3", Content: "Content 3"},
+		cbfixture.Dummy{Id: "4", Key: "Key 4", Content: "Content 4"},
+		cbfixture.Dummy{Id: "5", Key: "Key 5", Content: "Content 5"},
+	}
+
+	// Operations are executed no more than 2 at a time, results must be the same as for a single batch
+	persistence := openStubPersistence(t, operations, "options.max_write_concurrency", 2)
+	created, skipped, err := persistence.CreateMissing("", items)
+	assert.Nil(t, err)
+	assert.Len(t, created, 4)
+	assert.Len(t, skipped, 1)
+	assert.Equal(t, "1", skipped[0].(cbfixture.Dummy).Id)
+	assert.Equal(t, 5, calls)
+	assert.Equal(t, 2, peak)
+
+	// Operations are executed one by one
+	inFlight, peak, calls = 0, 0, 0
+	persistence = openStubPersistence(t, operations, "options.max_write_concurrency", 1)
+	created, skipped, err = persistence.CreateMissing("", items)
+	assert.Nil(t, err)
+	assert.Len(t, created, 4)
+	assert.Len(t, skipped, 1)
+	assert.Equal(t, 5, calls)
+	assert.Equal(t, 1, peak)
+
+	// Without the limit all operations are sent in a single batch
+	inFlight, peak, calls = 0, 0, 0
+	persistence = openStubPersistence(t, operations)
+	created, skipped, err = persistence.CreateMissing("", items)
+	assert.Nil(t, err)
+	assert.Len(t, created, 4)
+	assert.Len(t, skipped, 1)
+	assert.Equal(t, 1, calls)
+}
+
+func TestDummyCouchbasePersistenceCoalesceReads(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence, "options.coalesce_reads", true) {
+		return
+	}
+
+	_, err := persistence.Create("", cbfixture.Dummy{Id: "1", Key: "Key 1", Content: "Content 1"})
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dummy, err := persistence.GetOneById("", "1")
+			assert.Nil(t, err)
+			assert.Equal(t, "Content 1", dummy.Content)
+		}()
+	}
+	wg.Wait()
+
+	dummy, err := persistence.GetOneById("", "2")
+	assert.Nil(t, err)
+	assert.Equal(t, "", dummy.Id)
+}
+
+func TestDummyCouchbasePersistenceHistory(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence, "options.history_collection", "dummies_history") {
+		return
+	}
+
+	// History is not cleared with the collection, so a new id is used
+	dummy, err := persistence.Create("", cbfixture.Dummy{Key: "Key 1", Content: "Version 1"})
+	assert.Nil(t, err)
+
+	dummy.Content = "Version 2"
+	_, err = persistence.Update("", dummy)
+	assert.Nil(t, err)
+
+	_, err = persistence.UpdatePartially("", dummy.Id, cdata.NewAnyValueMapFromTuples("content", "Version 3"))
+	assert.Nil(t, err)
+
+	_, err = persistence.DeleteById("", dummy.Id)
+	assert.Nil(t, err)
+
+	items, err := persistence.GetHistory("", dummy.Id)
+	assert.Nil(t, err)
+	assert.Len(t, items, 3)
+	for i, item := range items {
+		assert.Equal(t, dummy.Id, item.(cbfixture.Dummy).Id)
+		assert.Equal(t, "Version "+strconv.Itoa(i+1), item.(cbfixture.Dummy).Content)
+	}
+}
+
+func TestDummyCouchbasePersistenceGenerateCorrelationId(t *testing.T) {
+	logger := newCaptureLogger()
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence, "options.generate_correlation_id", true) {
+		return
+	}
+	persistence.SetReferences(cref.NewReferencesFromTuples(
+		cref.NewDescriptor("pip-services", "logger", "capture", "default", "1.0"), logger,
+	))
+
+	_, err := persistence.Create("", cbfixture.Dummy{Id: "1", Key: "Key 1", Content: "Content 1"})
+	assert.Nil(t, err)
+
+	found := false
+	for _, message := range logger.Messages() {
+		if strings.Contains(message, "Created in") {
+			found = true
+			assert.False(t, strings.HasPrefix(message, " "), "correlation id must be generated")
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestDummyCouchbasePersistenceFilterParams(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	keys := []string{"O'Brien", "' OR '1'='1", "Ключ ✓", "Key"}
+	for _, key := range keys {
+		_, err := persistence.Create("", cbfixture.Dummy{Key: key, Content: "Content"})
+		assert.Nil(t, err)
+	}
+
+	// Values with quotes and unicode are matched exactly
+	for _, key := range keys {
+		page, err := persistence.GetPageByFilter("", cdata.NewFilterParamsFromTuples("key", key), nil)
+		assert.Nil(t, err)
+		assert.Len(t, page.Data, 1)
+		assert.Equal(t, key, page.Data[0].Key)
+	}
+
+	// Positional parameters
+	items, err := persistence.GetListByFilterWithParams("", "key=$1 OR key=$2", []interface{}{"O'Brien", "Key"}, "", "")
+	assert.Nil(t, err)
+	assert.Len(t, items, 2)
+
+	// Named parameters in AnyValueMap
+	page, err := persistence.GetPageByFilterWithParams("", "key=$key",
+		cdata.NewAnyValueMapFromTuples("key", "' OR '1'='1"), nil, "", "")
+	assert.Nil(t, err)
+	assert.Len(t, page.Data, 1)
+
+	// Nil and empty parameters
+	items, err = persistence.GetListByFilterWithParams("", "", nil, "", "")
+	assert.Nil(t, err)
+	assert.Len(t, items, 4)
+	items, err = persistence.GetListByFilterWithParams("", "", map[string]interface{}{}, "", "")
+	assert.Nil(t, err)
+	assert.Len(t, items, 4)
+}
+
+func TestDummyCouchbasePersistenceReadOnly(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	_, err := persistence.Create("", cbfixture.Dummy{Id: "1", Key: "Key 1", Content: "Content 1"})
+	assert.Nil(t, err)
+
+	dbConfig := getCouchbaseTestConfig()
+	dbConfig.SetAsObject("options.read_only", true)
+	readOnly := NewDummyCouchbasePersistence()
+	readOnly.Configure(dbConfig)
+
+	opnErr := readOnly.Open("")
+	if opnErr != nil {
+		assert.Nil(t, opnErr)
+		return
+	}
+	defer readOnly.Close("")
+
+	dummy, err := readOnly.GetOneById("", "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "Content 1", dummy.Content)
+
+	page, err := readOnly.GetPageByFilter("", nil, nil)
+	assert.Nil(t, err)
+	assert.Len(t, page.Data, 1)
+
+	_, err = readOnly.DeleteById("", "1")
+	assert.NotNil(t, err)
+
+	dummy, err = persistence.GetOneById("", "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "1", dummy.Id)
+}
+
+func TestDummyCouchbasePersistencePageTotal(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	for i := 0; i < 25; i++ {
+		_, err := persistence.Create("", cbfixture.Dummy{Key: "Key " + strconv.Itoa(i), Content: "Content"})
+		assert.Nil(t, err)
+	}
+
+	// Total counts all matching items on every page
+	for skip := int64(0); skip < 30; skip += 10 {
+		page, err := persistence.GetPageByFilter("", nil, cdata.NewPagingParams(skip, 10, true))
+		assert.Nil(t, err)
+		assert.NotNil(t, page.Total)
+		assert.Equal(t, int64(25), *page.Total)
+	}
+
+	page, err := persistence.GetPageByFilter("", cdata.NewFilterParamsFromTuples("key", "Key 1"), cdata.NewPagingParams(0, 10, true))
+	assert.Nil(t, err)
+	assert.Len(t, page.Data, 1)
+	assert.Equal(t, int64(1), *page.Total)
+}
+
+func TestDummyCouchbasePersistenceTtl(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	_, err := persistence.CreateWithTtl("", cbfixture.Dummy{Id: "1", Key: "Key 1", Content: "Content 1"}, 1)
+	assert.Nil(t, err)
+	_, err = persistence.SetWithTtl("", cbfixture.Dummy{Id: "2", Key: "Key 2", Content: "Content 2"}, 1)
+	assert.Nil(t, err)
+	_, err = persistence.Create("", cbfixture.Dummy{Id: "3", Key: "Key 3", Content: "Content 3"})
+	assert.Nil(t, err)
+
+	time.Sleep(3 * time.Second)
+
+	items, err := persistence.GetListByIds("", []string{"1", "2", "3"})
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, "3", items[0].Id)
+}
+
+func TestDummyCouchbasePersistenceUpdateWithCas(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	_, err := persistence.Create("", cbfixture.Dummy{Id: "1", Key: "Key 1", Content: "Content 1"})
+	assert.Nil(t, err)
+
+	// Two readers get the same version of the item
+	page1, err := persistence.GetPageWithCasByFilter("", "", nil, "")
+	assert.Nil(t, err)
+	page2, err := persistence.GetPageWithCasByFilter("", "", nil, "")
+	assert.Nil(t, err)
+	read1 := page1.Data[0].(*persist.ItemWithCas)
+	read2 := page2.Data[0].(*persist.ItemWithCas)
+
+	dummy := read1.Item.(cbfixture.Dummy)
+	dummy.Content = "Content 2"
+	_, err = persistence.UpdateWithCas("", dummy, read1.Cas)
+	assert.Nil(t, err)
+
+	dummy = read2.Item.(cbfixture.Dummy)
+	dummy.Content = "Content 3"
+	_, err = persistence.UpdateWithCas("", dummy, read2.Cas)
+	assert.NotNil(t, err)
+	assert.Equal(t, "CAS_MISMATCH", err.(*cerr.ApplicationError).Code)
+
+	result, err := persistence.GetOneById("", "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "Content 2", result.Content)
+}
+
+func TestDummyCouchbasePersistenceCasOperations(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	_, err := persistence.Create("", cbfixture.Dummy{Id: "1", Key: "Key 1", Content: "Content 1"})
+	assert.Nil(t, err)
+
+	item, cas, err := persistence.GetOneByIdWithCas("", "1")
+	assert.Nil(t, err)
+	assert.NotEqual(t, gocb.Cas(0), cas)
+	assert.Equal(t, "Content 1", item.(cbfixture.Dummy).Content)
+
+	_, newCas, err := persistence.UpdatePartiallyWithCas("", "1", cdata.NewAnyValueMapFromTuples("content", "Content 2"), cas)
+	assert.Nil(t, err)
+	assert.NotEqual(t, cas, newCas)
+
+	// The old CAS value is rejected
+	_, _, err = persistence.UpdatePartiallyWithCas("", "1", cdata.NewAnyValueMapFromTuples("content", "Content 3"), cas)
+	assert.NotNil(t, err)
+	assert.Equal(t, "CAS_MISMATCH", err.(*cerr.ApplicationError).Code)
+	_, err = persistence.DeleteByIdWithCas("", "1", cas)
+	assert.NotNil(t, err)
+	assert.Equal(t, "CAS_MISMATCH", err.(*cerr.ApplicationError).Code)
+
+	item, err = persistence.DeleteByIdWithCas("", "1", newCas)
+	assert.Nil(t, err)
+	assert.Equal(t, "Content 2", item.(cbfixture.Dummy).Content)
+
+	item, cas, err = persistence.GetOneByIdWithCas("", "1")
+	assert.Nil(t, err)
+	assert.Nil(t, item)
+	assert.Equal(t, gocb.Cas(0), cas)
+}
+
+func TestDummyCouchbasePersistenceDeleteByIdsMissing(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	ids := make([]string, 0)
+	for i := 0; i < 20; i++ {
+		id := strconv.Itoa(i)
+		ids = append(ids, id, "missing"+id)
+		_, err := persistence.Create("", cbfixture.Dummy{Id: id, Key: "Key " + id, Content: "Content"})
+		assert.Nil(t, err)
+	}
+
+	// Missing ids are ignored
+	err := persistence.DeleteByIds("", ids)
+	assert.Nil(t, err)
+
+	items, err := persistence.GetListByIds("", ids)
+	assert.Nil(t, err)
+	assert.Len(t, items, 0)
+}
+
+func TestDummyCouchbasePersistenceErrors(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	_, err := persistence.Create("123", cbfixture.Dummy{Id: "1", Key: "Key 1", Content: "Content 1"})
+	assert.Nil(t, err)
+
+	// Duplicate key is reported as a conflict
+	_, err = persistence.Create("123", cbfixture.Dummy{Id: "1", Key: "Key 1", Content: "Content 1"})
+	appErr, ok := err.(*cerr.ApplicationError)
+	assert.True(t, ok)
+	if ok {
+		assert.Equal(t, cerr.Conflict, appErr.Category)
+		assert.Equal(t, "DUPLICATE_KEY", appErr.Code)
+		assert.Equal(t, "123", appErr.CorrelationId)
+		assert.Equal(t, "1", appErr.Details["id"])
+		assert.Equal(t, "dummies", appErr.Details["collection"])
+		assert.NotEqual(t, "", appErr.Cause)
+	}
+
+	// Update of missing item is reported as not found
+	_, err = persistence.Update("123", cbfixture.Dummy{Id: "2", Key: "Key 2", Content: "Content 2"})
+	appErr, ok = err.(*cerr.ApplicationError)
+	assert.True(t, ok)
+	if ok {
+		assert.Equal(t, cerr.NotFound, appErr.Category)
+	}
+
+	// Reads and deletes of missing items are not errors
+	_, err = persistence.GetOneById("123", "2")
+	assert.Nil(t, err)
+	_, err = persistence.DeleteById("123", "2")
+	assert.Nil(t, err)
+}
+
+func TestDummyCouchbasePersistenceUpdateMissing(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	_, err := persistence.Update("123", cbfixture.Dummy{Id: "missing", Key: "Key 1", Content: "Content 1"})
+	appErr, ok := err.(*cerr.ApplicationError)
+	assert.True(t, ok)
+	if ok {
+		assert.Equal(t, cerr.NotFound, appErr.Category)
+		assert.Equal(t, "OBJECT_NOT_FOUND", appErr.Code)
+		assert.Equal(t, "missing", appErr.Details["id"])
+		assert.Equal(t, "dummies", appErr.Details["collection"])
+	}
+
+	_, err = persistence.UpdatePartially("123", "missing", cdata.NewAnyValueMapFromTuples("content", "Partially Updated"))
+	appErr, ok = err.(*cerr.ApplicationError)
+	assert.True(t, ok)
+	if ok {
+		assert.Equal(t, cerr.NotFound, appErr.Category)
+		assert.Equal(t, "OBJECT_NOT_FOUND", appErr.Code)
+		assert.Equal(t, "missing", appErr.Details["id"])
+	}
+}
+
+func TestDummyCouchbasePersistenceConsistency(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence, "options.consistency", "not_bounded") {
+		return
+	}
+
+	_, err := persistence.Create("", cbfixture.Dummy{Id: "1", Key: "Key 1", Content: "Content 1"})
+	assert.Nil(t, err)
+
+	// Request plus overrides configured consistency and reads own writes
+	page, err := persistence.IdentifiableCouchbasePersistence.GetPageByFilterWithConsistency("", "key=$key",
+		map[string]interface{}{"key": "Key 1"}, nil, "", "", gocb.RequestPlus)
+	assert.Nil(t, err)
+	assert.Len(t, page.Data, 1)
+
+	items, err := persistence.IdentifiableCouchbasePersistence.GetListByFilterWithConsistency("", "key=$key",
+		map[string]interface{}{"key": "Key 1"}, "", "", gocb.RequestPlus)
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+}
+
+func TestDummyCouchbasePersistenceIndexes(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	// Existing and missing indexes are handled gracefully
+	err := persistence.CreateIndex("", "test_dummies_key", []string{"key"}, false)
+	assert.Nil(t, err)
+	err = persistence.CreateIndex("", "test_dummies_key", []string{"key"}, false)
+	assert.Nil(t, err)
+
+	err = persistence.DropIndex("", "test_dummies_key")
+	assert.Nil(t, err)
+	err = persistence.DropIndex("", "test_dummies_key")
+	assert.Nil(t, err)
+}
+
+type schemaDummyPersistence struct {
+	persist.IdentifiableCouchbasePersistence
+	indexFields []string
+}
+
+func newSchemaDummyPersistence(indexFields []string) *schemaDummyPersistence {
+	c := &schemaDummyPersistence{indexFields: indexFields}
+	c.IdentifiableCouchbasePersistence = *persist.InheritIdentifiableCouchbasePersistence(c, reflect.TypeOf(cbfixture.Dummy{}), "test", "dummies")
+	return c
+}
+
+func (c *schemaDummyPersistence) DefineSchema() {
+	c.IdentifiableCouchbasePersistence.DefineSchema()
+	c.EnsureIndex("test_dummies_schema", c.indexFields, false)
+}
+
+func TestDummyCouchbasePersistenceDefineSchema(t *testing.T) {
+	dbConfig := getCouchbaseTestConfig()
+	if dbConfig == nil {
+		return
+	}
+
+	// Declared indexes are created on every opening
+	persistence := newSchemaDummyPersistence([]string{"key"})
+	persistence.Configure(dbConfig)
+	for i := 0; i < 2; i++ {
+		opnErr := persistence.Open("")
+		if opnErr != nil {
+			assert.Nil(t, opnErr)
+			return
+		}
+		assert.True(t, persistence.IsOpen())
+		persistence.Close("")
+	}
+
+	// Index creation failure fails opening
+	invalid := newSchemaDummyPersistence([]string{"invalid`key"})
+	invalid.Configure(dbConfig)
+	opnErr := invalid.Open("")
+	assert.NotNil(t, opnErr)
+	assert.Equal(t, "CONNECT_FAILED", opnErr.(*cerr.ApplicationError).Code)
+	assert.False(t, invalid.IsOpen())
+
+	if persistence.Open("") == nil {
+		persistence.DropIndex("", "test_dummies_schema")
+		persistence.Close("")
+	}
+}
+
+func TestDummyCouchbasePersistenceSubDocument(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence, "options.subdoc_updates", true) {
+		return
+	}
+
+	_, err := persistence.Create("", cbfixture.Dummy{Id: "1", Key: "Key 1", Content: "Content 1"})
+	assert.Nil(t, err)
+
+	dummy, err := persistence.UpdatePartially("", "1", cdata.NewAnyValueMapFromTuples("content", "New Content"))
+	assert.Nil(t, err)
+	assert.Equal(t, "Key 1", dummy.Key)
+	assert.Equal(t, "New Content", dummy.Content)
+
+	values, err := persistence.GetFields("", "1", []string{"content", "missing"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"content": "New Content"}, values)
+
+	values, err = persistence.GetFields("", "2", []string{"content"})
+	assert.Nil(t, err)
+	assert.Nil(t, values)
+}
+
+func TestDummyCouchbasePersistenceCounters(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	// Counter expires, so every run starts with a new one
+	counterId := "counter_" + cdata.IdGenerator.NextLong()
+	value, err := persistence.Increment("", counterId, 1, 10, 60)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), value)
+
+	value, err = persistence.Increment("", counterId, 5, 10, 60)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(15), value)
+
+	value, err = persistence.Decrement("", counterId, 3, 10, 60)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(12), value)
+
+	// Missing counter is not created with negative initial value
+	_, err = persistence.Increment("", "missing_"+counterId, 1, -1, 0)
+	assert.NotNil(t, err)
+}
+
+func TestDummyCouchbasePersistenceForEach(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	for i := 0; i < 5; i++ {
+		_, err := persistence.Create("", cbfixture.Dummy{Key: "Key " + strconv.Itoa(i), Content: "Content"})
+		assert.Nil(t, err)
+	}
+
+	keys := make([]string, 0)
+	err := persistence.ForEachByFilter("", "content=$content", map[string]interface{}{"content": "Content"}, "key", "",
+		func(item interface{}) error {
+			keys = append(keys, item.(cbfixture.Dummy).Key)
+			return nil
+		})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Key 0", "Key 1", "Key 2", "Key 3", "Key 4"}, keys)
+
+	// Callback error stops the iteration
+	stopErr := errors.New("stop")
+	count := 0
+	err = persistence.ForEachByFilter("", "", nil, "key", "", func(item interface{}) error {
+		count++
+		if count == 2 {
+			return stopErr
+		}
+		return nil
+	})
+	assert.Equal(t, stopErr, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestDummyCouchbasePersistenceProjection(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := persistence.Create("", cbfixture.Dummy{Id: strconv.Itoa(i), Key: "Key " + strconv.Itoa(i), Content: "Content"})
+		assert.Nil(t, err)
+	}
+
+	// "key" is a reserved word and must be escaped
+	page, err := persistence.GetPageByFilterWithProjection("", "", nil,
+		cdata.NewPagingParams(0, 2, true), "key", []string{"key", "missing"})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), *page.Total)
+	assert.Len(t, page.Data, 2)
+	assert.Equal(t, map[string]interface{}{"key": "Key 0"}, page.Data[0])
+	assert.Equal(t, map[string]interface{}{"key": "Key 1"}, page.Data[1])
+
+	_, err = persistence.GetPageByFilterWithProjection("", "", nil, nil, "", nil)
+	assert.NotNil(t, err)
+}
+
+func TestDummyCouchbasePersistenceOneRandom(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+	otherPersistence := persist.NewGenericCouchbasePersistence[cbfixture.Dummy, string]("test", "other_dummies")
+	if !openTestPersistence(t, otherPersistence) {
+		return
+	}
+
+	item, err := persistence.IdentifiableCouchbasePersistence.GetOneRandom("", "")
+	assert.Nil(t, err)
+	assert.Nil(t, item)
+
+	for i := 0; i < 3; i++ {
+		_, err = persistence.Create("", cbfixture.Dummy{Key: "Key " + strconv.Itoa(i), Content: "Own"})
+		assert.Nil(t, err)
+		_, err = otherPersistence.Create("", cbfixture.Dummy{Key: "Other " + strconv.Itoa(i), Content: "Other"})
+		assert.Nil(t, err)
+	}
+
+	// Random items are selected only from own collection
+	for i := 0; i < 10; i++ {
+		item, err = persistence.IdentifiableCouchbasePersistence.GetOneRandom("", "")
+		assert.Nil(t, err)
+		if assert.NotNil(t, item) {
+			assert.Equal(t, "Own", item.(cbfixture.Dummy).Content)
+		}
+	}
+}
+
+func TestDummyCouchbasePersistenceDeleteByFilterScope(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+	otherPersistence := persist.NewGenericCouchbasePersistence[cbfixture.Dummy, string]("test", "other_dummies")
+	if !openTestPersistence(t, otherPersistence) {
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := persistence.Create("", cbfixture.Dummy{Key: "Key " + strconv.Itoa(i), Content: "Content"})
+		assert.Nil(t, err)
+		_, err = otherPersistence.Create("", cbfixture.Dummy{Key: "Key " + strconv.Itoa(i), Content: "Content"})
+		assert.Nil(t, err)
+	}
+
+	// The same filter matches items of both collections, but only own items are deleted
+	deleted, err := persistence.DeleteByFilter("", "key='Key 0'")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), deleted)
+
+	deleted, err = persistence.DeleteByFilter("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), deleted)
+
+	count, err := otherPersistence.GetCountByFilter("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), count)
+}
+
+func TestDummyCouchbasePersistenceGetListByFilterScope(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+	otherPersistence := persist.NewGenericCouchbasePersistence[cbfixture.Dummy, string]("test", "other_dummies")
+	if !openTestPersistence(t, otherPersistence) {
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := persistence.Create("", cbfixture.Dummy{Key: "Key " + strconv.Itoa(i), Content: "Content"})
+		assert.Nil(t, err)
+		_, err = otherPersistence.Create("", cbfixture.Dummy{Key: "Key " + strconv.Itoa(i), Content: "Other Content"})
+		assert.Nil(t, err)
+	}
+
+	// OR filter is kept inside parentheses and doesn't escape the collection condition
+	items, err := persistence.IdentifiableCouchbasePersistence.GetListByFilter("", "key='Key 0' OR key='Key 1'", "", "")
+	assert.Nil(t, err)
+	assert.Len(t, items, 2)
+	for _, item := range items {
+		assert.Equal(t, "Content", item.(cbfixture.Dummy).Content)
+	}
+
+	items, err = persistence.IdentifiableCouchbasePersistence.GetListByFilter("", "", "", "")
+	assert.Nil(t, err)
+	assert.Len(t, items, 3)
+}
+
+func TestDummyCouchbasePersistenceClearCollection(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+	otherPersistence := persist.NewGenericCouchbasePersistence[cbfixture.Dummy, string]("test", "other_dummies")
+	if !openTestPersistence(t, otherPersistence) {
+		return
+	}
+
+	_, err := persistence.Create("", cbfixture.Dummy{Key: "Key 1", Content: "Content 1"})
+	assert.Nil(t, err)
+	_, err = otherPersistence.Create("", cbfixture.Dummy{Key: "Key 2", Content: "Content 2"})
+	assert.Nil(t, err)
+
+	err = persistence.Clear("")
+	assert.Nil(t, err)
+
+	count, err := persistence.GetCountByFilter("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), count)
+
+	count, err = otherPersistence.GetCountByFilter("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestDummyCouchbasePersistenceDurability(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence, "options.persist_to", 1) {
+		return
+	}
+
+	fixture := cbfixture.NewDummyPersistenceFixture(persistence)
+	t.Run("CRUD Operations", fixture.TestCrudOperations)
+}
+
+func TestDummyCouchbasePersistencePing(t *testing.T) {
+	dbConfig := getCouchbaseTestConfig()
+	if dbConfig == nil {
+		return
+	}
+
+	persistence := NewDummyCouchbasePersistence()
+	persistence.Configure(dbConfig)
+
+	opnErr := persistence.Open("")
+	if opnErr != nil {
+		assert.Nil(t, opnErr)
+		return
+	}
+
+	err := persistence.Connection.Ping("")
+	assert.Nil(t, err)
+
+	persistence.Close("")
+	err = persistence.Connection.Ping("")
+	assert.NotNil(t, err)
+}
+
+func TestDummyCouchbasePersistenceAutoReconnect(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	dummy, err := persistence.Create("", cbfixture.Dummy{Key: "Key 1", Content: "Content 1"})
+	assert.Nil(t, err)
+
+	// Simulate dropped connection
+	persistence.Bucket.Close()
+
+	item, err := persistence.GetOneById("", dummy.Id)
+	assert.Nil(t, err)
+	if assert.NotNil(t, item) {
+		assert.Equal(t, "Key 1", item.Key)
+	}
+}
+
+func TestDummyCouchbasePersistenceAnalyticsQuery(t *testing.T) {
+	dbConfig := getCouchbaseTestConfig()
+	// Analytics service with a dataset over the test bucket is required
+	dataset := os.Getenv("COUCHBASE_ANALYTICS_DATASET")
+	if dbConfig == nil || dataset == "" {
+		return
+	}
+
+	persistence := NewDummyCouchbasePersistence()
+	persistence.Configure(dbConfig)
+
+	opnErr := persistence.Open("")
+	if opnErr != nil {
+		assert.Nil(t, opnErr)
+		return
+	}
+	persistence.Clear("")
+	defer persistence.Close("")
+
+	_, err := persistence.Create("", cbfixture.Dummy{Key: "Key 1", Content: "Content 1"})
+	assert.Nil(t, err)
+
+	items, err := persistence.ExecuteAnalyticsQuery("", "SELECT VALUE d FROM `"+dataset+"` d WHERE d._c = $1",
+		[]interface{}{"dummies"})
+	assert.Nil(t, err)
+	for _, item := range items {
+		_, ok := item.(cbfixture.Dummy)
+		assert.True(t, ok)
+	}
+}
+
+func TestDummyCouchbasePersistenceQueryView(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	ddoc := &gocb.DesignDocument{
+		Name: "dummies_docs",
+		Views: map[string]gocb.View{
+			"by_key": {
+				Map: "function (doc, meta) { if (doc._c == 'dummies') { emit(doc.key, doc); } }",
+			},
+		},
+	}
+	dbConfig := getCouchbaseTestConfig()
+	manager := persistence.Bucket.Manager(dbConfig.GetAsString("credential.username"), dbConfig.GetAsString("credential.password"))
+	if err := manager.UpsertDesignDocument(ddoc); err != nil {
+		t.Skip("Design document views are not available: " + err.Error())
+	}
+	defer manager.RemoveDesignDocument(ddoc.Name)
+
+	for i := 0; i < 3; i++ {
+		_, err := persistence.Create("", cbfixture.Dummy{Key: "Key " + strconv.Itoa(i), Content: "Content"})
+		assert.Nil(t, err)
+	}
+
+	query := gocb.NewViewQuery("dummies_docs", "by_key").Stale(gocb.Before).Range("Key 1", "Key 2", true)
+	items, err := persistence.QueryView("", "dummies_docs", "by_key", query)
+	assert.Nil(t, err)
+	assert.Len(t, items, 2)
+	if len(items) == 2 {
+		assert.Equal(t, "Key 1", items[0].(cbfixture.Dummy).Key)
+		assert.Equal(t, "Key 2", items[1].(cbfixture.Dummy).Key)
+	}
+}
+
+func TestDummyCouchbasePersistenceGetListByIdsWithMissing(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	_, err := persistence.Create("", cbfixture.Dummy{Id: "1", Key: "Key 1", Content: "Content 1"})
+	assert.Nil(t, err)
+	_, err = persistence.Create("", cbfixture.Dummy{Id: "3", Key: "Key 3", Content: "Content 3"})
+	assert.Nil(t, err)
+
+	items, missing, err := persistence.IdentifiableCouchbasePersistence.GetListByIdsWithMissing("", []interface{}{"3", "2", "1"})
+	assert.Nil(t, err)
+	assert.Len(t, items, 3)
+	assert.Equal(t, "Key 3", items[0].(cbfixture.Dummy).Key)
+	assert.Nil(t, items[1])
+	assert.Equal(t, "Key 1", items[2].(cbfixture.Dummy).Key)
+	assert.Equal(t, []interface{}{"2"}, missing)
+
+	list, err := persistence.GetListByIds("", []string{"3", "2", "1"})
+	assert.Nil(t, err)
+	assert.Len(t, list, 2)
+}
+
+func TestDummyCouchbasePersistenceKeyGenerator(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	persistence.SetKeyGenerator(persist.NewDefaultKeyGenerator("::"))
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	fixture := cbfixture.NewDummyPersistenceFixture(persistence)
+	t.Run("CRUD Operations", fixture.TestCrudOperations)
+
+	_, err := persistence.Create("", cbfixture.Dummy{Id: "1", Key: "Key 1", Content: "Content 1"})
+	assert.Nil(t, err)
+
+	buf := make(map[string]interface{})
+	_, err = persistence.Bucket.Get("dummies::1", &buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "Key 1", buf["key"])
+}
+
+func TestDummyCouchbasePersistencePerformanceCounters(t *testing.T) {
+	counters := ccount.NewLogCounters()
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+	persistence.SetReferences(cref.NewReferencesFromTuples(
+		cref.NewDescriptor("pip-services", "counters", "log", "default", "1.0"), counters,
+	))
+
+	dummy, err := persistence.Create("", cbfixture.Dummy{Key: "Key 1", Content: "Content 1"})
+	assert.Nil(t, err)
+	_, err = persistence.GetOneById("", dummy.Id)
+	assert.Nil(t, err)
+	_, err = persistence.GetOneById("", dummy.Id)
+	assert.Nil(t, err)
+
+	calls := counters.Get("couchbase.GetOneById.calls", ccount.Increment)
+	assert.Equal(t, 2, calls.Count)
+	timing := counters.Get("couchbase.Create.time", ccount.Interval)
+	assert.Equal(t, 1, timing.Count)
+}
+
+func TestDummyCouchbasePersistenceSlowQuery(t *testing.T) {
+	// Any query over network takes at least a millisecond
+
+	logger := newCaptureLogger()
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence, "options.slow_query_threshold_ms", 1) {
+		return
+	}
+	persistence.SetReferences(cref.NewReferencesFromTuples(
+		cref.NewDescriptor("pip-services", "logger", "capture", "default", "1.0"), logger,
+	))
+
+	_, err := persistence.IdentifiableCouchbasePersistence.GetListByFilter("", "key='Key 1'", "", "")
+	assert.Nil(t, err)
+
+	found := false
+	for _, message := range logger.Messages() {
+		if strings.Contains(message, "Slow query") && strings.Contains(message, "key='Key 1'") {
+			found = true
+		}
+	}
+	assert.True(t, found)
+}
+
+func TestDummyCouchbasePersistenceGetPageByFilterWithCursor(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	for i := 1; i <= 5; i++ {
+		_, err := persistence.Create("", cbfixture.Dummy{Key: "Key " + strconv.Itoa(i), Content: "Content"})
+		assert.Nil(t, err)
+	}
+
+	keys := make([]string, 0)
+	var cursor interface{}
+	for pages := 0; pages < 5; pages++ {
+		items, next, err := persistence.GetPageByFilterWithCursor("", "", cursor, 2, "key")
+		assert.Nil(t, err)
+		for _, item := range items {
+			keys = append(keys, item.(cbfixture.Dummy).Key)
+		}
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, []string{"Key 1", "Key 2", "Key 3", "Key 4", "Key 5"}, keys)
+
+	items, _, err := persistence.GetPageByFilterWithCursor("", "", nil, 2, "key DESC")
+	assert.Nil(t, err)
+	assert.Len(t, items, 2)
+	assert.Equal(t, "Key 5", items[0].(cbfixture.Dummy).Key)
+}
+
+func TestDummyCouchbasePersistenceUnsetReferences(t *testing.T) {
+	dbConfig := getCouchbaseTestConfig()
+	if dbConfig == nil {
+		return
+	}
+
+	persistence := NewDummyCouchbasePersistence()
+	persistence.Configure(dbConfig)
+	persistence.SetReferences(cref.NewEmptyReferences())
+
+	opnErr := persistence.Open("")
+	if opnErr != nil {
+		assert.Nil(t, opnErr)
+		return
+	}
+	connection := persistence.Connection
+	assert.True(t, connection.IsOpen())
+
+	// The owned local connection is closed instead of being leaked
+	persistence.UnsetReferences()
+	assert.False(t, connection.IsOpen())
+	assert.False(t, persistence.IsOpen())
+
+	_, err := persistence.GetOneById("", "1")
+	assert.NotNil(t, err)
+	assert.Equal(t, "NOT_OPENED", err.(*cerr.ApplicationError).Code)
+
+	// The persistence can be reopened with a new local connection
+	persistence.SetReferences(cref.NewEmptyReferences())
+	assert.Nil(t, persistence.Open(""))
+	defer persistence.Close("")
+	assert.True(t, persistence.IsOpen())
+}
+
+func TestDummyCouchbasePersistenceGetOneByFilter(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	for i := 1; i <= 3; i++ {
+		_, err := persistence.Create("", cbfixture.Dummy{Key: "Key " + strconv.Itoa(i), Content: "Content"})
+		assert.Nil(t, err)
+	}
+
+	item, err := persistence.GetOneByFilter("", "key='Key 2'", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "Key 2", item.(cbfixture.Dummy).Key)
+
+	item, err = persistence.GetOneByFilter("", "content='Content'", "key DESC")
+	assert.Nil(t, err)
+	assert.Equal(t, "Key 3", item.(cbfixture.Dummy).Key)
+
+	item, err = persistence.GetOneByFilterWithParams("", "key=$key", map[string]interface{}{"key": "Key 4"}, "")
+	assert.Nil(t, err)
+	assert.Nil(t, item)
+}
+
+func TestDummyCouchbasePersistenceGetPageWithStats(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	for i := 1; i <= 3; i++ {
+		_, err := persistence.Create("", cbfixture.Dummy{Key: "Key " + strconv.Itoa(i), Content: "Content"})
+		assert.Nil(t, err)
+	}
+
+	page, stats, err := persistence.GetPageByFilterWithStats("", "content=$content",
+		map[string]interface{}{"content": "Content"}, nil, "key", "")
+	assert.Nil(t, err)
+	assert.Len(t, page.Data, 3)
+	assert.Equal(t, int64(3), stats.ResultCount)
+	assert.Equal(t, int64(3), stats.SortCount)
+	assert.True(t, stats.ExecutionTime > 0)
+}
+
+func TestDummyCouchbasePersistenceExists(t *testing.T) {
+	persistence := NewDummyCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	exists, err := persistence.Exists("", "")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	_, err = persistence.Create("", cbfixture.Dummy{Key: "Key 1", Content: "Content"})
+	assert.Nil(t, err)
+
+	exists, err = persistence.Exists("", "key='Key 1'")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	exists, err = persistence.ExistsWithParams("", "key=$key", map[string]interface{}{"key": "Key 2"})
+	assert.Nil(t, err)
+	assert.False(t, exists)
+}
@@ -0,0 +1,75 @@
+package test_persistence
+
+import (
+	"testing"
+
+	cdata "github.com/pip-services3-go/pip-services3-commons-go/data"
+	persist "github.com/pip-services3-go/pip-services3-couchbase-go/persistence"
+	cbfixture "github.com/pip-services3-go/pip-services3-couchbase-go/test/fixture"
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestDummyGenericCouchbasePersistence(t *testing.T) {
+	persistence := persist.NewGenericCouchbasePersistence[cbfixture.Dummy, string]("test", "dummies")
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	dummy, err := persistence.Create("", cbfixture.Dummy{Key: "Key 1", Content: "Content 1"})
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", dummy.Id)
+	assert.Equal(t, "Key 1", dummy.Key)
+
+	dummy.Content = "Updated Content 1"
+	dummy, err = persistence.Update("", dummy)
+	assert.Nil(t, err)
+	assert.Equal(t, "Updated Content 1", dummy.Content)
+
+	dummy, err = persistence.UpdatePartially("", dummy.Id, cdata.NewAnyValueMapFromTuples("content", "Partially Updated Content 1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "Partially Updated Content 1", dummy.Content)
+
+	result, err := persistence.GetOneById("", dummy.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, dummy, result)
+
+	items, err := persistence.GetListByIds("", []string{dummy.Id})
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+
+	page, err := persistence.GetPageByFilter("", "", cdata.NewPagingParams(0, 10, true), "", "")
+	assert.Nil(t, err)
+	assert.Len(t, page.Data, 1)
+
+	result, err = persistence.DeleteById("", dummy.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, dummy.Id, result.Id)
+
+	result, err = persistence.GetOneById("", dummy.Id)
+	assert.Nil(t, err)
+	assert.Equal(t, cbfixture.Dummy{}, result)
+}
+
+func TestDummyMapGenericCouchbasePersistence(t *testing.T) {
+	persistence := persist.NewGenericCouchbasePersistence[map[string]interface{}, string]("test", "dummies")
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	dummy, err := persistence.Create("", map[string]interface{}{"key": "Key 1", "content": "Content 1"})
+	assert.Nil(t, err)
+	id, _ := dummy["id"].(string)
+	assert.NotEqual(t, "", id)
+	assert.Equal(t, "Key 1", dummy["key"])
+
+	result, err := persistence.GetOneById("", id)
+	assert.Nil(t, err)
+	assert.Equal(t, "Content 1", result["content"])
+
+	err = persistence.DeleteByIds("", []string{id})
+	assert.Nil(t, err)
+
+	result, err = persistence.GetOneById("", id)
+	assert.Nil(t, err)
+	assert.Nil(t, result)
+}
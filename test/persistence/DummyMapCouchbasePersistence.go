@@ -99,17 +99,23 @@ func (c *DummyMapCouchbasePersistence) GetPageByFilter(correlationId string, fil
 	}
 	key := filter.GetAsString("key")
 	filterCondition := ""
+	params := make(map[string]interface{})
 	if key != "" {
-		filterCondition += "key='" + key + "'"
+		filterCondition += "key=$key"
+		params["key"] = key
 	}
 
-	tempPage, err := c.IdentifiableCouchbasePersistence.GetPageByFilter(correlationId, filterCondition, paging, "'key' DESC", "")
+	tempPage, err := c.IdentifiableCouchbasePersistence.GetPageByFilterWithSort(correlationId, filterCondition, params, paging,
+		cdata.NewSortParams([]cdata.SortField{cdata.NewSortField("key", false)}), "")
+	if err != nil {
+		return nil, err
+	}
 	// Convert to DummyPage
 	dataLen := int64(len(tempPage.Data)) // For full release tempPage and delete this by GC
 	data := make([]map[string]interface{}, dataLen)
 	for i, v := range tempPage.Data {
 		data[i] = v.(map[string]interface{})
 	}
-	dataPage := cbfixture.NewMapPage(&dataLen, data)
+	dataPage := cbfixture.NewMapPage(tempPage.Total, data)
 	return dataPage, err
 }
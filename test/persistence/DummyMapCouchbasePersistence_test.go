@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	cconf "github.com/pip-services3-go/pip-services3-commons-go/config"
+	cdata "github.com/pip-services3-go/pip-services3-commons-go/data"
 	cbfixture "github.com/pip-services3-go/pip-services3-couchbase-go/test/fixture"
 	assert "github.com/stretchr/testify/assert"
 )
@@ -70,3 +71,69 @@ func TestDummyMapCouchbasePersistence(t *testing.T) {
 	t.Run("Paging", fixture.TestPaging)
 
 }
+
+func TestDummyMapCouchbasePersistenceNilFields(t *testing.T) {
+	for _, unsetNil := range []bool{false, true} {
+		persistence := NewDummyMapCouchbasePersistence()
+		if !openTestPersistence(t, persistence, "options.unset_nil_fields", unsetNil) {
+			return
+		}
+
+		dummy, err := persistence.Create("", map[string]interface{}{"key": "Key 1", "content": "Content 1"})
+		assert.Nil(t, err)
+		id := dummy["id"].(string)
+
+		patch := cdata.NewEmptyAnyValueMap()
+		patch.Put("key", "Key 2")
+		patch.Put("content", nil)
+		dummy, err = persistence.UpdatePartially("", id, patch)
+		assert.Nil(t, err)
+		assert.Equal(t, "Key 2", dummy["key"])
+
+		result, err := persistence.GetOneById("", id)
+		assert.Nil(t, err)
+		assert.Equal(t, "Key 2", result["key"])
+		_, ok := result["content"]
+		if unsetNil {
+			assert.False(t, ok)
+			_, ok = dummy["content"]
+			assert.False(t, ok)
+		} else {
+			assert.Equal(t, "Content 1", result["content"])
+		}
+
+		// The patched document stays in the collection
+		page, err := persistence.GetPageByFilter("", cdata.NewFilterParamsFromTuples("key", "Key 2"), nil)
+		assert.Nil(t, err)
+		assert.Len(t, page.Data, 1)
+	}
+}
+
+func TestDummyMapCouchbasePersistenceReservedFields(t *testing.T) {
+	persistence := NewDummyMapCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	for i, key := range []string{"Key 1", "Key 2"} {
+		_, err := persistence.Create("", map[string]interface{}{"key": key, "type": "dummy", "order": i, "my-field": "value"})
+		assert.Nil(t, err)
+	}
+
+	// Fields named with reserved words and hyphens are escaped in generated statements
+	count, err := persistence.UpdateManyByFilter("", "", cdata.NewAnyValueMapFromTuples(
+		"type", "updated",
+		"my-field", "updated value",
+	))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), count)
+
+	page, err := persistence.GetPageByFilterWithSort("", "", nil, nil,
+		cdata.NewSortParams([]cdata.SortField{cdata.NewSortField("order", false)}), "")
+	assert.Nil(t, err)
+	assert.Len(t, page.Data, 2)
+	item := page.Data[0].(map[string]interface{})
+	assert.Equal(t, "Key 2", item["key"])
+	assert.Equal(t, "updated", item["type"])
+	assert.Equal(t, "updated value", item["my-field"])
+}
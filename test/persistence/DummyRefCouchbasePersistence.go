@@ -96,11 +96,17 @@ func (c *DummyRefCouchbasePersistence) GetPageByFilter(correlationId string, fil
 	}
 	key := filter.GetAsString("key")
 	filterCondition := ""
+	params := make(map[string]interface{})
 	if key != "" {
-		filterCondition += "key='" + key + "'"
+		filterCondition += "key=$key"
+		params["key"] = key
 	}
 
-	tempPage, err := c.IdentifiableCouchbasePersistence.GetPageByFilter(correlationId, filterCondition, paging, "'key' DESC", "")
+	tempPage, err := c.IdentifiableCouchbasePersistence.GetPageByFilterWithSort(correlationId, filterCondition, params, paging,
+		cdata.NewSortParams([]cdata.SortField{cdata.NewSortField("key", false)}), "")
+	if err != nil {
+		return nil, err
+	}
 
 	// Convert to DummyRefPage
 	dataLen := int64(len(tempPage.Data)) // For full release tempPage and delete this by GC
@@ -109,6 +115,6 @@ func (c *DummyRefCouchbasePersistence) GetPageByFilter(correlationId string, fil
 		temp := tempPage.Data[i].(*cbfixture.Dummy)
 		data[i] = temp
 	}
-	page = cbfixture.NewDummyRefPage(&dataLen, data)
+	page = cbfixture.NewDummyRefPage(tempPage.Total, data)
 	return page, err
 }
@@ -0,0 +1,61 @@
+package test_persistence
+
+import (
+	"testing"
+
+	cconf "github.com/pip-services3-go/pip-services3-commons-go/config"
+	persist "github.com/pip-services3-go/pip-services3-couchbase-go/persistence"
+	assert "github.com/stretchr/testify/assert"
+)
+
+type taggedDummy struct {
+	Key     string `json:"_id"`
+	Content string `json:"content"`
+}
+
+func newTaggedCouchbasePersistence() *persist.GenericCouchbasePersistence[taggedDummy, string] {
+	persistence := persist.NewGenericCouchbasePersistence[taggedDummy, string]("test", "tagged_dummies")
+	persistence.Configure(cconf.NewConfigParamsFromTuples(
+		"options.id_field", "_id",
+	))
+	return persistence
+}
+
+func TestCouchbasePersistenceIdField(t *testing.T) {
+	persistence := newTaggedCouchbasePersistence()
+	assert.Equal(t, "_id", persistence.IdField)
+
+	assert.Equal(t, "1", persistence.ComposeId(taggedDummy{Key: "1"}))
+	assert.Equal(t, "2", persistence.ComposeId(map[string]interface{}{"_id": "2"}))
+
+	var item interface{} = taggedDummy{Content: "Content 1"}
+	persistence.GenerateObjectId(&item)
+	assert.NotEqual(t, "", item.(taggedDummy).Key)
+
+	var mapItem interface{} = map[string]interface{}{"content": "Content 1"}
+	persistence.GenerateObjectId(&mapItem)
+	assert.NotEqual(t, "", mapItem.(map[string]interface{})["_id"])
+}
+
+func TestIdFieldCouchbasePersistence(t *testing.T) {
+	persistence := newTaggedCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	dummy, err := persistence.Create("", taggedDummy{Content: "Content 1"})
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", dummy.Key)
+
+	result, err := persistence.GetOneById("", dummy.Key)
+	assert.Nil(t, err)
+	assert.Equal(t, dummy, result)
+
+	dummy, err = persistence.Create("", taggedDummy{Key: "key1", Content: "Content 2"})
+	assert.Nil(t, err)
+	assert.Equal(t, "key1", dummy.Key)
+
+	result, err = persistence.GetOneById("", "key1")
+	assert.Nil(t, err)
+	assert.Equal(t, "Content 2", result.Content)
+}
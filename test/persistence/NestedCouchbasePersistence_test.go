@@ -0,0 +1,111 @@
+package test_persistence
+
+import (
+	"reflect"
+	"testing"
+
+	cdata "github.com/pip-services3-go/pip-services3-commons-go/data"
+	persist "github.com/pip-services3-go/pip-services3-couchbase-go/persistence"
+	assert "github.com/stretchr/testify/assert"
+)
+
+type nestedCouchbasePersistence struct {
+	persist.IdentifiableCouchbasePersistence
+}
+
+func newNestedCouchbasePersistence() *nestedCouchbasePersistence {
+	proto := reflect.TypeOf(&nestedDummy{})
+	c := &nestedCouchbasePersistence{}
+	c.IdentifiableCouchbasePersistence = *persist.InheritIdentifiableCouchbasePersistence(c, proto, "test", "nested_dummies")
+	return c
+}
+
+func TestNestedCouchbasePersistenceUpdatePartially(t *testing.T) {
+	persistence := newNestedCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	item := &nestedDummy{Id: "1", Name: "Name 1"}
+	item.Address.Home = nestedAddress{City: "City 1", Street: "Street 1"}
+	_, err := persistence.Create("", item)
+	assert.Nil(t, err)
+
+	result, err := persistence.UpdatePartially("", "1", cdata.NewAnyValueMapFromTuples(
+		"name", "Name 2",
+		"address.home.city", "City 2",
+	))
+	assert.Nil(t, err)
+	dummy, ok := result.(*nestedDummy)
+	assert.True(t, ok)
+	assert.Equal(t, "Name 2", dummy.Name)
+	assert.Equal(t, "City 2", dummy.Address.Home.City)
+	assert.Equal(t, "Street 1", dummy.Address.Home.Street)
+
+	// Go field names are matched as well as JSON names
+	_, err = persistence.UpdatePartially("", "1", cdata.NewAnyValueMapFromTuples("Address.Work.City", "City 3"))
+	assert.Nil(t, err)
+
+	result, err = persistence.GetOneById("", "1")
+	assert.Nil(t, err)
+	dummy = result.(*nestedDummy)
+	assert.Equal(t, "Name 2", dummy.Name)
+	assert.Equal(t, nestedAddress{City: "City 2", Street: "Street 1"}, dummy.Address.Home)
+	assert.Equal(t, "City 3", dummy.Address.Work.City)
+}
+
+func TestDummyMapCouchbasePersistenceUpdateNested(t *testing.T) {
+	persistence := NewDummyMapCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	dummy, err := persistence.Create("", map[string]interface{}{
+		"key":     "Key 1",
+		"address": map[string]interface{}{"city": "City 1", "street": "Street 1"},
+	})
+	assert.Nil(t, err)
+	id := dummy["id"].(string)
+
+	dummy, err = persistence.UpdatePartially("", id, cdata.NewAnyValueMapFromTuples(
+		"address.city", "City 2",
+		"location.zip", "12345",
+	))
+	assert.Nil(t, err)
+	assert.Equal(t, "Key 1", dummy["key"])
+
+	result, err := persistence.GetOneById("", id)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"city": "City 2", "street": "Street 1"}, result["address"])
+	// Missing nested objects are created
+	assert.Equal(t, map[string]interface{}{"zip": "12345"}, result["location"])
+}
+
+func TestNestedCouchbasePersistenceCompareAndSet(t *testing.T) {
+	persistence := newNestedCouchbasePersistence()
+	if !openTestPersistence(t, persistence) {
+		return
+	}
+
+	item := &nestedDummy{Id: "1", Name: "Name 1"}
+	item.Address.Home = nestedAddress{City: "City 1", Street: "Street 1"}
+	_, err := persistence.Create("", item)
+	assert.Nil(t, err)
+
+	changed, err := persistence.CompareAndSet("", "1", "address.home.city", "City 1", "City 2")
+	assert.Nil(t, err)
+	assert.True(t, changed)
+
+	// Go field names are resolved to document paths
+	changed, err = persistence.CompareAndSet("", "1", "Address.Home.City", "City 1", "City 3")
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	changed, err = persistence.CompareAndSet("", "1", "Address.Home.City", "City 2", "City 3")
+	assert.Nil(t, err)
+	assert.True(t, changed)
+
+	result, err := persistence.GetOneById("", "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "City 3", result.(*nestedDummy).Address.Home.City)
+	assert.Equal(t, "Street 1", result.(*nestedDummy).Address.Home.Street)
+}
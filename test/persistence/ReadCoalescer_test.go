@@ -0,0 +1,48 @@
+package test_persistence
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	persist "github.com/pip-services3-go/pip-services3-couchbase-go/persistence"
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestReadCoalescer(t *testing.T) {
+	coalescer := persist.NewReadCoalescer()
+
+	var calls int32
+	release := make(chan struct{})
+	read := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "value", nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 50)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _, _ = coalescer.Do("1", read)
+		}(i)
+	}
+	// Give all readers time to join the read in flight
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	for _, result := range results {
+		assert.Equal(t, "value", result)
+	}
+
+	// The key is released after the read is completed
+	result, err, shared := coalescer.Do("1", func() (interface{}, error) { return "next", nil })
+	assert.Nil(t, err)
+	assert.False(t, shared)
+	assert.Equal(t, "next", result)
+}
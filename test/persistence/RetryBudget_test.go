@@ -0,0 +1,98 @@
+package test_persistence
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	cerr "github.com/pip-services3-go/pip-services3-commons-go/errors"
+	persist "github.com/pip-services3-go/pip-services3-couchbase-go/persistence"
+	cbfixture "github.com/pip-services3-go/pip-services3-couchbase-go/test/fixture"
+	assert "github.com/stretchr/testify/assert"
+	gocb "gopkg.in/couchbase/gocb.v1"
+)
+
+func TestRetryBudget(t *testing.T) {
+	budget := persist.NewRetryBudget(5)
+
+	// Transient failures retried in a tight loop are bounded by the budget
+	retries := 0
+	for i := 0; i < 100; i++ {
+		if budget.TryAcquire() {
+			retries++
+		}
+	}
+	assert.Equal(t, 5, retries)
+	assert.False(t, budget.TryAcquire())
+
+	// The budget is refilled over time
+	time.Sleep(250 * time.Millisecond)
+	assert.True(t, budget.TryAcquire())
+}
+
+func TestRetryBudgetBoundsRetries(t *testing.T) {
+	// The backend fails transiently on every call
+	queries := 0
+	operations := &stubBucketOperations{
+		query: func(statement string) (gocb.QueryResults, error) {
+			queries++
+			return nil, errors.New("[12008] Index not ready for serving queries")
+		},
+	}
+	persistence := openStubPersistence(t, operations,
+		"options.index_wait", 10000,
+		"options.retry_budget_per_sec", 2,
+	)
+
+	// Queries are retried only while the budget lasts, not until index_wait expires
+	start := time.Now()
+	_, err := persistence.GetCountByFilter("", "")
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, queries)
+	assert.True(t, time.Since(start) < 2*time.Second)
+
+	// The exhausted budget is shared, so the next query fails fast
+	_, err = persistence.GetCountByFilter("", "")
+	assert.NotNil(t, err)
+	assert.Equal(t, 4, queries)
+
+	// Concurrent update retries stop when the budget is exhausted
+	upserts := 0
+	operations = &stubBucketOperations{
+		get: func(key string, valuePtr interface{}) (gocb.Cas, error) {
+			*valuePtr.(*map[string]interface{}) = map[string]interface{}{"id": "1", "key": "Key 1", "_c": "dummies"}
+			return 1, nil
+		},
+		upsert: func(key string, path string, value interface{}, cas gocb.Cas) (gocb.Cas, error) {
+			upserts++
+			return 0, gocb.ErrKeyExists
+		},
+	}
+	persistence = openStubPersistence(t, operations, "options.retry_budget_per_sec", 2)
+
+	changed, err := persistence.CompareAndSet("", "1", "key", "Key 1", "Key 2")
+	assert.False(t, changed)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "CONCURRENT_UPDATE", err.(*cerr.ApplicationError).Code)
+	}
+	assert.Equal(t, 3, upserts)
+
+	// Operations are not repeated after reconnect when the budget is exhausted
+	inserts := 0
+	operations = &stubBucketOperations{}
+	persistence = openStubPersistence(t, operations, "options.retry_budget_per_sec", 1)
+	operations.insert = func(key string, value interface{}) (gocb.Cas, error) {
+		inserts++
+		// The connection is reopened by its owner, but fails again
+		persistence.Connection.Bucket = &gocb.Bucket{}
+		return 0, gocb.ErrNetwork
+	}
+
+	_, err = persistence.Create("", cbfixture.Dummy{Id: "1", Key: "Key 1", Content: "Content 1"})
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, inserts)
+
+	_, err = persistence.Create("", cbfixture.Dummy{Id: "2", Key: "Key 2", Content: "Content 2"})
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, inserts)
+}